@@ -0,0 +1,406 @@
+package main
+
+import (
+	"debug/elf"
+	"sort"
+)
+
+type symbol struct {
+	name    string
+	addr    uint32
+	section *asmSection
+	line    int
+	// references to the label, and how many of them are B or B<c>
+	refs, jumps int
+}
+
+// local tells if the label is only a branch target inside the source,
+// like a loop, others may be entry points for the code linked with it
+func (this *symbol) local() bool {
+	return this.refs > 0 && this.refs == this.jumps
+}
+
+type literal struct {
+	value *operand
+	addr  uint32
+}
+
+// reloc is a reference to a symbol defined outside of the source, or
+// to a label of the given section, only made when assembling an object
+// file. The addend of labels is their offset in the section
+type reloc struct {
+	addr    uint32
+	kind    elf.R_ARM
+	symbol  string
+	section *asmSection
+}
+
+type asmSection struct {
+	name     string
+	addr     uint32
+	size     uint32
+	contents []byte
+	node     *sectionNode
+
+	// literal pool, placed word aligned at the end of the section
+	pool     []*literal
+	poolAddr uint32
+
+	relocs []*reloc
+	// where the contents switch between code and data
+	marks []mark
+}
+
+type mark struct {
+	addr uint32
+	code bool
+}
+
+// isCode tells if addr is in a run of instructions
+func (this *asmSection) isCode(addr uint32) bool {
+	code := false
+	for _, m := range this.marks {
+		if m.addr > addr {
+			break
+		}
+		code = m.code
+	}
+	return code
+}
+
+// setMark records a switch between code and data at addr
+func (this *asmSection) setMark(addr uint32, code bool) {
+	if n := len(this.marks); n > 0 && this.marks[n-1].code == code {
+		return
+	}
+	this.marks = append(this.marks, mark{addr: addr, code: code})
+}
+
+func (this *asmSection) end() uint32 {
+	return this.addr + this.size
+}
+
+type object struct {
+	sections []*asmSection
+	symbols  map[string]*symbol
+}
+
+// memoryMaps returns one region per section, sorted by address
+func (this *object) memoryMaps() []*memoryMap {
+	out := []*memoryMap{}
+	for _, s := range this.sections {
+		if len(s.contents) == 0 {
+			continue
+		}
+		out = append(out, &memoryMap{addr: s.addr, contents: s.contents})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].addr < out[j].addr
+	})
+	return out
+}
+
+// flat returns the contents of all sections laid out from the lowest
+// address, with gaps filled with zeroes
+func (this *object) flat() []byte {
+	return flatten(this.memoryMaps())
+}
+
+// entry returns the reset handler of the vector table that starts the
+// first section, or zero if there is none
+func (this *object) entry() uint32 {
+	if len(this.sections) == 0 {
+		return 0
+	}
+	table, err := readVectorTable(this.memoryMaps(), this.sections[0].addr)
+	if err != nil {
+		return 0
+	}
+	return table[1].value
+}
+
+type assembler struct {
+	consts   map[string]int64
+	symbols  map[string]*symbol
+	sections []*asmSection
+	// undefined symbols are left to the linker
+	relocatable bool
+}
+
+func assemble(mod *module) (*object, error) {
+	return assembleMode(mod, false)
+}
+
+// assembleObject leaves the references to undefined symbols to the linker
+func assembleObject(mod *module) (*object, error) {
+	return assembleMode(mod, true)
+}
+
+func assembleMode(mod *module, relocatable bool) (*object, error) {
+	this := &assembler{
+		consts:      map[string]int64{},
+		symbols:     map[string]*symbol{},
+		relocatable: relocatable,
+	}
+	for _, c := range mod.consts {
+		if _, ok := this.consts[c.name]; ok {
+			return nil, lineErr(c.line, "constant '%v' redefined", c.name)
+		}
+		this.consts[c.name] = c.value
+	}
+	for _, node := range mod.sections {
+		s, err := this.layout(node)
+		if err != nil {
+			return nil, err
+		}
+		this.sections = append(this.sections, s)
+	}
+	if err := this.checkOverlap(); err != nil {
+		return nil, err
+	}
+	for _, s := range this.sections {
+		if err := this.emit(s); err != nil {
+			return nil, err
+		}
+	}
+	return &object{sections: this.sections, symbols: this.symbols}, nil
+}
+
+// first pass: computes the address of every label and the size of the section
+func (this *assembler) layout(node *sectionNode) (*asmSection, error) {
+	s := &asmSection{name: node.name, addr: node.addr, node: node}
+	if node.addr%2 != 0 {
+		return nil, lineErr(node.line, "section '%v' is not halfword aligned", node.name)
+	}
+	addr := node.addr
+	for _, stmt := range node.stmts {
+		switch stmt.kind {
+		case stLabel:
+			if err := this.define(stmt, s, addr); err != nil {
+				return nil, err
+			}
+		case stMem:
+			addr += memSize(stmt)
+		case stInstr:
+			if addr%2 != 0 {
+				return nil, lineErr(stmt.line, "instruction is not halfword aligned")
+			}
+			addr += instrSize(stmt.mnemonic)
+			for _, op := range stmt.operands {
+				if op.kind == opSugar {
+					s.pool = append(s.pool, &literal{value: op.terms[0]})
+				}
+			}
+		}
+	}
+	s.poolAddr = align(addr, 4)
+	if len(s.pool) > 0 {
+		addr = s.poolAddr + uint32(len(s.pool))*4
+	}
+	s.size = addr - s.addr
+	return s, nil
+}
+
+func (this *assembler) define(stmt *statement, s *asmSection, addr uint32) error {
+	if _, ok := this.consts[stmt.label]; ok {
+		return lineErr(stmt.line, "label '%v' has the same name as a constant", stmt.label)
+	}
+	if other, ok := this.symbols[stmt.label]; ok {
+		return lineErr(stmt.line, "label '%v' already defined at line %v", stmt.label, other.line)
+	}
+	this.symbols[stmt.label] = &symbol{
+		name:    stmt.label,
+		addr:    addr,
+		section: s,
+		line:    stmt.line,
+	}
+	return nil
+}
+
+func (this *assembler) checkOverlap() error {
+	sorted := append([]*asmSection{}, this.sections...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].addr < sorted[j].addr
+	})
+	for i := 1; i < len(sorted); i++ {
+		prev, curr := sorted[i-1], sorted[i]
+		if prev.end() > curr.addr {
+			return lineErr(curr.node.line, "section '%v' overlaps section '%v'", curr.name, prev.name)
+		}
+	}
+	return nil
+}
+
+// second pass: encodes every statement
+func (this *assembler) emit(s *asmSection) error {
+	addr := s.addr
+	pool := s.pool
+	for i, lit := range pool {
+		lit.addr = s.poolAddr + uint32(i)*4
+	}
+	for _, stmt := range s.node.stmts {
+		switch stmt.kind {
+		case stMem:
+			s.setMark(addr, false)
+			data, err := this.encodeMem(s, addr, stmt)
+			if err != nil {
+				return err
+			}
+			s.contents = append(s.contents, data...)
+			addr += uint32(len(data))
+		case stInstr:
+			s.setMark(addr, true)
+			ctx := &instrCtx{
+				asm:     this,
+				section: s,
+				stmt:    stmt,
+				addr:    addr,
+			}
+			for _, op := range stmt.operands {
+				if op.kind == opSugar {
+					ctx.lit = pool[0]
+					pool = pool[1:]
+				}
+			}
+			code, err := encodeInstr(ctx)
+			if err != nil {
+				return err
+			}
+			s.contents = append(s.contents, code...)
+			addr += uint32(len(code))
+		}
+	}
+	if len(s.pool) > 0 {
+		for addr < s.poolAddr {
+			s.contents = append(s.contents, 0)
+			addr++
+		}
+		s.setMark(s.poolAddr, false)
+		for _, lit := range s.pool {
+			v, err := this.word(s, lit.addr, lit.value)
+			if err != nil {
+				return err
+			}
+			s.contents = appendU32(s.contents, uint32(v))
+		}
+	}
+	return nil
+}
+
+func (this *assembler) encodeMem(s *asmSection, addr uint32, stmt *statement) ([]byte, error) {
+	if stmt.value == nil {
+		return stmt.str, nil
+	}
+	var v int64
+	var err error
+	if stmt.memSize == 4 {
+		v, err = this.word(s, addr, stmt.value)
+	} else if this.label(stmt.value) != nil {
+		err = lineErr(stmt.line, "the address of '%v' is only known once linked, use a word", stmt.value.name)
+	} else {
+		v, err = this.eval(stmt.value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bits := stmt.memSize * 8
+	if bits < 32 && (v >= 1<<bits || v < -(1<<(bits-1))) {
+		return nil, lineErr(stmt.line, "value %v does not fit in %v bytes", v, stmt.memSize)
+	}
+	out := []byte{}
+	for i := uint32(0); i < stmt.memSize; i++ {
+		out = append(out, byte(v>>(i*8)))
+	}
+	return out, nil
+}
+
+// word evaluates a word of data at addr, references to symbols are
+// relocated in objects with the addend stored in place
+func (this *assembler) word(s *asmSection, addr uint32, op *operand) (int64, error) {
+	if this.external(op) {
+		s.relocate(addr, elf.R_ARM_ABS32, op.name)
+		return op.value, nil
+	}
+	if sy := this.label(op); sy != nil {
+		sy.refs++
+		s.relocateLabel(addr, elf.R_ARM_ABS32, sy)
+		return int64(sy.addr-sy.section.addr) + op.value, nil
+	}
+	return this.eval(op)
+}
+
+func (this *asmSection) relocate(addr uint32, kind elf.R_ARM, symbol string) {
+	this.relocs = append(this.relocs, &reloc{addr: addr, kind: kind, symbol: symbol})
+}
+
+// relocateLabel relocates against the section of the label, so that
+// the linker may place it anywhere
+func (this *asmSection) relocateLabel(addr uint32, kind elf.R_ARM, sy *symbol) {
+	this.relocs = append(this.relocs, &reloc{addr: addr, kind: kind, section: sy.section})
+}
+
+// external tells if the expression refers to a symbol left to the
+// linker, which only happens when assembling an object file
+func (this *assembler) external(op *operand) bool {
+	if !this.relocatable || op.kind != opExpr || op.name == "" {
+		return false
+	}
+	_, isConst := this.consts[op.name]
+	_, isLabel := this.symbols[op.name]
+	return !isConst && !isLabel
+}
+
+// label returns the label an expression refers to when assembling an
+// object file, where the address of labels depends on the linker
+func (this *assembler) label(op *operand) *symbol {
+	if !this.relocatable || op.kind != opExpr || op.name == "" {
+		return nil
+	}
+	return this.symbols[op.name]
+}
+
+// eval resolves an expression to its value, names may refer
+// to constants or labels
+func (this *assembler) eval(op *operand) (int64, error) {
+	if op.kind != opExpr {
+		return 0, lineErr(op.line, "expected a value, found %v", op)
+	}
+	if op.name == "" {
+		return op.value, nil
+	}
+	if c, ok := this.consts[op.name]; ok {
+		return c + op.value, nil
+	}
+	if sy, ok := this.symbols[op.name]; ok {
+		sy.refs++
+		return int64(sy.addr) + op.value, nil
+	}
+	return 0, lineErr(op.line, "undefined symbol '%v'", op.name)
+}
+
+func memSize(stmt *statement) uint32 {
+	if stmt.value == nil {
+		return uint32(len(stmt.str))
+	}
+	return stmt.memSize
+}
+
+func instrSize(mnemonic string) uint32 {
+	switch mnemonic {
+	case "BL", "DMB", "DSB", "ISB", "MRS", "MSR", "UDF.W":
+		return 4
+	}
+	return 2
+}
+
+func align(addr, n uint32) uint32 {
+	return (addr + n - 1) &^ (n - 1)
+}
+
+func appendU16(buff []byte, hw uint16) []byte {
+	return append(buff, byte(hw), byte(hw>>8))
+}
+
+func appendU32(buff []byte, w uint32) []byte {
+	return append(buff, byte(w), byte(w>>8), byte(w>>16), byte(w>>24))
+}
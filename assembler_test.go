@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"testing"
+)
+
+const objectSource = `section text at 0x10000000:
+	$0x20001000 w
+	$_reset+1 w
+_reset:
+	ldr r0, =table
+	movs r1, #3
+loop:
+	subs r1, #1
+	bne loop
+	bl helper
+	bl printf
+	b _reset
+table:
+	$printf+4 w
+
+section fast at 0x10000100:
+helper:
+	bx lr
+`
+
+func TestExecutable(t *testing.T) {
+	mod, err := parse(objectSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := assemble(mod); err == nil {
+		t.Fatal("undefined printf assembled into an executable")
+	}
+	mod, err = parse(objectSource[:len(objectSource)-len("\tbx lr\n")] + "printf:\n\tbx lr\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := assemble(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps, entry, err := readELF(writeExecutable(obj, obj.entry()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != 0x10000009 || len(maps) != 2 || maps[0].addr != 0x10000000 || maps[1].addr != 0x10000100 {
+		t.Errorf("entry 0x%08X and %v regions", entry, len(maps))
+	}
+	if !bytes.Equal(maps[0].contents, obj.sections[0].contents) {
+		t.Errorf("the contents of the executable differ from the assembled ones")
+	}
+}
+
+func TestObject(t *testing.T) {
+	mod, err := parse(objectSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := assembleObject(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := writeObject(obj)
+	if _, _, err := readELF(data); err == nil {
+		t.Error("objects have no image")
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	symbols := []struct {
+		name  string
+		value uint64
+		bind  elf.SymBind
+		kind  elf.SymType
+	}{
+		{"_reset", 0x9, elf.STB_GLOBAL, elf.STT_FUNC},
+		{"loop", 0xC, elf.STB_LOCAL, elf.STT_NOTYPE},
+		{"table", 0x1A, elf.STB_GLOBAL, elf.STT_OBJECT},
+		{"helper", 0x1, elf.STB_GLOBAL, elf.STT_FUNC},
+		{"printf", 0, elf.STB_GLOBAL, elf.STT_NOTYPE},
+	}
+	byName := map[string]elf.Symbol{}
+	for _, s := range syms {
+		byName[s.Name] = s
+	}
+	for _, expected := range symbols {
+		s, ok := byName[expected.name]
+		if !ok {
+			t.Errorf("%v is missing", expected.name)
+			continue
+		}
+		if s.Value != expected.value || elf.ST_BIND(s.Info) != expected.bind || elf.ST_TYPE(s.Info) != expected.kind {
+			t.Errorf("%v is 0x%X %v %v, expected 0x%X %v %v", s.Name, s.Value, elf.ST_BIND(s.Info), elf.ST_TYPE(s.Info),
+				expected.value, expected.bind, expected.kind)
+		}
+	}
+
+	// symbol names of the relocations, the sections for labels
+	text, err := f.Section(".text").Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := f.Section(".rel.text")
+	if rel == nil {
+		t.Fatal(".rel.text is missing")
+	}
+	relocs := []struct {
+		offset uint32
+		kind   elf.R_ARM
+		symbol string
+		// in place addend of R_ARM_ABS32
+		addend uint32
+	}{
+		{0x4, elf.R_ARM_ABS32, ".text", 0x9},
+		{0x10, elf.R_ARM_THM_PC22, ".fast", 0},
+		{0x14, elf.R_ARM_THM_PC22, "printf", 0},
+		{0x1A, elf.R_ARM_ABS32, "printf", 0x4},
+		{0x20, elf.R_ARM_ABS32, ".text", 0x1A},
+	}
+	entries, err := rel.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(relocs)*8 {
+		t.Fatalf("%v relocations, expected %v", len(entries)/8, len(relocs))
+	}
+	for i, expected := range relocs {
+		offset := readLE(entries[i*8:], 4)
+		info := readLE(entries[i*8+4:], 4)
+		name := ""
+		if sym := int(info>>8) - 1; sym >= 0 && sym < len(syms) {
+			name = syms[sym].Name
+			if elf.ST_TYPE(syms[sym].Info) == elf.STT_SECTION {
+				name = f.Sections[syms[sym].Section].Name
+			}
+		}
+		if offset != expected.offset || elf.R_ARM(info&0xFF) != expected.kind || name != expected.symbol {
+			t.Errorf("relocation %v is %v at 0x%X against %q, expected %v at 0x%X against %q", i,
+				elf.R_ARM(info&0xFF), offset, name, expected.kind, expected.offset, expected.symbol)
+		}
+		if expected.kind == elf.R_ARM_ABS32 && readLE(text[offset:], 4) != expected.addend {
+			t.Errorf("relocation %v has the addend 0x%X, expected 0x%X", i, readLE(text[offset:], 4), expected.addend)
+		}
+	}
+}
+
+func TestObjectErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"section a at 0x0:\n\tb far\nsection b at 0x100:\nfar:\n\tbx lr\n", "2: B: 'far' is in section 'b', only BL and words may refer to other sections of an object"},
+		{"section a at 0x0:\nhere:\n\t$here hw\n", "3: the address of 'here' is only known once linked, use a word"},
+	}
+	for _, test := range tests {
+		mod, err := parse(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = assembleObject(mod)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: got error %v, expected %q", test.src, err, test.err)
+		}
+	}
+}
+
+// an encoder disagreeing with the layout is an error, not a crash
+func TestSizeMismatch(t *testing.T) {
+	encoders["TEST"] = func(ctx *instrCtx) ([]uint16, error) {
+		return []uint16{0xBF00, 0xBF00}, nil
+	}
+	defer delete(encoders, "TEST")
+	ctx := &instrCtx{stmt: &statement{kind: stInstr, mnemonic: "TEST", line: 7}}
+	_, err := encodeInstr(ctx)
+	if err == nil || err.Error() != "7: TEST: encoded on 4 bytes instead of 2" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// the bootrom copies the first 256 bytes of flash to the end of
+	// SRAM and runs them if the last word is a valid CRC
+	boot2Addr = 0x10000000
+	boot2Size = 256
+	boot2SRAM = 0x20041F00
+)
+
+// boot2Variants maps the sha256 of a boot2 block to its name, add
+// the hash printed by ras for builds of the pico-sdk boot2 sources
+var boot2Variants = map[string]string{
+	// boot2_w25q080.S with the default clock divider of 2
+	"a1408dd2691089af701a1cad19530c539064608566633b9619d15b40d0357b1e": "w25q080",
+}
+
+type boot2 struct {
+	region   *memoryMap
+	crc      uint32
+	computed uint32
+	sha256   string
+}
+
+func (this *boot2) ok() bool {
+	return this.crc == this.computed
+}
+
+func (this *boot2) variant() string {
+	if name, ok := boot2Variants[this.sha256]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (this *boot2) String() string {
+	out := fmt.Sprintf("boot2 at 0x%08X, runs at 0x%08X\n", boot2Addr, boot2SRAM)
+	out += fmt.Sprintf("\tCRC 0x%08X ok\n", this.crc)
+	out += fmt.Sprintf("\tvariant %v, sha256 %v\n", this.variant(), this.sha256)
+	return out
+}
+
+// readBoot2 returns the first 256 bytes of flash as a boot2 block,
+// whether its CRC is valid or not, and the index of their region
+func readBoot2(maps []*memoryMap) (*boot2, int) {
+	for i, m := range maps {
+		if m.addr != boot2Addr || len(m.contents) < boot2Size {
+			continue
+		}
+		block := m.contents[:boot2Size]
+		sum := sha256.Sum256(block)
+		return &boot2{
+			region:   &memoryMap{addr: boot2Addr, contents: block},
+			crc:      uint32(block[252]) | uint32(block[253])<<8 | uint32(block[254])<<16 | uint32(block[255])<<24,
+			computed: boot2CRC(block[:boot2Size-4]),
+			sha256:   hex.EncodeToString(sum[:]),
+		}, i
+	}
+	return nil, 0
+}
+
+// boot2Missing explains why the start of flash is not a boot2 block,
+// or returns an empty string if it is one or if there's no flash
+func boot2Missing(maps []*memoryMap) string {
+	b, _ := readBoot2(maps)
+	if b == nil || b.ok() {
+		return ""
+	}
+	return fmt.Sprintf("no valid boot2 found: CRC 0x%08X, expected 0x%08X", b.crc, b.computed)
+}
+
+// splitBoot2 detects the boot2 block at the start of flash and splits it
+// from the application, the maps are left untouched unless its CRC is
+// the one the bootrom checks
+func splitBoot2(maps []*memoryMap) (*boot2, []*memoryMap) {
+	out, i := readBoot2(maps)
+	if out == nil || !out.ok() {
+		return nil, maps
+	}
+	m := maps[i]
+	app := append([]*memoryMap{}, maps[:i]...)
+	if len(m.contents) > boot2Size {
+		app = append(app, &memoryMap{addr: boot2Addr + boot2Size, contents: m.contents[boot2Size:]})
+	}
+	return out, append(app, maps[i+1:]...)
+}
+
+// boot2CRC is the CRC32 checked by the bootrom: polynomial 0x04C11DB7,
+// initial value 0xFFFFFFFF, no reflection and no final xor
+func boot2CRC(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBoot2(t *testing.T) {
+	block, err := ioutil.ReadFile(filepath.Join("testdata", "boot2_w25q080.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := []byte{0x00, 0x10, 0x04, 0x20, 0xF7, 0x00, 0x00, 0x10}
+	flash := &memoryMap{addr: boot2Addr, contents: append(append([]byte{}, block...), app...)}
+	boot, maps := splitBoot2([]*memoryMap{flash})
+	if boot == nil {
+		t.Fatal("boot2 not found")
+	}
+	if boot.variant() != "w25q080" {
+		t.Errorf("variant is %v", boot.variant())
+	}
+	if len(maps) != 1 || maps[0].addr != boot2Addr+boot2Size || len(maps[0].contents) != len(app) {
+		t.Errorf("the application is not split from boot2")
+	}
+	if msg := boot2Missing([]*memoryMap{flash}); msg != "" {
+		t.Errorf("valid boot2 reported as %q", msg)
+	}
+
+	// a wrong CRC leaves the flash to the application
+	flash.contents[0x10] ^= 0xFF
+	boot, maps = splitBoot2([]*memoryMap{flash})
+	if boot != nil || len(maps) != 1 || maps[0] != flash {
+		t.Errorf("boot2 with a wrong CRC is split from the application")
+	}
+	if msg := boot2Missing([]*memoryMap{flash}); !strings.HasPrefix(msg, "no valid boot2 found") {
+		t.Errorf("invalid boot2 reported as %q", msg)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// In file container blocks the address is an offset in the file, the
+// family ID field holds the size of the file and the file name follows
+// the payload, terminated by a zero byte.
+
+type containedFile struct {
+	name     string
+	contents []byte
+}
+
+// parseFileName reads the name that follows the payload
+func parseFileName(data []byte, payloadSize uint32) string {
+	name := data[payloadSize:]
+	for i, b := range name {
+		if b == 0 {
+			return string(name[:i])
+		}
+	}
+	return string(name)
+}
+
+// unpackFiles puts the file container blocks back together, a file
+// with missing pieces is reported instead of being filled with zeroes
+func unpackFiles(blocks []*uf2block) ([]*containedFile, []error) {
+	pieces := map[string][]*uf2block{}
+	names := []string{}
+	for _, b := range blocks {
+		if !b.flags.FileContainer {
+			continue
+		}
+		if _, ok := pieces[b.fileName]; !ok {
+			names = append(names, b.fileName)
+		}
+		pieces[b.fileName] = append(pieces[b.fileName], b)
+	}
+
+	out := []*containedFile{}
+	errs := []error{}
+	for _, name := range names {
+		f, err := joinFile(name, pieces[name])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		out = append(out, f)
+	}
+	return out, errs
+}
+
+func joinFile(name string, blocks []*uf2block) (*containedFile, error) {
+	if err := checkFileName(name); err != nil {
+		return nil, err
+	}
+	size := blocks[0].something
+	covered := map[uint32]bool{}
+	for _, b := range blocks {
+		if b.something != size {
+			return nil, fmt.Errorf("%v: blocks disagree on the file size, %v and %v", name, size, b.something)
+		}
+		if b.addr+b.payloadSize > size || b.addr+b.payloadSize < b.addr {
+			return nil, fmt.Errorf("%v: block at offset %v goes past the end of the file", name, b.addr)
+		}
+		for i := uint32(0); i < b.payloadSize; i++ {
+			covered[b.addr+i] = true
+		}
+	}
+	if uint32(len(covered)) != size {
+		return nil, fmt.Errorf("%v: incomplete, only %v of %v bytes are present", name, len(covered), size)
+	}
+	contents := make([]byte, size)
+	for _, b := range blocks {
+		copy(contents[b.addr:], b.payload)
+	}
+	return &containedFile{name: name, contents: contents}, nil
+}
+
+// checkFileName rejects names that would be written outside of the
+// output directory
+func checkFileName(name string) error {
+	if name == "" {
+		return fmt.Errorf("file with an empty name")
+	}
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return fmt.Errorf("%v: absolute file name", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return fmt.Errorf("%v: file name leaves the directory", name)
+		}
+	}
+	return nil
+}
+
+func writeFiles(dir string, files []*containedFile) error {
+	for _, f := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filename, f.contents, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFiles reads every regular file under dir, names are relative
+// to dir and use forward slashes
+func readFiles(dir string) ([]*containedFile, error) {
+	out := []*containedFile{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		out = append(out, &containedFile{name: filepath.ToSlash(rel), contents: contents})
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].name < out[j].name
+	})
+	return out, err
+}
+
+// packFiles splits the files into file container blocks
+func packFiles(files []*containedFile) ([]*uf2block, error) {
+	out := []*uf2block{}
+	for _, f := range files {
+		if len(f.name)+1 > uf2DataSize-uf2PayloadSize {
+			return nil, fmt.Errorf("%v: file name is too long", f.name)
+		}
+		for offset := 0; offset == 0 || offset < len(f.contents); offset += uf2PayloadSize {
+			end := offset + uf2PayloadSize
+			if end > len(f.contents) {
+				end = len(f.contents)
+			}
+			b := &uf2block{
+				addr:        uint32(offset),
+				payloadSize: uint32(end - offset),
+				something:   uint32(len(f.contents)),
+				payload:     f.contents[offset:end],
+				fileName:    f.name,
+			}
+			b.flags.FileContainer = true
+			out = append(out, b)
+		}
+	}
+	for i, b := range out {
+		b.seqBlockNum = uint32(i)
+		b.totBlockNum = uint32(len(out))
+	}
+	return out, nil
+}
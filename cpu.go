@@ -0,0 +1,700 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// ARMv6-M core executing the instructions of decodeInstr
+
+type haltKind int
+
+const (
+	haltBreakpoint haltKind = iota // BKPT
+	haltUndefined                  // UDF or an encoding decodeInstr does not know
+	haltFault                      // bus errors, unaligned accesses, leaving Thumb state
+	haltWait                       // WFI with nothing to wake the core
+	haltLimit                      // the step limit was reached
+	haltReset                      // a system reset request through AIRCR
+)
+
+// halt stops the emulation, pc is the address of the instruction that
+// caused it
+type halt struct {
+	kind haltKind
+	pc   uint32
+	msg  string
+}
+
+func (this *halt) Error() string {
+	return fmt.Sprintf("0x%08X: %v", this.pc, this.msg)
+}
+
+type cpu struct {
+	// r15 holds the address of the instruction being executed
+	r          [16]uint32
+	n, z, c, v bool
+	// the stack pointer not selected by CONTROL.SPSEL
+	otherSP uint32
+	control uint32
+	primask bool
+	// set by SEV, cleared by WFE
+	event bool
+	// exception number of the running handler, zero in thread mode
+	ipsr uint32
+	scs  *systemControl
+	// DEMCR.VC_HARDERR, the faults halt instead of running the HardFault
+	// handler, handing control to the host
+	catchHardFault bool
+
+	bus bus
+	// executed instructions
+	steps uint64
+	// approximate cycles, they drive the SysTick
+	cycles uint64
+
+	// set by branches, where execution continues
+	next     uint32
+	branched bool
+	// set by BX and POP of an EXC_RETURN value in handler mode
+	excReturn uint32
+	// the last instruction completed by step, or nil if it entered
+	// an exception
+	executed *instr
+	entered  uint32
+}
+
+func newCPU(b bus) *cpu {
+	out := &cpu{scs: newSystemControl(0)}
+	out.bus = &privateBus{bus: b, cpu: out}
+	return out
+}
+
+// reset loads the initial SP and the reset handler from the vector
+// table at vtor
+func (this *cpu) reset(vtor uint32) error {
+	sp, err := this.bus.read(vtor, 4)
+	if err != nil {
+		return err
+	}
+	pc, err := this.bus.read(vtor+4, 4)
+	if err != nil {
+		return err
+	}
+	this.r = [16]uint32{}
+	this.setSP(sp)
+	this.r[14] = 0xFFFFFFFF
+	this.r[15] = pc &^ 1
+	this.n, this.z, this.c, this.v = false, false, false, false
+	this.control = 0
+	this.primask = false
+	this.ipsr = 0
+	this.scs = newSystemControl(vtor)
+	if pc&1 == 0 {
+		return &halt{kind: haltFault, pc: pc, msg: "reset handler without the Thumb bit"}
+	}
+	return nil
+}
+
+// run executes up to max instructions, zero means no limit, until
+// something halts the core
+func (this *cpu) run(max uint64) *halt {
+	for i := uint64(0); max == 0 || i < max; i++ {
+		if h := this.step(); h != nil {
+			return h
+		}
+	}
+	return &halt{kind: haltLimit, pc: this.r[15], msg: "instruction limit reached"}
+}
+
+// fetch decodes the instruction at PC
+func (this *cpu) fetch() (*instr, *halt) {
+	pc := this.r[15]
+	hw, err := this.bus.read(pc, 2)
+	if err != nil {
+		return nil, this.fault(err)
+	}
+	data := appendU16(nil, uint16(hw))
+	if is32bit(uint16(hw)) {
+		hw2, err := this.bus.read(pc+2, 2)
+		if err != nil {
+			return nil, this.fault(err)
+		}
+		data = appendU16(data, uint16(hw2))
+	}
+	in := &instr{addr: pc}
+	decodeInstr(newReadBuffer(data), in)
+	return in, nil
+}
+
+// step executes one instruction, or enters the exception that
+// preempts it. Faults enter the HardFault handler
+func (this *cpu) step() *halt {
+	this.executed = nil
+	this.entered = 0
+	if n, ok := this.nextException(); ok {
+		return this.enter(n, this.r[15])
+	}
+	in, h := this.fetch()
+	if h != nil {
+		return this.hardFault(h)
+	}
+	this.branched = false
+	this.excReturn = 0
+	if h := this.execute(in); h != nil {
+		if h.kind == haltFault || h.kind == haltUndefined {
+			return this.hardFault(h)
+		}
+		return h
+	}
+	this.steps++
+	this.executed = in
+	this.addCycles(cycles(in, this.branched))
+	if this.scs.resetRequested {
+		this.scs.resetRequested = false
+		return &halt{kind: haltReset, pc: in.addr, msg: "system reset requested"}
+	}
+	if this.excReturn != 0 {
+		if h := this.exceptionReturn(this.excReturn); h != nil {
+			return this.hardFault(h)
+		}
+		return nil
+	}
+	if this.branched {
+		this.r[15] = this.next
+	} else {
+		this.r[15] += in.size
+	}
+	return nil
+}
+
+func (this *cpu) fault(err error) *halt {
+	return &halt{kind: haltFault, pc: this.r[15], msg: err.Error()}
+}
+
+func (this *cpu) faultf(format string, a ...any) *halt {
+	return &halt{kind: haltFault, pc: this.r[15], msg: fmt.Sprintf(format, a...)}
+}
+
+// get reads a register, the PC reads as the instruction address plus 4
+func (this *cpu) get(r uint16) uint32 {
+	if r == 15 {
+		return this.r[15] + 4
+	}
+	return this.r[r]
+}
+
+// set writes a register, writing the PC is a branch
+func (this *cpu) set(r uint16, v uint32) {
+	switch r {
+	case 13:
+		this.setSP(v)
+	case 15:
+		this.branch(v &^ 1)
+	default:
+		this.r[r] = v
+	}
+}
+
+// the two low bits of the stack pointers always read as zero
+func (this *cpu) setSP(v uint32) {
+	this.r[13] = v &^ 0b11
+}
+
+func (this *cpu) branch(addr uint32) {
+	this.next = addr
+	this.branched = true
+}
+
+// bxWritePC branches to an interworking address, which must have the
+// Thumb bit set since ARMv6-M has no ARM state. In handler mode,
+// EXC_RETURN values return from the exception
+func (this *cpu) bxWritePC(addr uint32) *halt {
+	if this.ipsr != 0 && addr>>28 == 0xF {
+		this.excReturn = addr
+		return nil
+	}
+	if addr&1 == 0 {
+		return this.faultf("branch to 0x%08X without the Thumb bit", addr)
+	}
+	this.branch(addr &^ 1)
+	return nil
+}
+
+// value returns the value of a register or immediate operand
+func (this *cpu) value(a arg) uint32 {
+	if a.kind == argReg {
+		return this.get(a.reg)
+	}
+	return uint32(a.value)
+}
+
+func (this *cpu) setNZ(result uint32) {
+	this.n = result&0x80000000 != 0
+	this.z = result == 0
+}
+
+// addWithCarry returns x + y + carry and sets all the flags
+func (this *cpu) addWithCarry(x, y uint32, carry bool) uint32 {
+	c := uint32(0)
+	if carry {
+		c = 1
+	}
+	sum, c1 := bits.Add32(x, y, c)
+	this.setNZ(sum)
+	this.c = c1 != 0
+	this.v = (x^sum)&(y^sum)&0x80000000 != 0
+	return sum
+}
+
+func (this *cpu) apsr() uint32 {
+	out := uint32(0)
+	for i, f := range []bool{this.v, this.c, this.z, this.n} {
+		if f {
+			out |= 1 << (28 + i)
+		}
+	}
+	return out
+}
+
+// xpsr is the combined program status, with the Thumb bit of the EPSR
+// always set
+func (this *cpu) xpsr() uint32 {
+	return this.apsr() | 1<<24 | this.ipsr
+}
+
+func (this *cpu) setAPSR(v uint32) {
+	this.n = v&(1<<31) != 0
+	this.z = v&(1<<30) != 0
+	this.c = v&(1<<29) != 0
+	this.v = v&(1<<28) != 0
+}
+
+// passed tells if the condition of a conditional branch holds
+func (this *cpu) passed(c int32) bool {
+	var out bool
+	switch c >> 1 {
+	case 0:
+		out = this.z
+	case 1:
+		out = this.c
+	case 2:
+		out = this.n
+	case 3:
+		out = this.v
+	case 4:
+		out = this.c && !this.z
+	case 5:
+		out = this.n == this.v
+	case 6:
+		out = this.n == this.v && !this.z
+	case 7:
+		return true
+	}
+	if c&1 == 1 {
+		return !out
+	}
+	return out
+}
+
+// operands splits the arguments of data processing instructions, both
+// OP <Rdn>, <Rm> and OP <Rd>, <Rn>, <Rm> are computed as d = n op m
+func operands(in *instr) (arg, arg, arg) {
+	if len(in.args) == 3 {
+		return in.args[0], in.args[1], in.args[2]
+	}
+	return in.args[0], in.args[0], in.args[1]
+}
+
+func (this *cpu) execute(in *instr) *halt {
+	if in.op == mnInvalid {
+		return &halt{kind: haltUndefined, pc: in.addr, msg: fmt.Sprintf("undefined instruction 0x%0*X", in.size*2, in.word)}
+	}
+	switch in.op {
+	case mnADCS, mnADDS, mnADD, mnSBCS, mnSUBS, mnSUB, mnANDS, mnBICS, mnEORS, mnORRS, mnMULS:
+		d, n, m := operands(in)
+		x, y := this.value(n), this.value(m)
+		var result uint32
+		switch in.op {
+		case mnADCS:
+			result = this.addWithCarry(x, y, this.c)
+		case mnADDS:
+			result = this.addWithCarry(x, y, false)
+		case mnADD:
+			result = x + y
+		case mnSBCS:
+			result = this.addWithCarry(x, ^y, this.c)
+		case mnSUBS:
+			result = this.addWithCarry(x, ^y, true)
+		case mnSUB:
+			result = x - y
+		case mnANDS:
+			result = x & y
+		case mnBICS:
+			result = x &^ y
+		case mnEORS:
+			result = x ^ y
+		case mnORRS:
+			result = x | y
+		case mnMULS:
+			result = x * y
+		}
+		switch in.op {
+		case mnANDS, mnBICS, mnEORS, mnORRS, mnMULS:
+			this.setNZ(result)
+		}
+		this.set(d.reg, result)
+	case mnCMP, mnCMN, mnTST:
+		x, y := this.value(in.args[0]), this.value(in.args[1])
+		switch in.op {
+		case mnCMP:
+			this.addWithCarry(x, ^y, true)
+		case mnCMN:
+			this.addWithCarry(x, y, false)
+		case mnTST:
+			this.setNZ(x & y)
+		}
+	case mnNEGS:
+		this.set(in.args[0].reg, this.addWithCarry(^this.value(in.args[1]), 0, true))
+	case mnMVNS:
+		result := ^this.value(in.args[1])
+		this.setNZ(result)
+		this.set(in.args[0].reg, result)
+	case mnMOVS:
+		result := this.value(in.args[1])
+		this.setNZ(result)
+		this.set(in.args[0].reg, result)
+	case mnMOV:
+		this.set(in.args[0].reg, this.value(in.args[1]))
+	case mnLSLS, mnLSRS, mnASRS, mnRORS:
+		d, n, m := operands(in)
+		amount := this.value(m)
+		if m.kind == argReg {
+			amount &= 0xFF
+		}
+		result := this.shift(in.op, this.value(n), amount)
+		this.setNZ(result)
+		this.set(d.reg, result)
+	case mnADR:
+		this.set(in.args[0].reg, in.target(in.args[1]))
+	case mnREV, mnREV16, mnREVSH, mnSXTB, mnSXTH, mnUXTB, mnUXTH:
+		x := this.value(in.args[1])
+		var result uint32
+		switch in.op {
+		case mnREV:
+			result = bits.ReverseBytes32(x)
+		case mnREV16:
+			result = uint32(bits.ReverseBytes16(uint16(x>>16)))<<16 | uint32(bits.ReverseBytes16(uint16(x)))
+		case mnREVSH:
+			result = uint32(int32(int16(bits.ReverseBytes16(uint16(x)))))
+		case mnSXTB:
+			result = uint32(int32(int8(x)))
+		case mnSXTH:
+			result = uint32(int32(int16(x)))
+		case mnUXTB:
+			result = x & 0xFF
+		case mnUXTH:
+			result = x & 0xFFFF
+		}
+		this.set(in.args[0].reg, result)
+	case mnB:
+		target := in.args[len(in.args)-1]
+		if len(in.args) == 1 || this.passed(in.args[0].value) {
+			this.branch(in.target(target))
+		}
+	case mnBL:
+		this.r[14] = (in.addr + 4) | 1
+		this.branch(in.target(in.args[0]))
+	case mnBX:
+		return this.bxWritePC(this.value(in.args[0]))
+	case mnBLX:
+		target := this.value(in.args[0])
+		this.r[14] = (in.addr + 2) | 1
+		return this.bxWritePC(target)
+	case mnLDR, mnLDRB, mnLDRH, mnLDRSB, mnLDRSH, mnSTR, mnSTRB, mnSTRH:
+		return this.loadStore(in)
+	case mnLDM, mnSTM, mnPUSH, mnPOP:
+		return this.multiple(in)
+	case mnMRS:
+		this.set(in.args[0].reg, this.readSpecial(uint16(in.args[1].value)))
+	case mnMSR:
+		SYSm, v := uint16(in.args[0].value), this.value(in.args[1])
+		if SYSm >= 0b0000_1000 && !this.privileged() {
+			// unprivileged code can only write the flags
+			break
+		}
+		if SYSm == 0b0001_0100 && this.ipsr != 0 {
+			// handlers always run on the main stack
+			v = v&1 | this.control&0b10
+		}
+		this.writeSpecial(SYSm, v)
+	case mnCPSIE:
+		if this.privileged() {
+			this.primask = false
+		}
+	case mnCPSID:
+		if this.privileged() {
+			this.primask = true
+		}
+	case mnSEV:
+		this.event = true
+	case mnWFE:
+		if this.event {
+			this.event = false
+			return nil
+		}
+		return this.sleep(in)
+	case mnWFI:
+		return this.sleep(in)
+	case mnNOP, mnYIELD, mnDMB, mnDSB, mnISB:
+	case mnBKPT:
+		return &halt{kind: haltBreakpoint, pc: in.addr, msg: fmt.Sprintf("BKPT #%v", in.args[0].value)}
+	case mnSVC:
+		return this.svc(in)
+	case mnUDF, mnUDFW:
+		return &halt{kind: haltUndefined, pc: in.addr, msg: fmt.Sprintf("%v #%v", in.op, in.args[0].value)}
+	default:
+		return &halt{kind: haltUndefined, pc: in.addr, msg: fmt.Sprintf("%v is not implemented", in.op)}
+	}
+	return nil
+}
+
+// shift computes the shifts and rotation, updating the carry flag
+// with the last bit shifted out. Shifts by zero leave the carry as is
+func (this *cpu) shift(op mnemonic, x, n uint32) uint32 {
+	if n == 0 {
+		return x
+	}
+	switch op {
+	case mnLSLS:
+		if n > 32 {
+			this.c = false
+			return 0
+		}
+		this.c = (uint64(x)<<n)&(1<<32) != 0
+		return uint32(uint64(x) << n)
+	case mnLSRS:
+		if n > 32 {
+			this.c = false
+			return 0
+		}
+		this.c = (x>>(n-1))&1 != 0
+		return uint32(uint64(x) >> n)
+	case mnASRS:
+		if n > 32 {
+			n = 32
+		}
+		this.c = (int64(int32(x))>>(n-1))&1 != 0
+		return uint32(int64(int32(x)) >> n)
+	}
+	result := bits.RotateLeft32(x, -int(n%32))
+	this.c = result&0x80000000 != 0
+	return result
+}
+
+func (this *cpu) loadStore(in *instr) *halt {
+	rt := in.args[0].reg
+	a := in.args[1]
+	var addr uint32
+	if a.kind == argTarget {
+		addr = in.target(a)
+	} else {
+		addr = this.get(a.reg)
+		if a.hasIndex {
+			addr += this.get(a.index)
+		} else {
+			addr += uint32(a.value)
+		}
+	}
+	size := uint32(4)
+	switch in.op {
+	case mnLDRB, mnLDRSB, mnSTRB:
+		size = 1
+	case mnLDRH, mnLDRSH, mnSTRH:
+		size = 2
+	}
+	switch in.op {
+	case mnSTR, mnSTRB, mnSTRH:
+		return this.store(addr, size, this.get(rt))
+	}
+	v, h := this.load(addr, size)
+	if h != nil {
+		return h
+	}
+	switch in.op {
+	case mnLDRSB:
+		v = uint32(int32(int8(v)))
+	case mnLDRSH:
+		v = uint32(int32(int16(v)))
+	}
+	this.set(rt, v)
+	return nil
+}
+
+func (this *cpu) load(addr, size uint32) (uint32, *halt) {
+	if addr%size != 0 {
+		return 0, this.faultf("unaligned read of %v bytes at 0x%08X", size, addr)
+	}
+	v, err := this.bus.read(addr, size)
+	if err != nil {
+		return 0, this.fault(err)
+	}
+	return v, nil
+}
+
+func (this *cpu) store(addr, size, v uint32) *halt {
+	if addr%size != 0 {
+		return this.faultf("unaligned write of %v bytes at 0x%08X", size, addr)
+	}
+	if err := this.bus.write(addr, size, v); err != nil {
+		return this.fault(err)
+	}
+	return nil
+}
+
+// multiple runs LDM, STM, PUSH and POP, registers are transferred
+// from the lowest address up in the order of their numbers
+func (this *cpu) multiple(in *instr) *halt {
+	var list uint16
+	var base uint16 = 13
+	writeback := true
+	if in.op == mnLDM || in.op == mnSTM {
+		base, writeback = in.args[0].reg, in.args[0].writeback
+		list = in.args[1].list
+	} else {
+		list = in.args[0].list
+	}
+	if list == 0 {
+		return &halt{kind: haltUndefined, pc: in.addr, msg: fmt.Sprintf("%v with no registers", in.op)}
+	}
+	count := uint32(bits.OnesCount16(list))
+	addr := this.r[base]
+	end := addr + 4*count
+	if in.op == mnPUSH {
+		addr -= 4 * count
+		end = addr
+	}
+	var pc uint32
+	for r := uint16(0); r < 16; r++ {
+		if list&(1<<r) == 0 {
+			continue
+		}
+		switch in.op {
+		case mnSTM, mnPUSH:
+			if h := this.store(addr, 4, this.get(r)); h != nil {
+				return h
+			}
+		default:
+			v, h := this.load(addr, 4)
+			if h != nil {
+				return h
+			}
+			if r == 15 {
+				pc = v
+			} else {
+				this.set(r, v)
+			}
+		}
+		addr += 4
+	}
+	if writeback {
+		this.set(base, end)
+	}
+	if list&(1<<15) != 0 {
+		return this.bxWritePC(pc)
+	}
+	return nil
+}
+
+// spsel tells if thread mode uses the process stack
+func (this *cpu) spsel() bool {
+	return this.control&0b10 != 0
+}
+
+func (this *cpu) readSpecial(SYSm uint16) uint32 {
+	switch SYSm {
+	case 0b0000_0000, 0b0000_0010:
+		// APSR and EAPSR, the EPSR reads as zero
+		return this.apsr()
+	case 0b0000_0001, 0b0000_0011:
+		// IAPSR and XPSR
+		return this.apsr() | this.ipsr
+	case 0b0000_0101, 0b0000_0111:
+		// IPSR and IEPSR
+		return this.ipsr
+	case 0b0000_1000:
+		if this.spsel() {
+			return this.otherSP
+		}
+		return this.r[13]
+	case 0b0000_1001:
+		if this.spsel() {
+			return this.r[13]
+		}
+		return this.otherSP
+	case 0b0001_0000:
+		if this.primask {
+			return 1
+		}
+		return 0
+	case 0b0001_0100:
+		return this.control
+	}
+	return 0
+}
+
+func (this *cpu) writeSpecial(SYSm uint16, v uint32) {
+	switch SYSm {
+	case 0b0000_0000, 0b0000_0001, 0b0000_0010, 0b0000_0011:
+		this.setAPSR(v)
+	case 0b0000_1000:
+		if this.spsel() {
+			this.otherSP = v &^ 0b11
+		} else {
+			this.setSP(v)
+		}
+	case 0b0000_1001:
+		if this.spsel() {
+			this.setSP(v)
+		} else {
+			this.otherSP = v &^ 0b11
+		}
+	case 0b0001_0000:
+		this.primask = v&1 != 0
+	case 0b0001_0100:
+		// only SPSEL and nPRIV exist, switching stacks swaps the SPs
+		v &= 0b11
+		if (v^this.control)&0b10 != 0 {
+			this.r[13], this.otherSP = this.otherSP, this.r[13]
+		}
+		this.control = v
+	}
+}
+
+// String prints the registers and flags
+func (this *cpu) String() string {
+	out := ""
+	for i := uint16(0); i < 16; i++ {
+		out += fmt.Sprintf("%-4v%08X", reg(i), this.r[i])
+		if i%4 == 3 {
+			out += "\n"
+		} else {
+			out += "  "
+		}
+	}
+	return out + fmt.Sprintf("apsr %v  primask %v  control %v\n", formatFlags(this.apsr()), this.readSpecial(0b0001_0000), this.control)
+}
+
+// formatFlags shows the NZCV flags of an APSR value, upper case when set
+func formatFlags(apsr uint32) string {
+	out := ""
+	for i, name := range "NZCV" {
+		if apsr&(1<<(31-i)) != 0 {
+			out += string(name)
+		} else {
+			out += strings.ToLower(string(name))
+		}
+	}
+	return out
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"testing"
+)
+
+// assembleSource assembles a program that starts at 0x20000000 with a
+// vector table
+func assembleSource(t *testing.T, src string) []*memoryMap {
+	t.Helper()
+	return assembleModule(t, "section text at 0x20000000:\n\t$0x20001000 w\n\t$_start+1 w\n_start:\n"+src)
+}
+
+func assembleModule(t *testing.T, src string) []*memoryMap {
+	t.Helper()
+	mod, err := parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := assemble(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj.memoryMaps()
+}
+
+// runSource runs a program until it halts
+func runSource(t *testing.T, src string) (*cpu, *halt) {
+	t.Helper()
+	return runOn(t, newSparseMemory(assembleSource(t, src)))
+}
+
+// runOn runs the program at 0x20000000, faults halt the cpu
+func runOn(t *testing.T, b bus) (*cpu, *halt) {
+	t.Helper()
+	c := newCPU(b)
+	c.catchHardFault = true
+	if err := c.reset(0x20000000); err != nil {
+		t.Fatal(err)
+	}
+	return c, c.run(10000)
+}
+
+// expect runs a program that must stop at a BKPT with the given
+// register values
+func expect(t *testing.T, src string, regs map[uint16]uint32) *cpu {
+	t.Helper()
+	c, h := runSource(t, src)
+	if h.kind != haltBreakpoint {
+		t.Fatalf("halted with %v", h)
+	}
+	for r, v := range regs {
+		if c.r[r] != v {
+			t.Errorf("%v is 0x%08X, expected 0x%08X", reg(r), c.r[r], v)
+		}
+	}
+	return c
+}
+
+func flags(c *cpu) string {
+	out := ""
+	for i, f := range []bool{c.n, c.z, c.c, c.v} {
+		if f {
+			out += string("NZCV"[i])
+		}
+	}
+	return out
+}
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		src   string
+		r0    uint32
+		flags string
+	}{
+		{"ldr r0, =0x7FFFFFFF\n\tadds r0, #1", 0x80000000, "NV"},
+		{"movs r0, #0\n\tsubs r0, #1", 0xFFFFFFFF, "N"},
+		{"movs r0, #5\n\tsubs r0, r0, #5", 0, "ZC"},
+		{"movs r0, #3\n\tmovs r1, #5\n\tcmp r0, r1", 3, "N"},
+		{"ldr r0, =0xFFFFFFFF\n\tmovs r1, #1\n\tadds r0, r0, r1", 0, "ZC"},
+		{"movs r0, #1\n\tnegs r0, r0", 0xFFFFFFFF, "N"},
+		{"movs r0, #0\n\tnegs r0, r0", 0, "ZC"},
+		{"movs r0, #6\n\tmovs r1, #7\n\tmuls r0, r1, r0", 42, ""},
+		{"ldr r0, =0xF0F0\n\tldr r1, =0xFF00\n\tbics r0, r1", 0xF0, ""},
+		{"movs r0, #0\n\tmvns r0, r0", 0xFFFFFFFF, "N"},
+		{"ldr r0, =0x12345678\n\trev r0, r0", 0x78563412, ""},
+		{"ldr r0, =0x12345678\n\trev16 r0, r0", 0x34127856, ""},
+		{"ldr r0, =0x1280\n\trevsh r0, r0", 0xFFFF8012, ""},
+		{"ldr r0, =0x1280\n\tsxtb r0, r0", 0xFFFFFF80, ""},
+		{"ldr r0, =0x18000\n\tsxth r0, r0", 0xFFFF8000, ""},
+		{"ldr r0, =0x18000\n\tuxth r0, r0", 0x8000, ""},
+	}
+	for _, test := range tests {
+		c := expect(t, "\t"+test.src+"\n\tbkpt #0\n", map[uint16]uint32{0: test.r0})
+		if flags(c) != test.flags {
+			t.Errorf("%q: flags are %q, expected %q", test.src, flags(c), test.flags)
+		}
+	}
+}
+
+// 64 bit arithmetic chains the carry
+func TestCarryChain(t *testing.T) {
+	expect(t, `
+	ldr r0, =0xFFFFFFFF
+	movs r1, #1
+	movs r2, #1
+	movs r3, #2
+	adds r0, r0, r2
+	adcs r1, r3
+	movs r4, #0
+	movs r5, #0
+	movs r6, #1
+	movs r7, #0
+	subs r4, r4, r6
+	sbcs r5, r7
+	bkpt #0
+`, map[uint16]uint32{0: 0, 1: 4, 4: 0xFFFFFFFF, 5: 0xFFFFFFFF})
+}
+
+func TestShifts(t *testing.T) {
+	tests := []struct {
+		src   string
+		r0    uint32
+		flags string
+	}{
+		{"ldr r0, =0x80000001\n\tlsls r0, r0, #1", 2, "C"},
+		{"ldr r0, =0x80000001\n\tlsrs r0, r0, #1", 0x40000000, "C"},
+		{"ldr r0, =0x80000000\n\tlsrs r0, r0, #32", 0, "ZC"},
+		{"ldr r0, =0x80000000\n\tasrs r0, r0, #32", 0xFFFFFFFF, "NC"},
+		{"ldr r0, =0x80000010\n\tasrs r0, r0, #4", 0xF8000001, "N"},
+		{"movs r0, #1\n\tmovs r1, #33\n\tlsls r0, r1", 0, "Z"},
+		{"movs r0, #1\n\tmovs r1, #32\n\tlsls r0, r1", 0, "ZC"},
+		{"movs r0, #3\n\tmovs r1, #1\n\trors r0, r1", 0x80000001, "NC"},
+		{"movs r0, #3\n\tmovs r1, #0\n\trors r0, r1", 3, ""},
+	}
+	for _, test := range tests {
+		c := expect(t, "\t"+test.src+"\n\tbkpt #0\n", map[uint16]uint32{0: test.r0})
+		if flags(c) != test.flags {
+			t.Errorf("%q: flags are %q, expected %q", test.src, flags(c), test.flags)
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	expect(t, `
+	ldr r0, =0x20000800
+	ldr r1, =0x8081FF7F
+	str r1, [r0, #4]
+	ldrb r2, [r0, #4]
+	movs r3, #7
+	ldrsb r3, [r0, r3]
+	movs r4, #4
+	ldrh r4, [r0, r4]
+	movs r5, #6
+	ldrsh r5, [r0, r5]
+	adds r0, #8
+	movs r6, #1
+	movs r7, #2
+	stm r0!, {r6, r7}
+	subs r0, #8
+	ldm r0!, {r6, r7}
+	bkpt #0
+`, map[uint16]uint32{0: 0x20000810, 1: 0x8081FF7F, 2: 0x7F, 3: 0xFFFFFF80, 4: 0xFF7F, 5: 0xFFFF8081, 6: 1, 7: 2})
+}
+
+func TestCalls(t *testing.T) {
+	expect(t, `
+	movs r0, #1
+	bl double
+	bl double
+	adr r1, triple
+	adds r1, #1
+	blx r1
+	bkpt #0
+double:
+	push {r4, lr}
+	movs r4, r0
+	adds r0, r0, r4
+	pop {r4, pc}
+	$0 hw
+triple:
+	movs r2, r0
+	adds r0, r0, r2
+	adds r0, r0, r2
+	bx lr
+`, map[uint16]uint32{0: 12, 13: 0x20001000})
+}
+
+func TestLoop(t *testing.T) {
+	expect(t, `
+	movs r0, #0
+	movs r1, #10
+loop:
+	adds r0, r0, r1
+	subs r1, #1
+	bne loop
+	cmp r0, #55
+	beq done
+	movs r0, #0
+done:
+	bkpt #1
+`, map[uint16]uint32{0: 55, 1: 0})
+}
+
+func TestSpecialRegisters(t *testing.T) {
+	expect(t, `
+	ldr r0, =0xA0000000
+	msr apsr, r0
+	mrs r1, apsr
+	ldr r2, =0x20000400
+	msr psp, r2
+	movs r3, #2
+	msr control, r3
+	mov r4, sp
+	mrs r5, msp
+	cpsid i
+	mrs r6, primask
+	bkpt #0
+`, map[uint16]uint32{1: 0xA0000000, 4: 0x20000400, 5: 0x20001000, 6: 1})
+}
+
+func TestHalts(t *testing.T) {
+	tests := []struct {
+		src  string
+		kind haltKind
+	}{
+		{"ldr r0, =0x20000001\n\tldr r1, [r0, #0]", haltFault},
+		{"movs r0, #0\n\tbx r0", haltFault},
+		{"udf #3", haltUndefined},
+		{"wfi", haltWait},
+		{"b _start", haltLimit},
+	}
+	for _, test := range tests {
+		_, h := runSource(t, "\t"+test.src+"\n\tbkpt #0\n")
+		if h.kind != test.kind {
+			t.Errorf("%q: halted with %v", test.src, h)
+		}
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"fmt"
+)
+
+type mnemonic int
+
+const (
+	mnInvalid mnemonic = iota
+	mnADCS
+	mnADD
+	mnADDS
+	mnADR
+	mnANDS
+	mnASRS
+	mnB
+	mnBICS
+	mnBKPT
+	mnBL
+	mnBLX
+	mnBX
+	mnCMN
+	mnCMP
+	mnCPSID
+	mnCPSIE
+	mnDMB
+	mnDSB
+	mnEORS
+	mnISB
+	mnLDM
+	mnLDR
+	mnLDRB
+	mnLDRH
+	mnLDRSB
+	mnLDRSH
+	mnLSLS
+	mnLSRS
+	mnMOV
+	mnMOVS
+	mnMRS
+	mnMSR
+	mnMULS
+	mnMVNS
+	mnNEGS
+	mnNOP
+	mnORRS
+	mnPOP
+	mnPUSH
+	mnREV
+	mnREV16
+	mnREVSH
+	mnRORS
+	mnSBCS
+	mnSEV
+	mnSTM
+	mnSTR
+	mnSTRB
+	mnSTRH
+	mnSUB
+	mnSUBS
+	mnSVC
+	mnSXTB
+	mnSXTH
+	mnTST
+	mnUDF
+	mnUDFW
+	mnUXTB
+	mnUXTH
+	mnWFE
+	mnWFI
+	mnYIELD
+
+	// data directives, never decoded, used for bytes that are not code
+	mnWord
+	mnHword
+	mnByte
+)
+
+var mnemonicNames = [...]string{
+	mnInvalid: "???",
+	mnADCS:    "ADCS",
+	mnADD:     "ADD",
+	mnADDS:    "ADDS",
+	mnADR:     "ADR",
+	mnANDS:    "ANDS",
+	mnASRS:    "ASRS",
+	mnB:       "B",
+	mnBICS:    "BICS",
+	mnBKPT:    "BKPT",
+	mnBL:      "BL",
+	mnBLX:     "BLX",
+	mnBX:      "BX",
+	mnCMN:     "CMN",
+	mnCMP:     "CMP",
+	mnCPSID:   "CPSID",
+	mnCPSIE:   "CPSIE",
+	mnDMB:     "DMB",
+	mnDSB:     "DSB",
+	mnEORS:    "EORS",
+	mnISB:     "ISB",
+	mnLDM:     "LDM",
+	mnLDR:     "LDR",
+	mnLDRB:    "LDRB",
+	mnLDRH:    "LDRH",
+	mnLDRSB:   "LDRSB",
+	mnLDRSH:   "LDRSH",
+	mnLSLS:    "LSLS",
+	mnLSRS:    "LSRS",
+	mnMOV:     "MOV",
+	mnMOVS:    "MOVS",
+	mnMRS:     "MRS",
+	mnMSR:     "MSR",
+	mnMULS:    "MULS",
+	mnMVNS:    "MVNS",
+	mnNEGS:    "NEGS",
+	mnNOP:     "NOP",
+	mnORRS:    "ORRS",
+	mnPOP:     "POP",
+	mnPUSH:    "PUSH",
+	mnREV:     "REV",
+	mnREV16:   "REV16",
+	mnREVSH:   "REVSH",
+	mnRORS:    "RORS",
+	mnSBCS:    "SBCS",
+	mnSEV:     "SEV",
+	mnSTM:     "STM",
+	mnSTR:     "STR",
+	mnSTRB:    "STRB",
+	mnSTRH:    "STRH",
+	mnSUB:     "SUB",
+	mnSUBS:    "SUBS",
+	mnSVC:     "SVC",
+	mnSXTB:    "SXTB",
+	mnSXTH:    "SXTH",
+	mnTST:     "TST",
+	mnUDF:     "UDF",
+	mnUDFW:    "UDF.W",
+	mnUXTB:    "UXTB",
+	mnUXTH:    "UXTH",
+	mnWFE:     "WFE",
+	mnWFI:     "WFI",
+	mnYIELD:   "YIELD",
+	mnWord:    ".word",
+	mnHword:   ".hword",
+	mnByte:    ".byte",
+}
+
+func (this mnemonic) String() string {
+	return mnemonicNames[this]
+}
+
+type fmtKind int
+
+const (
+	fmtReg      fmtKind = iota // register field, optionally with a 4th bit elsewhere
+	fmtFixedReg                // register implied by the encoding (SP, PC)
+	fmtImm                     // unsigned immediate, scaled
+	fmtShift                   // 5 bit shift amount where 0 means 32
+	fmtRegList                 // 8 bit register list, optionally with an extra register
+	fmtBaseWb                  // LDM/STM base register, with writeback
+	fmtCond                    // condition code, printed as a mnemonic suffix
+	fmtBranch                  // signed halfword offset relative to PC
+	fmtBL                      // BL offset, split between both halfwords
+	fmtLiteral                 // word offset relative to Align(PC, 4)
+	fmtMem                     // memory address, formed by sub operands
+	fmtSysReg                  // special register for MRS/MSR
+	fmtBarrier                 // barrier option of DMB/DSB/ISB
+	fmtImm16                   // imm4:imm12 of UDF.W
+)
+
+// operandFmt describes where an operand is stored in the instruction
+// word and how it should be interpreted. For 32 bit instructions the
+// first halfword is stored in the upper 16 bits of the word.
+type operandFmt struct {
+	kind  fmtKind
+	shift uint32
+	width uint32
+	scale uint32
+
+	// fmtReg: position of the 4th register bit, zero if absent.
+	// fmtRegList: position of the bit that selects extra.
+	hiBit uint32
+	// fmtFixedReg: the register. fmtRegList: the extra register.
+	reg uint16
+	// fmtBaseWb: writeback is always done, even if the register
+	// is in the list
+	always bool
+
+	sub []operandFmt
+}
+
+func (this operandFmt) field(word uint32) uint32 {
+	return (word >> this.shift) & (1<<this.width - 1)
+}
+
+func lowReg(shift uint32) operandFmt {
+	return operandFmt{kind: fmtReg, shift: shift, width: 3}
+}
+
+func reg4(shift uint32) operandFmt {
+	return operandFmt{kind: fmtReg, shift: shift, width: 4}
+}
+
+// D:Rdn style registers, where the high bit is separated from the rest
+func hiReg(hiBit, shift uint32) operandFmt {
+	return operandFmt{kind: fmtReg, shift: shift, width: 3, hiBit: hiBit}
+}
+
+func fixedReg(r uint16) operandFmt {
+	return operandFmt{kind: fmtFixedReg, reg: r}
+}
+
+func imm(shift, width, scale uint32) operandFmt {
+	return operandFmt{kind: fmtImm, shift: shift, width: width, scale: scale}
+}
+
+func shiftImm(shift uint32) operandFmt {
+	return operandFmt{kind: fmtShift, shift: shift, width: 5, scale: 1}
+}
+
+func regList() operandFmt {
+	return operandFmt{kind: fmtRegList, shift: 0, width: 8}
+}
+
+// register list where bit hiBit selects an extra register
+func regListPlus(hiBit uint32, extra uint16) operandFmt {
+	return operandFmt{kind: fmtRegList, shift: 0, width: 8, hiBit: hiBit, reg: extra}
+}
+
+func baseWb(shift uint32, always bool) operandFmt {
+	return operandFmt{kind: fmtBaseWb, shift: shift, width: 3, always: always}
+}
+
+func condField(shift uint32) operandFmt {
+	return operandFmt{kind: fmtCond, shift: shift, width: 4}
+}
+
+func branch(width uint32) operandFmt {
+	return operandFmt{kind: fmtBranch, shift: 0, width: width, scale: 2}
+}
+
+func blTarget() operandFmt {
+	return operandFmt{kind: fmtBL}
+}
+
+func pcLiteral() operandFmt {
+	return operandFmt{kind: fmtLiteral, shift: 0, width: 8, scale: 4}
+}
+
+// mem takes the base register and an optional register or immediate offset
+func mem(sub ...operandFmt) operandFmt {
+	return operandFmt{kind: fmtMem, sub: sub}
+}
+
+func sysReg(shift uint32) operandFmt {
+	return operandFmt{kind: fmtSysReg, shift: shift, width: 8}
+}
+
+func barrierOpt() operandFmt {
+	return operandFmt{kind: fmtBarrier, shift: 0, width: 4}
+}
+
+func imm16() operandFmt {
+	return operandFmt{kind: fmtImm16}
+}
+
+type opcode struct {
+	mnemonic mnemonic
+	size     uint32
+	mask     uint32
+	value    uint32
+	// when more than one entry matches, the highest priority wins
+	priority int
+	operands []operandFmt
+	// if set, matching words it rejects are UNPREDICTABLE
+	valid func(word uint32) bool
+}
+
+func op16(mnemonic mnemonic, mask, value uint16, operands ...operandFmt) *opcode {
+	return &opcode{
+		mnemonic: mnemonic,
+		size:     2,
+		mask:     uint32(mask),
+		value:    uint32(value),
+		operands: operands,
+	}
+}
+
+func op32(mnemonic mnemonic, mask, value uint32, operands ...operandFmt) *opcode {
+	return &opcode{
+		mnemonic: mnemonic,
+		size:     4,
+		mask:     mask,
+		value:    value,
+		operands: operands,
+	}
+}
+
+func (this *opcode) withPriority(p int) *opcode {
+	this.priority = p
+	return this
+}
+
+func (this *opcode) when(valid func(word uint32) bool) *opcode {
+	this.valid = valid
+	return this
+}
+
+func (this *opcode) matches(word uint32) bool {
+	return word&this.mask == this.value
+}
+
+func (this *opcode) overlaps(other *opcode) bool {
+	common := this.mask & other.mask
+	return this.value&common == other.value&common
+}
+
+// shadows tells if every word matched by other is also matched by this
+func (this *opcode) shadows(other *opcode) bool {
+	return this.mask&other.mask == this.mask && this.overlaps(other)
+}
+
+type opcodeTable []*opcode
+
+func (this opcodeTable) lookup(word uint32) *opcode {
+	var out *opcode
+	for _, op := range this {
+		if op.matches(word) && (out == nil || op.priority > out.priority) {
+			out = op
+		}
+	}
+	return out
+}
+
+// check reports entries that overlap with the same priority, since the
+// result would depend on their position in the table, and entries that
+// are completely hidden by a single entry of higher priority
+func (this opcodeTable) check() []string {
+	out := []string{}
+	for i, a := range this {
+		if a.value&^a.mask != 0 {
+			out = append(out, fmt.Sprintf("%v: value %08X has bits outside of mask %08X", a.mnemonic, a.value, a.mask))
+		}
+		for _, b := range this[i+1:] {
+			if a.priority == b.priority && a.overlaps(b) {
+				out = append(out, fmt.Sprintf("ambiguous entries: %v (%08X/%08X) and %v (%08X/%08X)",
+					a.mnemonic, a.value, a.mask, b.mnemonic, b.value, b.mask))
+			}
+		}
+		for _, b := range this {
+			if b.priority > a.priority && b.shadows(a) {
+				out = append(out, fmt.Sprintf("%v (%08X/%08X) is hidden by %v (%08X/%08X)",
+					a.mnemonic, a.value, a.mask, b.mnemonic, b.value, b.mask))
+			}
+		}
+	}
+	return out
+}
+
+var thumb16 = opcodeTable{
+	op16(mnADCS, bits15_6, 0b0100_0001_0100_0000, lowReg(0), lowReg(3)),
+	op16(mnADDS, bits15_9, 0b0001_1100_0000_0000, lowReg(0), lowReg(3), imm(6, 3, 1)),
+	op16(mnADDS, bits15_11, 0b0011_0000_0000_0000, lowReg(8), imm(0, 8, 1)),
+	op16(mnADDS, bits15_9, 0b0001_1000_0000_0000, lowReg(0), lowReg(3), lowReg(6)),
+	op16(mnADD, bits15_8, 0b0100_0100_0000_0000, hiReg(7, 0), reg4(3)),
+	op16(mnADD, bits15_8|bits6_3, 0b0100_0100_0110_1000, hiReg(7, 0), fixedReg(13), hiReg(7, 0)).withPriority(1),
+	op16(mnADD, bits15_7|bits2_0, 0b0100_0100_1000_0101, fixedReg(13), reg4(3)).withPriority(2),
+	op16(mnADD, bits15_11, 0b1010_1000_0000_0000, lowReg(8), fixedReg(13), imm(0, 8, 4)),
+	op16(mnADD, bits15_7, 0b1011_0000_0000_0000, fixedReg(13), fixedReg(13), imm(0, 7, 4)),
+	op16(mnADR, bits15_11, 0b1010_0000_0000_0000, lowReg(8), pcLiteral()),
+	op16(mnANDS, bits15_6, 0b0100_0000_0000_0000, lowReg(0), lowReg(3)),
+	op16(mnASRS, bits15_11, 0b0001_0000_0000_0000, lowReg(0), lowReg(3), shiftImm(6)),
+	op16(mnASRS, bits15_6, 0b0100_0001_0000_0000, lowReg(0), lowReg(3)),
+	op16(mnB, bits15_12, 0b1101_0000_0000_0000, condField(8), branch(8)),
+	op16(mnB, bits15_11, 0b1110_0000_0000_0000, branch(11)),
+	op16(mnBICS, bits15_6, 0b0100_0011_1000_0000, lowReg(0), lowReg(3)),
+	op16(mnBKPT, bits15_8, 0b1011_1110_0000_0000, imm(0, 8, 1)),
+	op16(mnBLX, bits15_7|bits2_0, 0b0100_0111_1000_0000, reg4(3)),
+	op16(mnBX, bits15_7|bits2_0, 0b0100_0111_0000_0000, reg4(3)),
+	op16(mnCMN, bits15_6, 0b0100_0010_1100_0000, lowReg(0), lowReg(3)),
+	op16(mnCMP, bits15_11, 0b0010_1000_0000_0000, lowReg(8), imm(0, 8, 1)),
+	op16(mnCMP, bits15_6, 0b0100_0010_1000_0000, lowReg(0), lowReg(3)),
+	op16(mnCMP, bits15_8, 0b0100_0101_0000_0000, hiReg(7, 0), reg4(3)),
+	op16(mnCPSIE, 0xFFFF, 0b1011_0110_0110_0010),
+	op16(mnCPSID, 0xFFFF, 0b1011_0110_0111_0010),
+	op16(mnEORS, bits15_6, 0b0100_0000_0100_0000, lowReg(0), lowReg(3)),
+	op16(mnLDM, bits15_11, 0b1100_1000_0000_0000, baseWb(8, false), regList()),
+	op16(mnLDR, bits15_11, 0b0110_1000_0000_0000, lowReg(0), mem(lowReg(3), imm(6, 5, 4))),
+	op16(mnLDR, bits15_11, 0b1001_1000_0000_0000, lowReg(8), mem(fixedReg(13), imm(0, 8, 4))),
+	op16(mnLDR, bits15_11, 0b0100_1000_0000_0000, lowReg(8), pcLiteral()),
+	op16(mnLDR, bits15_9, 0b0101_1000_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnLDRB, bits15_11, 0b0111_1000_0000_0000, lowReg(0), mem(lowReg(3), imm(6, 5, 1))),
+	op16(mnLDRB, bits15_9, 0b0101_1100_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnLDRH, bits15_11, 0b1000_1000_0000_0000, lowReg(0), mem(lowReg(3), imm(6, 5, 2))),
+	op16(mnLDRH, bits15_9, 0b0101_1010_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnLDRSB, bits15_9, 0b0101_0110_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnLDRSH, bits15_9, 0b0101_1110_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnLSLS, bits15_11, 0b0000_0000_0000_0000, lowReg(0), lowReg(3), imm(6, 5, 1)),
+	op16(mnLSLS, bits15_6, 0b0100_0000_1000_0000, lowReg(0), lowReg(3)),
+	op16(mnLSRS, bits15_11, 0b0000_1000_0000_0000, lowReg(0), lowReg(3), shiftImm(6)),
+	op16(mnLSRS, bits15_6, 0b0100_0000_1100_0000, lowReg(0), lowReg(3)),
+	op16(mnMOVS, bits15_11, 0b0010_0000_0000_0000, lowReg(8), imm(0, 8, 1)),
+	op16(mnMOVS, bits15_6, 0b0000_0000_0000_0000, lowReg(0), lowReg(3)).withPriority(1),
+	op16(mnMOV, bits15_8, 0b0100_0110_0000_0000, hiReg(7, 0), reg4(3)),
+	op16(mnMULS, bits15_6, 0b0100_0011_0100_0000, lowReg(0), lowReg(3), lowReg(0)),
+	op16(mnMVNS, bits15_6, 0b0100_0011_1100_0000, lowReg(0), lowReg(3)),
+	op16(mnNEGS, bits15_6, 0b0100_0010_0100_0000, lowReg(0), lowReg(3)),
+	op16(mnNOP, 0xFFFF, 0b1011_1111_0000_0000),
+	op16(mnORRS, bits15_6, 0b0100_0011_0000_0000, lowReg(0), lowReg(3)),
+	op16(mnPOP, bits15_9, 0b1011_1100_0000_0000, regListPlus(8, 15)),
+	op16(mnPUSH, bits15_9, 0b1011_0100_0000_0000, regListPlus(8, 14)),
+	op16(mnREV, bits15_6, 0b1011_1010_0000_0000, lowReg(0), lowReg(3)),
+	op16(mnREV16, bits15_6, 0b1011_1010_0100_0000, lowReg(0), lowReg(3)),
+	op16(mnREVSH, bits15_6, 0b1011_1010_1100_0000, lowReg(0), lowReg(3)),
+	op16(mnRORS, bits15_6, 0b0100_0001_1100_0000, lowReg(0), lowReg(3)),
+	op16(mnSBCS, bits15_6, 0b0100_0001_1000_0000, lowReg(0), lowReg(3)),
+	op16(mnSEV, 0xFFFF, 0b1011_1111_0100_0000),
+	op16(mnSTM, bits15_11, 0b1100_0000_0000_0000, baseWb(8, true), regList()),
+	op16(mnSTR, bits15_11, 0b0110_0000_0000_0000, lowReg(0), mem(lowReg(3), imm(6, 5, 4))),
+	op16(mnSTR, bits15_11, 0b1001_0000_0000_0000, lowReg(8), mem(fixedReg(13), imm(0, 8, 4))),
+	op16(mnSTR, bits15_9, 0b0101_0000_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnSTRB, bits15_11, 0b0111_0000_0000_0000, lowReg(0), mem(lowReg(3), imm(6, 5, 1))),
+	op16(mnSTRB, bits15_9, 0b0101_0100_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnSTRH, bits15_11, 0b1000_0000_0000_0000, lowReg(0), mem(lowReg(3), imm(6, 5, 2))),
+	op16(mnSTRH, bits15_9, 0b0101_0010_0000_0000, lowReg(0), mem(lowReg(3), lowReg(6))),
+	op16(mnSUBS, bits15_9, 0b0001_1110_0000_0000, lowReg(0), lowReg(3), imm(6, 3, 1)),
+	op16(mnSUBS, bits15_11, 0b0011_1000_0000_0000, lowReg(8), imm(0, 8, 1)),
+	op16(mnSUBS, bits15_9, 0b0001_1010_0000_0000, lowReg(0), lowReg(3), lowReg(6)),
+	op16(mnSUB, bits15_7, 0b1011_0000_1000_0000, fixedReg(13), fixedReg(13), imm(0, 7, 4)),
+	op16(mnSVC, bits15_8, 0b1101_1111_0000_0000, imm(0, 8, 1)).withPriority(1),
+	op16(mnSXTB, bits15_6, 0b1011_0010_0100_0000, lowReg(0), lowReg(3)),
+	op16(mnSXTH, bits15_6, 0b1011_0010_0000_0000, lowReg(0), lowReg(3)),
+	op16(mnTST, bits15_6, 0b0100_0010_0000_0000, lowReg(0), lowReg(3)),
+	op16(mnUDF, bits15_8, 0b1101_1110_0000_0000, imm(0, 8, 1)).withPriority(1),
+	op16(mnUXTB, bits15_6, 0b1011_0010_1100_0000, lowReg(0), lowReg(3)),
+	op16(mnUXTH, bits15_6, 0b1011_0010_1000_0000, lowReg(0), lowReg(3)),
+	op16(mnWFE, 0xFFFF, 0b1011_1111_0010_0000),
+	op16(mnWFI, 0xFFFF, 0b1011_1111_0011_0000),
+	op16(mnYIELD, 0xFFFF, 0b1011_1111_0001_0000),
+}
+
+var thumb32 = opcodeTable{
+	op32(mnBL, 0xF800_D000, 0xF000_D000, blTarget()),
+	op32(mnDMB, 0xFFFF_FFF0, 0xF3BF_8F50, barrierOpt()),
+	op32(mnDSB, 0xFFFF_FFF0, 0xF3BF_8F40, barrierOpt()),
+	op32(mnISB, 0xFFFF_FFF0, 0xF3BF_8F60, barrierOpt()),
+	op32(mnMRS, 0xFFFF_F000, 0xF3EF_8000, reg4(8), sysReg(0)).when(func(word uint32) bool {
+		return notSPorPC(word>>8) && isSpecialReg(word)
+	}),
+	op32(mnMSR, 0xFFF0_FF00, 0xF380_8800, sysReg(0), reg4(16)).when(func(word uint32) bool {
+		return notSPorPC(word>>16) && isSpecialReg(word)
+	}),
+	op32(mnUDFW, 0xFFF0_F000, 0xF7F0_A000, imm16()),
+}
+
+func notSPorPC(r uint32) bool {
+	r &= 0xF
+	return r != 13 && r != 15
+}
+
+// isSpecialReg tells if the SYSm field, in the low byte, is one
+// of the ARMv6-M special registers
+func isSpecialReg(word uint32) bool {
+	_, ok := specialRegName(uint16(word & 0xFF))
+	return ok
+}
+
+// specialRegName returns the upper case name of a SYSm value
+func specialRegName(SYSm uint16) (string, bool) {
+	for name, v := range specialRegs {
+		if v == SYSm {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+var barrierNames = map[uint16]string{
+	0b1111: "SY",
+}
+
+// is32bit tells if the halfword is the first half of a 32 bit instruction
+func is32bit(hw uint16) bool {
+	prefix := hw & bits15_11
+	return prefix == 0b1110_1000_0000_0000 ||
+		prefix == 0b1111_0000_0000_0000 ||
+		prefix == 0b1111_1000_0000_0000
+}
+
+// instr is a decoded instruction, use formatInstr to render it
+type instr struct {
+	// address of the instruction, used to resolve PC relative targets
+	addr uint32
+	op   mnemonic
+	args []arg
+	size uint32
+	// raw encoding, the first halfword is in the upper bits
+	word uint32
+	// raw bytes, in the reverse order of memory
+	chunk []byte
+}
+
+type argKind int
+
+const (
+	argReg     argKind = iota
+	argRegList         // registers in list
+	argImm             // value
+	argTarget          // PC relative address, offset in value
+	argSysReg          // SYSm in value
+	argBarrier         // option in value
+	argCond            // condition in value
+	argMem             // [reg, index] or [reg, #value]
+)
+
+type arg struct {
+	kind argKind
+
+	// argReg: the register, argMem: the base register
+	reg uint16
+	// argReg: LDM/STM base register with writeback
+	writeback bool
+	// argMem: offset register, if hasIndex is set
+	index    uint16
+	hasIndex bool
+
+	list  uint16
+	value int32
+	// argTarget: the offset is relative to Align(PC, 4) instead of PC
+	aligned bool
+}
+
+func decodeInstr(rb *ReadBuffer, out *instr) bool {
+	hw, ok := rb.getU16()
+	if !ok {
+		return false
+	}
+	out.chunk = []byte{uint8(hw >> 8), uint8(hw)} // little endian
+	out.op = mnInvalid
+	out.args = nil
+	out.size = 2
+
+	word := uint32(hw)
+	table := thumb16
+	if is32bit(hw) {
+		hw2, ok := rb.getU16()
+		if !ok {
+			return false
+		}
+		out.chunk = append([]byte{uint8(hw2 >> 8), uint8(hw2)}, out.chunk...)
+		out.size = 4
+		word = uint32(hw)<<16 | uint32(hw2)
+		table = thumb32
+	}
+	out.word = word
+
+	op := table.lookup(word)
+	if op != nil && (op.valid == nil || op.valid(word)) {
+		out.op = op.mnemonic
+		for _, f := range op.operands {
+			out.args = append(out.args, f.decode(word))
+		}
+	}
+	return true
+}
+
+// target resolves a PC relative operand to an absolute address,
+// the PC reads as the address of the instruction plus 4
+func (this *instr) target(a arg) uint32 {
+	pc := this.addr + 4
+	if a.aligned {
+		pc &^= 0b11
+	}
+	return pc + uint32(a.value)
+}
+
+func (this operandFmt) decode(word uint32) arg {
+	switch this.kind {
+	case fmtReg:
+		r := this.field(word)
+		if this.hiBit != 0 {
+			r |= ((word >> this.hiBit) & 1) << 3
+		}
+		return arg{kind: argReg, reg: uint16(r)}
+	case fmtFixedReg:
+		return arg{kind: argReg, reg: this.reg}
+	case fmtImm:
+		return arg{kind: argImm, value: int32(this.field(word) * this.scale)}
+	case fmtShift:
+		n := this.field(word)
+		if n == 0 {
+			n = 32
+		}
+		return arg{kind: argImm, value: int32(n)}
+	case fmtRegList:
+		list := uint16(this.field(word))
+		if this.hiBit != 0 && (word>>this.hiBit)&1 == 1 {
+			list |= 1 << this.reg
+		}
+		return arg{kind: argRegList, list: list}
+	case fmtBaseWb:
+		rn := this.field(word)
+		wb := this.always || word&(1<<rn) == 0
+		return arg{kind: argReg, reg: uint16(rn), writeback: wb}
+	case fmtCond:
+		return arg{kind: argCond, value: int32(this.field(word))}
+	case fmtBranch:
+		offset := signExtend(this.field(word), this.width) * int32(this.scale)
+		return arg{kind: argTarget, value: offset}
+	case fmtBL:
+		return arg{kind: argTarget, value: blOffset(word)}
+	case fmtLiteral:
+		offset := int32(this.field(word) * this.scale)
+		return arg{kind: argTarget, value: offset, aligned: true}
+	case fmtMem:
+		base := this.sub[0].decode(word)
+		out := arg{kind: argMem, reg: base.reg}
+		if len(this.sub) > 1 {
+			offset := this.sub[1].decode(word)
+			if offset.kind == argReg {
+				out.index = offset.reg
+				out.hasIndex = true
+			} else {
+				out.value = offset.value
+			}
+		}
+		return out
+	case fmtSysReg:
+		return arg{kind: argSysReg, value: int32(this.field(word))}
+	case fmtBarrier:
+		return arg{kind: argBarrier, value: int32(this.field(word))}
+	case fmtImm16:
+		return arg{kind: argImm, value: int32((word>>16)&0xF<<12 | word&0xFFF)}
+	}
+	panic("unknown operand format")
+}
+
+func signExtend(v uint32, width uint32) int32 {
+	return int32(v<<(32-width)) >> (32 - width)
+}
+
+// blOffset reassembles the BL offset, where I1 = NOT(J1 XOR S)
+// and I2 = NOT(J2 XOR S)
+func blOffset(word uint32) int32 {
+	hw := uint16(word >> 16)
+	hw2 := uint16(word)
+	imm10 := uint32(hw & bits9_0)
+	S := uint32(hw&bit10) >> 10
+
+	imm11 := uint32(hw2 & bits10_0)
+	J1 := uint32(hw2&bit13) >> 13
+	J2 := uint32(hw2&bit11) >> 11
+
+	I1 := (J1 ^ S) ^ 1
+	I2 := (J2 ^ S) ^ 1
+
+	u24 := S<<23 | I1<<22 | I2<<21 | imm10<<11 | imm11
+	return signExtend(u24, 24) << 1
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// second halfwords tried after each 32 bit prefix, chosen to reach the
+// BL, MRS/MSR, barrier and UDF.W encodings
+var secondHalfwords = []uint16{0x0000, 0x8000, 0x8808, 0x8F4F, 0x8F5E, 0x8F5F, 0x8F6F, 0xA000, 0xD000, 0xFFFF}
+
+func TestOpcodeTables(t *testing.T) {
+	for _, p := range append(thumb16.check(), thumb32.check()...) {
+		t.Error(p)
+	}
+}
+
+func TestDecode16Golden(t *testing.T) {
+	out := &bytes.Buffer{}
+	for hw := 0; hw <= 0xFFFF; hw++ {
+		if is32bit(uint16(hw)) {
+			continue
+		}
+		fmt.Fprintf(out, "%04X\t%v\n", hw, decodeText(appendU16(nil, uint16(hw))))
+	}
+	golden(t, "thumb16.golden", out.Bytes())
+}
+
+func TestDecode32Golden(t *testing.T) {
+	out := &bytes.Buffer{}
+	for hw := 0; hw <= 0xFFFF; hw++ {
+		if !is32bit(uint16(hw)) {
+			continue
+		}
+		for _, hw2 := range secondHalfwords {
+			fmt.Fprintf(out, "%04X %04X\t%v\n", hw, hw2, decodeText(appendU16(appendU16(nil, uint16(hw)), hw2)))
+		}
+	}
+	golden(t, "thumb32.golden", out.Bytes())
+}
+
+// decodeText renders the first instruction in data, at an address that
+// keeps the branch targets positive
+func decodeText(data []byte) string {
+	in := &instr{addr: 0x10000000}
+	if !decodeInstr(newReadBuffer(data), in) {
+		return "<truncated>"
+	}
+	p := &printer{maps: []*memoryMap{{addr: in.addr, contents: data}}}
+	return p.format(in)
+}
+
+// golden compares out with the file in testdata, or rewrites the file
+// when running with -update
+func golden(t *testing.T, name string, out []byte) {
+	t.Helper()
+	filename := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(filename, out, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(out, expected) {
+		return
+	}
+	got := strings.Split(string(out), "\n")
+	want := strings.Split(string(expected), "\n")
+	shown := 0
+	for i := 0; i < len(got) || i < len(want); i++ {
+		g, w := "", ""
+		if i < len(got) {
+			g = got[i]
+		}
+		if i < len(want) {
+			w = want[i]
+		}
+		if g != w {
+			t.Errorf("%v:%v: got %q, expected %q", name, i+1, g, w)
+			if shown++; shown == 10 {
+				t.Fatal("too many differences, run with -update if they are intended")
+			}
+		}
+	}
+}
+
+func FuzzDecodeInstr(f *testing.F) {
+	f.Add([]byte{0x00, 0xF0, 0x01, 0xF8})
+	f.Add([]byte{0xBF, 0xF3, 0x4F, 0x8F})
+	f.Add([]byte{0x02, 0x48, 0x70, 0x47})
+	f.Add([]byte{0xEF, 0xF3})
+	f.Add([]byte{0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := &memoryMap{addr: 0x10000000, contents: data}
+		instrs := decodeAll(m)
+		p := &printer{maps: []*memoryMap{m}, labels: labelsFor(instrs, nil)}
+		size := uint32(0)
+		for _, in := range instrs {
+			p.format(in)
+			p.formatGNU(in)
+			strchunk(in.chunk)
+			size += in.size
+		}
+		if size > uint32(len(data)) {
+			t.Fatalf("decoded %v bytes out of %v", size, len(data))
+		}
+		traverse([]*memoryMap{m}, []uint32{m.addr}).listing(m)
+	})
+}
+
+// symbols of unknown size end at the next symbol or with their region
+func TestDescribe(t *testing.T) {
+	maps := []*memoryMap{{addr: 0x10000000, contents: make([]byte, 0x100)}}
+	symbols := newSymbolTable()
+	symbols.add("Reset", 0x10000000, 0, true)
+	symbols.add("table", 0x10000040, 8, false)
+	symbols.add("_l3", 0x10000080, 0, false)
+	tests := []struct {
+		addr uint32
+		name string
+	}{
+		{0x10000000, "Reset"},
+		{0x10000012, "Reset+0x12"},
+		{0x10000044, "table+0x4"},
+		{0x10000048, ""},
+		{0x100000FF, "_l3+0x7F"},
+		{0x10000100, ""},
+		{0xDEADBEEF, ""},
+	}
+	for _, test := range tests {
+		name, _ := symbols.describe(test.addr, maps)
+		if name != test.name {
+			t.Errorf("0x%08X is described as %q, expected %q", test.addr, name, test.name)
+		}
+	}
+}
+
+// a call that never returns is followed by the literal pool of its
+// caller, which must not be decoded as code
+func TestFlowLiterals(t *testing.T) {
+	maps := assembleModule(t, `section text at 0x10000000:
+_start:
+	ldr r0, =0x47704770
+	ldr r1, =0xBF00BF00
+	bl _start
+`)
+	code := traverse(maps, []uint32{0x10000000})
+	expected := []string{"LDR", "LDR", "BL", ".word", ".word"}
+	listing := code.listing(maps[0])
+	if len(listing) != len(expected) {
+		t.Fatalf("listed %v instructions, expected %v", len(listing), len(expected))
+	}
+	for i, in := range listing {
+		if in.op.String() != expected[i] {
+			t.Errorf("0x%08X is listed as %v, expected %v", in.addr, in.op, expected[i])
+		}
+	}
+}
+
+// a literal load into the middle of a 32 bit instruction restarts the
+// linear decoding at its target
+func TestDecodeAllTargets(t *testing.T) {
+	m := &memoryMap{addr: 0x10000000, contents: []byte{0x00, 0x48, 0x00, 0xF0, 0x00, 0xF8, 0x70, 0x47}}
+	instrs := decodeAll(m)
+	if len(instrs) < 3 || instrs[1].op != mnHword || instrs[2].addr != 0x10000004 {
+		t.Fatalf("the target 0x10000004 doesn't start an instruction")
+	}
+	if label := labelsFor(instrs, nil)[0x10000004]; label != "dat_10000004" {
+		t.Errorf("the target is labelled %q", label)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+)
+
+// lister splits a region into instructions and data
+type lister func(m *memoryMap) []*instr
+
+// decodeAll linearly decodes every halfword of the region. Branch and
+// literal targets always start an instruction, a 32 bit instruction
+// that would hide one is listed as a .hword instead
+func decodeAll(m *memoryMap) []*instr {
+	starts := map[uint32]bool{}
+	for {
+		out := decodeFrom(m, starts)
+		decoded := map[uint32]bool{}
+		for _, in := range out {
+			decoded[in.addr] = true
+		}
+		added := false
+		for _, in := range out {
+			for _, a := range in.args {
+				if a.kind != argTarget {
+					continue
+				}
+				if target := in.target(a); m.contains(target) && !decoded[target] && !starts[target] {
+					starts[target] = true
+					added = true
+				}
+			}
+		}
+		if !added {
+			return out
+		}
+	}
+}
+
+func decodeFrom(m *memoryMap, starts map[uint32]bool) []*instr {
+	out := []*instr{}
+	rb := newReadBuffer(m.contents)
+	addr := m.addr
+	for {
+		in := &instr{addr: addr}
+		if !decodeInstr(rb, in) {
+			break
+		}
+		if in.size == 4 && starts[addr+2] {
+			in = dataInstr(m, addr, 2)
+			rb = newReadBuffer(m.contents[addr+2-m.addr:])
+		}
+		out = append(out, in)
+		addr += in.size
+	}
+	return out
+}
+
+// Disassemble renders the region, symbols replace the automatic
+// labels of the addresses they name. regions is all the loaded memory
+func Disassemble(m *memoryMap, regions []*memoryMap, list lister, symbols *symbolTable) string {
+	instrs := list(m)
+	p := &printer{
+		maps:    []*memoryMap{m},
+		labels:  labelsFor(instrs, symbols),
+		symbols: symbols,
+		regions: regions,
+	}
+
+	out := ""
+	for _, in := range instrs {
+		if label, ok := p.labels[in.addr]; ok {
+			out += label + ":\n"
+		}
+		out += fmt.Sprintf("%08X", in.addr) +
+			" " + strchunk(in.chunk) +
+			"\t" + p.format(in) + "\n"
+	}
+	return out
+}
+
+func labelsFor(instrs []*instr, symbols *symbolTable) map[uint32]string {
+	out := autoLabels(instrs)
+	for _, in := range instrs {
+		if name, ok := symbols.name(in.addr); ok {
+			out[in.addr] = name
+		}
+	}
+	return out
+}
+
+// autoLabels names every branch, call and literal target that starts
+// an instruction: sub_ for BL targets, loc_ for other branches and
+// dat_ for ADR and literal loads
+func autoLabels(instrs []*instr) map[uint32]string {
+	starts := map[uint32]bool{}
+	for _, in := range instrs {
+		starts[in.addr] = true
+	}
+	out := map[uint32]string{}
+	for _, in := range instrs {
+		for _, a := range in.args {
+			if a.kind != argTarget {
+				continue
+			}
+			target := in.target(a)
+			if !starts[target] {
+				continue
+			}
+			prefix := "loc_"
+			switch in.op {
+			case mnBL:
+				prefix = "sub_"
+			case mnADR, mnLDR:
+				prefix = "dat_"
+			}
+			// calls take precedence over jumps, and both over data
+			old, ok := out[target]
+			if ok && (old[:4] == "sub_" || prefix == "dat_") {
+				continue
+			}
+			out[target] = fmt.Sprintf("%v%08X", prefix, target)
+		}
+	}
+	return out
+}
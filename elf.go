@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// readELF loads the PT_LOAD segments at their physical address, which
+// is where objcopy and elf2uf2 place them. Zero filled parts, like .bss,
+// are not part of the image
+func readELF(data []byte) ([]*memoryMap, uint32, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_ARM {
+		return nil, 0, fmt.Errorf("not a 32 bit ARM ELF file")
+	}
+	maps := []*memoryMap{}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Filesz == 0 {
+			continue
+		}
+		contents, err := io.ReadAll(io.NewSectionReader(p, 0, int64(p.Filesz)))
+		if err != nil {
+			return nil, 0, err
+		}
+		maps = append(maps, &memoryMap{addr: uint32(p.Paddr), contents: contents})
+	}
+	if len(maps) == 0 && f.Type == elf.ET_REL {
+		return nil, 0, fmt.Errorf("relocatable object files have no image, link them first")
+	}
+	maps, err = mergeMaps(maps)
+	return maps, uint32(f.Entry), err
+}
+
+// ELF32 constants, debug/elf only describes the structures
+const (
+	elfHeaderSize  = 52
+	elfPhdrSize    = 32
+	elfShdrSize    = 40
+	elfFlagsEABIv5 = 0x05000000
+)
+
+type elfSection struct {
+	name    string
+	kind    elf.SectionType
+	flags   elf.SectionFlag
+	addr    uint32
+	data    []byte
+	link    uint32
+	info    uint32
+	align   uint32
+	entsize uint32
+
+	// set by layout
+	offset    uint32
+	nameIndex uint32
+}
+
+type elfWriter struct {
+	kind     elf.Type
+	entry    uint32
+	sections []*elfSection
+}
+
+func (this *elfWriter) add(s *elfSection) uint32 {
+	this.sections = append(this.sections, s)
+	// index 0 is the null section
+	return uint32(len(this.sections))
+}
+
+// bytes lays out the file: header, program headers, section contents,
+// section names and section headers. Executables get one PT_LOAD per
+// allocated section
+func (this *elfWriter) bytes() []byte {
+	loads := []*elfSection{}
+	if this.kind == elf.ET_EXEC {
+		for _, s := range this.sections {
+			if s.flags&elf.SHF_ALLOC != 0 && s.kind == elf.SHT_PROGBITS && len(s.data) > 0 {
+				loads = append(loads, s)
+			}
+		}
+	}
+
+	shstrtab := &elfSection{name: ".shstrtab", kind: elf.SHT_STRTAB, align: 1}
+	sections := append(append([]*elfSection{}, this.sections...), shstrtab)
+	names := []byte{0}
+	for _, s := range sections {
+		s.nameIndex = uint32(len(names))
+		names = append(append(names, s.name...), 0)
+	}
+	shstrtab.data = names
+
+	offset := uint32(elfHeaderSize + len(loads)*elfPhdrSize)
+	for _, s := range sections {
+		if s.align > 1 {
+			offset = align(offset, s.align)
+		}
+		s.offset = offset
+		offset += uint32(len(s.data))
+	}
+	shoff := align(offset, 4)
+
+	out := []byte{0x7F, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	for len(out) < 16 {
+		out = append(out, 0)
+	}
+	phoff := uint32(0)
+	if len(loads) > 0 {
+		phoff = elfHeaderSize
+	}
+	out = appendU16(out, uint16(this.kind))
+	out = appendU16(out, uint16(elf.EM_ARM))
+	out = appendU32(out, uint32(elf.EV_CURRENT))
+	out = appendU32(out, this.entry)
+	out = appendU32(out, phoff)
+	out = appendU32(out, shoff)
+	out = appendU32(out, elfFlagsEABIv5)
+	out = appendU16(out, elfHeaderSize)
+	out = appendU16(out, elfPhdrSize)
+	out = appendU16(out, uint16(len(loads)))
+	out = appendU16(out, elfShdrSize)
+	out = appendU16(out, uint16(len(sections)+1))
+	out = appendU16(out, uint16(len(sections))) // .shstrtab is the last one
+
+	for _, s := range loads {
+		flags := elf.PF_R
+		if s.flags&elf.SHF_EXECINSTR != 0 {
+			flags |= elf.PF_X
+		}
+		if s.flags&elf.SHF_WRITE != 0 {
+			flags |= elf.PF_W
+		}
+		out = appendU32(out, uint32(elf.PT_LOAD))
+		out = appendU32(out, s.offset)
+		out = appendU32(out, s.addr)
+		out = appendU32(out, s.addr)
+		out = appendU32(out, uint32(len(s.data)))
+		out = appendU32(out, uint32(len(s.data)))
+		out = appendU32(out, uint32(flags))
+		out = appendU32(out, s.align)
+	}
+	for _, s := range sections {
+		for uint32(len(out)) < s.offset {
+			out = append(out, 0)
+		}
+		out = append(out, s.data...)
+	}
+	for uint32(len(out)) < shoff {
+		out = append(out, 0)
+	}
+
+	out = append(out, make([]byte, elfShdrSize)...) // null section
+	for _, s := range sections {
+		out = appendU32(out, s.nameIndex)
+		out = appendU32(out, uint32(s.kind))
+		out = appendU32(out, uint32(s.flags))
+		out = appendU32(out, s.addr)
+		out = appendU32(out, s.offset)
+		out = appendU32(out, uint32(len(s.data)))
+		out = appendU32(out, s.link)
+		out = appendU32(out, s.info)
+		out = appendU32(out, s.align)
+		out = appendU32(out, s.entsize)
+	}
+	return out
+}
+
+// writeELF builds an executable with one section and segment per region
+func writeELF(maps []*memoryMap, entry uint32) []byte {
+	w := &elfWriter{kind: elf.ET_EXEC, entry: entry}
+	for _, m := range maps {
+		// the file offset must be congruent to the address
+		alignment := uint32(4)
+		for m.addr%alignment != 0 {
+			alignment /= 2
+		}
+		w.add(&elfSection{
+			name:  fmt.Sprintf(".text.r%08X", m.addr),
+			kind:  elf.SHT_PROGBITS,
+			flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR | elf.SHF_WRITE,
+			addr:  m.addr,
+			data:  m.contents,
+			align: alignment,
+		})
+	}
+	return w.bytes()
+}
+
+type elfSymbol struct {
+	name    string
+	value   uint32
+	size    uint32
+	kind    elf.SymType
+	bind    elf.SymBind
+	section uint16
+}
+
+// symtab builds the .symtab and .strtab contents, locals must come first
+func symtab(syms []*elfSymbol) ([]byte, []byte) {
+	strtab := []byte{0}
+	out := make([]byte, 16) // null symbol
+	for _, s := range syms {
+		name := uint32(0)
+		if s.name != "" {
+			name = uint32(len(strtab))
+			strtab = append(append(strtab, s.name...), 0)
+		}
+		out = appendU32(out, name)
+		out = appendU32(out, s.value)
+		out = appendU32(out, s.size)
+		out = append(out, byte(s.bind)<<4|byte(s.kind), 0)
+		out = appendU16(out, s.section)
+	}
+	return out, strtab
+}
+
+// writeObject builds a relocatable object with one section per source
+// section. Words and calls referring to labels of another section are
+// relocated like the undefined symbols, so the linker may place the
+// sections anywhere. Labels only used as branch targets are local
+func writeObject(obj *object) []byte {
+	return writeAssembled(obj, elf.ET_REL, 0)
+}
+
+// writeExecutable builds a linked executable, sections are loaded at
+// their address
+func writeExecutable(obj *object, entry uint32) []byte {
+	return writeAssembled(obj, elf.ET_EXEC, entry)
+}
+
+func writeAssembled(obj *object, kind elf.Type, entry uint32) []byte {
+	w := &elfWriter{kind: kind, entry: entry}
+	index := map[*asmSection]uint16{}
+	// section relative values in objects, addresses in executables
+	value := func(s *asmSection, addr uint32) uint32 {
+		if kind == elf.ET_REL {
+			return addr - s.addr
+		}
+		return addr
+	}
+
+	locals := []*elfSymbol{}
+	sectionSyms := map[*asmSection]uint32{}
+	for _, s := range obj.sections {
+		flags := elf.SHF_ALLOC | elf.SHF_WRITE
+		for _, m := range s.marks {
+			if m.code {
+				flags = elf.SHF_ALLOC | elf.SHF_EXECINSTR
+			}
+		}
+		alignment := uint32(4)
+		if s.addr%4 != 0 {
+			alignment = 2
+		}
+		sec := &elfSection{
+			name:  "." + s.name,
+			kind:  elf.SHT_PROGBITS,
+			flags: flags,
+			data:  s.contents,
+			align: alignment,
+		}
+		if kind == elf.ET_EXEC {
+			sec.addr = s.addr
+		}
+		index[s] = uint16(w.add(sec))
+		locals = append(locals, &elfSymbol{kind: elf.STT_SECTION, bind: elf.STB_LOCAL, section: index[s], value: value(s, s.addr)})
+		sectionSyms[s] = uint32(len(locals))
+		// mapping symbols tell debuggers and disassemblers what is code
+		for _, m := range s.marks {
+			name := "$d"
+			if m.code {
+				name = "$t"
+			}
+			locals = append(locals, &elfSymbol{name: name, kind: elf.STT_NOTYPE, bind: elf.STB_LOCAL, section: index[s], value: value(s, m.addr)})
+		}
+	}
+
+	labels := []*symbol{}
+	for _, sy := range obj.symbols {
+		labels = append(labels, sy)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].addr != labels[j].addr {
+			return labels[i].addr < labels[j].addr
+		}
+		return labels[i].name < labels[j].name
+	})
+	globals := []*elfSymbol{}
+	for _, sy := range labels {
+		sym := &elfSymbol{name: sy.name, kind: elf.STT_OBJECT, bind: elf.STB_GLOBAL, section: index[sy.section], value: value(sy.section, sy.addr)}
+		if sy.local() {
+			sym.kind = elf.STT_NOTYPE
+			sym.bind = elf.STB_LOCAL
+			locals = append(locals, sym)
+			continue
+		}
+		if sy.section.isCode(sy.addr) {
+			sym.kind = elf.STT_FUNC
+			sym.value |= 1
+		}
+		globals = append(globals, sym)
+	}
+
+	undefined := map[string]uint32{}
+	names := []string{}
+	for _, s := range obj.sections {
+		for _, r := range s.relocs {
+			if _, ok := undefined[r.symbol]; !ok && r.section == nil {
+				names = append(names, r.symbol)
+				undefined[r.symbol] = 0
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		globals = append(globals, &elfSymbol{name: name, kind: elf.STT_NOTYPE, bind: elf.STB_GLOBAL, section: uint16(elf.SHN_UNDEF)})
+	}
+	syms := append(locals, globals...)
+	for i, sym := range syms {
+		if sym.section == uint16(elf.SHN_UNDEF) {
+			undefined[sym.name] = uint32(i + 1)
+		}
+	}
+
+	symData, strData := symtab(syms)
+	symIndex := uint32(len(w.sections)) + 1
+	w.add(&elfSection{
+		name:    ".symtab",
+		kind:    elf.SHT_SYMTAB,
+		data:    symData,
+		link:    symIndex + 1,
+		info:    uint32(len(locals)) + 1, // first global
+		align:   4,
+		entsize: 16,
+	})
+	w.add(&elfSection{name: ".strtab", kind: elf.SHT_STRTAB, data: strData, align: 1})
+
+	for _, s := range obj.sections {
+		if len(s.relocs) == 0 {
+			continue
+		}
+		data := []byte{}
+		for _, r := range s.relocs {
+			sym := undefined[r.symbol]
+			if r.section != nil {
+				sym = sectionSyms[r.section]
+			}
+			data = appendU32(data, value(s, r.addr))
+			data = appendU32(data, sym<<8|uint32(r.kind))
+		}
+		w.add(&elfSection{
+			name:    ".rel." + s.name,
+			kind:    elf.SHT_REL,
+			flags:   elf.SHF_INFO_LINK,
+			data:    data,
+			link:    symIndex,
+			info:    uint32(index[s]),
+			align:   4,
+			entsize: 8,
+		})
+	}
+	return w.bytes()
+}
@@ -0,0 +1,1037 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"strings"
+)
+
+type instrCtx struct {
+	asm     *assembler
+	section *asmSection
+	stmt    *statement
+	addr    uint32
+	// literal pool entry used by the '=' operand, if any
+	lit *literal
+}
+
+func (this *instrCtx) errorf(format string, a ...any) error {
+	return lineErr(this.stmt.line, "%v: %v", this.stmt.mnemonic, fmt.Sprintf(format, a...))
+}
+
+func (this *instrCtx) ops() []*operand {
+	return this.stmt.operands
+}
+
+// pc is the value of the PC register as seen by the instruction
+func (this *instrCtx) pc() uint32 {
+	return this.addr + 4
+}
+
+func (this *instrCtx) want(n int) error {
+	if len(this.ops()) != n {
+		return this.errorf("expected %v operands, found %v", n, len(this.ops()))
+	}
+	return nil
+}
+
+func (this *instrCtx) reg(op *operand) (uint16, error) {
+	if op.kind != opReg {
+		return 0, this.errorf("expected register, found %v", op)
+	}
+	if op.writeback {
+		return 0, this.errorf("unexpected '!' after %v", op)
+	}
+	return op.reg, nil
+}
+
+func (this *instrCtx) lowReg(op *operand) (uint16, error) {
+	r, err := this.reg(op)
+	if err != nil {
+		return 0, err
+	}
+	if r > 7 {
+		return 0, this.errorf("expected low register (r0-r7), found %v", reg(r))
+	}
+	return r, nil
+}
+
+func (this *instrCtx) isReg(i int) bool {
+	return i < len(this.ops()) && this.ops()[i].kind == opReg
+}
+
+func (this *instrCtx) isLowReg(i int) bool {
+	return this.isReg(i) && this.ops()[i].reg <= 7
+}
+
+func (this *instrCtx) isImm(i int) bool {
+	return i < len(this.ops()) && this.ops()[i].kind == opExpr
+}
+
+// imm evaluates an immediate that must be a multiple of scale and,
+// after being divided by scale, fit in the given number of bits
+func (this *instrCtx) imm(op *operand, bits uint, scale int64) (uint16, error) {
+	v, err := this.asm.eval(op)
+	if err != nil {
+		return 0, err
+	}
+	return this.checkImm(v, bits, scale)
+}
+
+func (this *instrCtx) checkImm(v int64, bits uint, scale int64) (uint16, error) {
+	if v%scale != 0 {
+		return 0, this.errorf("immediate %v is not a multiple of %v", v, scale)
+	}
+	max := (int64(1)<<bits - 1) * scale
+	if v < 0 || v > max {
+		return 0, this.errorf("immediate %v out of range [0, %v]", v, max)
+	}
+	return uint16(v / scale), nil
+}
+
+// target evaluates a branch or literal target and returns the offset
+// relative to base. In objects the offset to another section is only
+// known once linked
+func (this *instrCtx) target(op *operand, base uint32) (int64, error) {
+	if sy := this.asm.label(op); sy != nil && sy.section != this.section {
+		return 0, this.errorf("'%v' is in section '%v', only BL and words may refer to other sections of an object", op.name, sy.section.name)
+	}
+	v, err := this.asm.eval(op)
+	if err != nil {
+		return 0, err
+	}
+	return v - int64(base), nil
+}
+
+func (this *instrCtx) branchOffset(op *operand, bits uint) (uint32, error) {
+	offset, err := this.target(op, this.pc())
+	if err != nil {
+		return 0, err
+	}
+	if offset%2 != 0 {
+		return 0, this.errorf("branch target is not halfword aligned")
+	}
+	limit := int64(1) << bits
+	if offset < -limit || offset >= limit {
+		return 0, this.errorf("branch target out of range (offset %v)", offset)
+	}
+	return uint32(offset>>1) & (uint32(1)<<bits - 1), nil
+}
+
+// jump counts a B or B<c> to a label, labels only used by those stay
+// local to the object
+func (this *instrCtx) jump(op *operand) {
+	if sy, ok := this.asm.symbols[op.name]; ok && op.kind == opExpr {
+		sy.jumps++
+	}
+}
+
+// literalOffset computes the imm8 of PC relative loads, the target
+// is relative to Align(PC, 4)
+func (this *instrCtx) literalOffset(target int64) (uint16, error) {
+	offset := target - int64(this.pc()&^0b11)
+	if target%4 != 0 {
+		return 0, this.errorf("target address 0x%X is not word aligned", target)
+	}
+	if offset < 0 || offset > 1020 {
+		return 0, this.errorf("target out of range (offset %v)", offset)
+	}
+	return uint16(offset / 4), nil
+}
+
+type encodeFunc func(ctx *instrCtx) ([]uint16, error)
+
+func encodeInstr(ctx *instrCtx) ([]byte, error) {
+	enc, ok := encoders[ctx.stmt.mnemonic]
+	if !ok {
+		c, isBranch := condBranch(ctx.stmt.mnemonic)
+		if !isBranch {
+			return nil, ctx.errorf("unknown instruction")
+		}
+		enc = func(ctx *instrCtx) ([]uint16, error) {
+			return encodeBCond(ctx, c)
+		}
+	}
+	hws, err := enc(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(hws)*2) != instrSize(ctx.stmt.mnemonic) {
+		// the layout pass gave the instruction another size
+		return nil, ctx.errorf("encoded on %v bytes instead of %v", len(hws)*2, instrSize(ctx.stmt.mnemonic))
+	}
+	out := []byte{}
+	for _, hw := range hws {
+		out = appendU16(out, hw)
+	}
+	return out, nil
+}
+
+var encoders map[string]encodeFunc
+
+func init() {
+	encoders = map[string]encodeFunc{
+		"ADCS":  lowDN(0b0100_0001_0100_0000),
+		"ADD":   encodeADD,
+		"ADDS":  encodeADDS,
+		"ADR":   encodeADR,
+		"ANDS":  lowDN(0b0100_0000_0000_0000),
+		"ASRS":  shift(0b0001_0000_0000_0000, 0b0100_0001_0000_0000, true),
+		"B":     encodeB,
+		"BICS":  lowDN(0b0100_0011_1000_0000),
+		"BKPT":  imm8(0b1011_1110_0000_0000),
+		"BL":    encodeBL,
+		"BLX":   branchReg(0b0100_0111_1000_0000),
+		"BX":    branchReg(0b0100_0111_0000_0000),
+		"CMN":   lowNM(0b0100_0010_1100_0000),
+		"CMP":   encodeCMP,
+		"CPSID": cps(0b1011_0110_0111_0010),
+		"CPSIE": cps(0b1011_0110_0110_0010),
+		"DMB":   barrier(0b1000_1111_0101_0000),
+		"DSB":   barrier(0b1000_1111_0100_0000),
+		"EORS":  lowDN(0b0100_0000_0100_0000),
+		"ISB":   barrier(0b1000_1111_0110_0000),
+		"LDM":   encodeLDM,
+		"LDR":   encodeLDR,
+		"LDRB":  loadStore(0b0111_1000_0000_0000, 0b0101_1100_0000_0000, 1),
+		"LDRH":  loadStore(0b1000_1000_0000_0000, 0b0101_1010_0000_0000, 2),
+		"LDRSB": loadStore(0, 0b0101_0110_0000_0000, 0),
+		"LDRSH": loadStore(0, 0b0101_1110_0000_0000, 0),
+		"LSLS":  shift(0b0000_0000_0000_0000, 0b0100_0000_1000_0000, false),
+		"LSRS":  shift(0b0000_1000_0000_0000, 0b0100_0000_1100_0000, true),
+		"MOV":   encodeMOV,
+		"MOVS":  encodeMOVS,
+		"MRS":   encodeMRS,
+		"MSR":   encodeMSR,
+		"MULS":  encodeMULS,
+		"MVNS":  lowDM(0b0100_0011_1100_0000),
+		"NEGS":  encodeRSBS,
+		"NOP":   fixed(0b1011_1111_0000_0000),
+		"ORRS":  lowDN(0b0100_0011_0000_0000),
+		"POP":   pushPop(0b1011_1100_0000_0000, 15),
+		"PUSH":  pushPop(0b1011_0100_0000_0000, 14),
+		"REV":   lowDM(0b1011_1010_0000_0000),
+		"REV16": lowDM(0b1011_1010_0100_0000),
+		"REVSH": lowDM(0b1011_1010_1100_0000),
+		"RORS":  lowDN(0b0100_0001_1100_0000),
+		"RSBS":  encodeRSBS,
+		"SBCS":  lowDN(0b0100_0001_1000_0000),
+		"SEV":   fixed(0b1011_1111_0100_0000),
+		"STM":   encodeSTM,
+		"STR":   encodeSTR,
+		"STRB":  loadStore(0b0111_0000_0000_0000, 0b0101_0100_0000_0000, 1),
+		"STRH":  loadStore(0b1000_0000_0000_0000, 0b0101_0010_0000_0000, 2),
+		"SUB":   encodeSUB,
+		"SUBS":  encodeSUBS,
+		"SVC":   imm8(0b1101_1111_0000_0000),
+		"SXTB":  lowDM(0b1011_0010_0100_0000),
+		"SXTH":  lowDM(0b1011_0010_0000_0000),
+		"TST":   lowNM(0b0100_0010_0000_0000),
+		"UDF":   imm8(0b1101_1110_0000_0000),
+		"UDF.W": encodeUDFW,
+		"UXTB":  lowDM(0b1011_0010_1100_0000),
+		"UXTH":  lowDM(0b1011_0010_1000_0000),
+		"WFE":   fixed(0b1011_1111_0010_0000),
+		"WFI":   fixed(0b1011_1111_0011_0000),
+		"YIELD": fixed(0b1011_1111_0001_0000),
+	}
+}
+
+// condBranch recognizes B<c> mnemonics and returns the condition
+func condBranch(mnemonic string) (uint16, bool) {
+	if len(mnemonic) != 3 || mnemonic[0] != 'B' {
+		return 0, false
+	}
+	suffix := mnemonic[1:]
+	switch suffix {
+	case "HS":
+		suffix = "CS"
+	case "LO":
+		suffix = "CC"
+	}
+	for c := uint8(0); c < 14; c++ {
+		if cond(c) == suffix {
+			return uint16(c), true
+		}
+	}
+	return 0, false
+}
+
+func fixed(hw uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		if err := ctx.want(0); err != nil {
+			return nil, err
+		}
+		return []uint16{hw}, nil
+	}
+}
+
+// CPSIE/CPSID i
+func cps(hw uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		if err := ctx.want(1); err != nil {
+			return nil, err
+		}
+		op := ctx.ops()[0]
+		if op.kind != opExpr || strings.ToLower(op.name) != "i" || op.value != 0 {
+			return nil, ctx.errorf("expected 'i', found %v", op)
+		}
+		return []uint16{hw}, nil
+	}
+}
+
+// OP #<imm8>
+func imm8(base uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		if err := ctx.want(1); err != nil {
+			return nil, err
+		}
+		imm, err := ctx.imm(ctx.ops()[0], 8, 1)
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{base | imm}, nil
+	}
+}
+
+// OP <Rdn>, <Rm> with low registers, also accepts OP <Rdn>, <Rdn>, <Rm>
+func lowDN(base uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		ops := ctx.ops()
+		if len(ops) == 3 {
+			if !ctx.isReg(0) || !ctx.isReg(1) || ops[0].reg != ops[1].reg {
+				return nil, ctx.errorf("first and second operands must be the same register")
+			}
+			ops = ops[1:]
+		} else if err := ctx.want(2); err != nil {
+			return nil, err
+		}
+		return encodeLow2(ctx, base, ops[0], ops[1])
+	}
+}
+
+// OP <Rd>, <Rm> with low registers
+func lowDM(base uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		if err := ctx.want(2); err != nil {
+			return nil, err
+		}
+		return encodeLow2(ctx, base, ctx.ops()[0], ctx.ops()[1])
+	}
+}
+
+// OP <Rn>, <Rm> with low registers
+func lowNM(base uint16) encodeFunc {
+	return lowDM(base)
+}
+
+func encodeLow2(ctx *instrCtx, base uint16, a, b *operand) ([]uint16, error) {
+	rd, err := ctx.lowReg(a)
+	if err != nil {
+		return nil, err
+	}
+	rm, err := ctx.lowReg(b)
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{base | rm<<3 | rd}, nil
+}
+
+// OP <Rd>, <Rn>, <Rm> with low registers
+func encodeLow3(ctx *instrCtx, base uint16) ([]uint16, error) {
+	ops := ctx.ops()
+	rd, err := ctx.lowReg(ops[0])
+	if err != nil {
+		return nil, err
+	}
+	rn, err := ctx.lowReg(ops[1])
+	if err != nil {
+		return nil, err
+	}
+	rm, err := ctx.lowReg(ops[2])
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{base | rm<<6 | rn<<3 | rd}, nil
+}
+
+// OP <Rd>, <Rn>, #<imm3>
+func encodeImm3(ctx *instrCtx, base uint16, imm uint16) ([]uint16, error) {
+	ops := ctx.ops()
+	rd, err := ctx.lowReg(ops[0])
+	if err != nil {
+		return nil, err
+	}
+	rn, err := ctx.lowReg(ops[1])
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{base | imm<<6 | rn<<3 | rd}, nil
+}
+
+// OP <Rdn>, #<imm8>
+func encodeRdImm8(ctx *instrCtx, base uint16, rdOp, immOp *operand, scale int64) ([]uint16, error) {
+	rd, err := ctx.lowReg(rdOp)
+	if err != nil {
+		return nil, err
+	}
+	imm, err := ctx.imm(immOp, 8, scale)
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{base | rd<<8 | imm}, nil
+}
+
+// ADDS <Rd>, <Rn>, #<imm3>
+// ADDS <Rdn>, #<imm8>
+// ADDS <Rd>, <Rn>, <Rm>
+func encodeADDS(ctx *instrCtx) ([]uint16, error) {
+	return addSub(ctx, 0b0001_1100_0000_0000, 0b0011_0000_0000_0000, 0b0001_1000_0000_0000)
+}
+
+// SUBS <Rd>, <Rn>, #<imm3>
+// SUBS <Rdn>, #<imm8>
+// SUBS <Rd>, <Rn>, <Rm>
+func encodeSUBS(ctx *instrCtx) ([]uint16, error) {
+	return addSub(ctx, 0b0001_1110_0000_0000, 0b0011_1000_0000_0000, 0b0001_1010_0000_0000)
+}
+
+func addSub(ctx *instrCtx, imm3, imm8, regs uint16) ([]uint16, error) {
+	ops := ctx.ops()
+	switch {
+	case len(ops) == 2 && ctx.isImm(1):
+		return encodeRdImm8(ctx, imm8, ops[0], ops[1], 1)
+	case len(ops) == 2:
+		rd, err := ctx.lowReg(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		rm, err := ctx.lowReg(ops[1])
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{regs | rm<<6 | rd<<3 | rd}, nil
+	case len(ops) == 3 && ctx.isImm(2):
+		v, err := ctx.asm.eval(ops[2])
+		if err != nil {
+			return nil, err
+		}
+		if v > 7 && ctx.isReg(0) && ctx.isReg(1) && ops[0].reg == ops[1].reg {
+			return encodeRdImm8(ctx, imm8, ops[0], ops[2], 1)
+		}
+		imm, err := ctx.checkImm(v, 3, 1)
+		if err != nil {
+			return nil, err
+		}
+		return encodeImm3(ctx, imm3, imm)
+	case len(ops) == 3:
+		return encodeLow3(ctx, regs)
+	}
+	return nil, ctx.errorf("invalid operands")
+}
+
+// ADD <Rdn>, <Rm>
+// ADD <Rd>, SP, #<imm8>
+// ADD SP, SP, #<imm7>
+// ADD <Rdm>, SP, <Rdm>
+// ADD SP, <Rm>
+// ADD <Rd>, PC, #<imm8>
+func encodeADD(ctx *instrCtx) ([]uint16, error) {
+	ops := ctx.ops()
+	if len(ops) == 2 && ctx.isReg(0) && ctx.isImm(1) && ops[0].reg == 13 {
+		return encodeSPImm7(ctx, 0b1011_0000_0000_0000, ops[1])
+	}
+	if len(ops) == 2 {
+		return encodeHiDN(ctx, 0b0100_0100_0000_0000, ops[0], ops[1])
+	}
+	if err := ctx.want(3); err != nil {
+		return nil, err
+	}
+	if !ctx.isReg(0) || !ctx.isReg(1) {
+		return nil, ctx.errorf("invalid operands")
+	}
+	rd, rn := ops[0].reg, ops[1].reg
+	if ctx.isImm(2) {
+		switch {
+		case rd == 13 && rn == 13:
+			return encodeSPImm7(ctx, 0b1011_0000_0000_0000, ops[2])
+		case rn == 13:
+			return encodeRdImm8(ctx, 0b1010_1000_0000_0000, ops[0], ops[2], 4)
+		case rn == 15:
+			return encodeRdImm8(ctx, 0b1010_0000_0000_0000, ops[0], ops[2], 4)
+		}
+		return nil, ctx.errorf("immediate form only accepts SP or PC as base, use ADDS")
+	}
+	if !ctx.isReg(2) {
+		return nil, ctx.errorf("invalid operands")
+	}
+	if rd == rn {
+		return encodeHiDN(ctx, 0b0100_0100_0000_0000, ops[0], ops[2])
+	}
+	if rd == ops[2].reg {
+		return encodeHiDN(ctx, 0b0100_0100_0000_0000, ops[0], ops[1])
+	}
+	return nil, ctx.errorf("destination must be one of the sources, use ADDS")
+}
+
+// OP SP, SP, #<imm7>
+func encodeSPImm7(ctx *instrCtx, base uint16, op *operand) ([]uint16, error) {
+	imm, err := ctx.imm(op, 7, 4)
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{base | imm}, nil
+}
+
+// OP <Rdn>, <Rm> with any register, D is stored in bit 7
+func encodeHiDN(ctx *instrCtx, base uint16, a, b *operand) ([]uint16, error) {
+	rd, err := ctx.reg(a)
+	if err != nil {
+		return nil, err
+	}
+	rm, err := ctx.reg(b)
+	if err != nil {
+		return nil, err
+	}
+	D := (rd & 0b1000) << 4
+	return []uint16{base | D | rm<<3 | rd&0b0111}, nil
+}
+
+// SUB SP, SP, #<imm7>
+func encodeSUB(ctx *instrCtx) ([]uint16, error) {
+	ops := ctx.ops()
+	var immOp *operand
+	switch {
+	case len(ops) == 2 && ctx.isReg(0) && ops[0].reg == 13:
+		immOp = ops[1]
+	case len(ops) == 3 && ctx.isReg(0) && ctx.isReg(1) && ops[0].reg == 13 && ops[1].reg == 13:
+		immOp = ops[2]
+	default:
+		return nil, ctx.errorf("only SUB SP, SP, #<imm7> is available, use SUBS")
+	}
+	if !ctx.isImm(len(ops) - 1) {
+		return nil, ctx.errorf("expected immediate, found %v", immOp)
+	}
+	return encodeSPImm7(ctx, 0b1011_0000_1000_0000, immOp)
+}
+
+// ADR <Rd>, <label>
+// ADR <Rd>, PC, #<imm8>
+func encodeADR(ctx *instrCtx) ([]uint16, error) {
+	ops := ctx.ops()
+	if len(ops) == 3 {
+		if !ctx.isReg(1) || ops[1].reg != 15 {
+			return nil, ctx.errorf("expected PC as second operand")
+		}
+		return encodeRdImm8(ctx, 0b1010_0000_0000_0000, ops[0], ops[2], 4)
+	}
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	rd, err := ctx.lowReg(ops[0])
+	if err != nil {
+		return nil, err
+	}
+	target, err := ctx.asm.eval(ops[1])
+	if err != nil {
+		return nil, err
+	}
+	imm, err := ctx.literalOffset(target)
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{0b1010_0000_0000_0000 | rd<<8 | imm}, nil
+}
+
+// ASRS/LSRS/LSLS <Rd>, <Rm>, #<imm5>
+// ASRS/LSRS/LSLS <Rdn>, <Rm>
+func shift(immBase, regBase uint16, upTo32 bool) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		ops := ctx.ops()
+		if len(ops) == 3 && ctx.isImm(2) {
+			v, err := ctx.asm.eval(ops[2])
+			if err != nil {
+				return nil, err
+			}
+			base := immBase
+			if upTo32 && v == 0 {
+				// shifting by zero is a plain move
+				base = 0b0000_0000_0000_0000
+			} else if upTo32 {
+				if v < 1 || v > 32 {
+					return nil, ctx.errorf("shift amount %v out of range [1, 32]", v)
+				}
+				v = v % 32
+			}
+			imm, err := ctx.checkImm(v, 5, 1)
+			if err != nil {
+				return nil, err
+			}
+			rd, err := ctx.lowReg(ops[0])
+			if err != nil {
+				return nil, err
+			}
+			rm, err := ctx.lowReg(ops[1])
+			if err != nil {
+				return nil, err
+			}
+			return []uint16{base | imm<<6 | rm<<3 | rd}, nil
+		}
+		return lowDN(regBase)(ctx)
+	}
+}
+
+// B<c> <label>
+func encodeBCond(ctx *instrCtx, c uint16) ([]uint16, error) {
+	if err := ctx.want(1); err != nil {
+		return nil, err
+	}
+	imm8, err := ctx.branchOffset(ctx.ops()[0], 8)
+	if err != nil {
+		return nil, err
+	}
+	ctx.jump(ctx.ops()[0])
+	return []uint16{0b1101_0000_0000_0000 | c<<8 | uint16(imm8)}, nil
+}
+
+// B <label>
+func encodeB(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(1); err != nil {
+		return nil, err
+	}
+	imm11, err := ctx.branchOffset(ctx.ops()[0], 11)
+	if err != nil {
+		return nil, err
+	}
+	ctx.jump(ctx.ops()[0])
+	return []uint16{0b1110_0000_0000_0000 | uint16(imm11)}, nil
+}
+
+// BL <label>
+func encodeBL(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(1); err != nil {
+		return nil, err
+	}
+	op := ctx.ops()[0]
+	if ctx.asm.external(op) {
+		// the addend is the offset of the target from the PC,
+		// R_ARM_THM_PC22 is the old name of R_ARM_THM_CALL
+		ctx.section.relocate(ctx.addr, elf.R_ARM_THM_PC22, op.name)
+		return encodeBLOffset(uint32((op.value-4)>>1) & (1<<24 - 1)), nil
+	}
+	if sy := ctx.asm.label(op); sy != nil && sy.section != ctx.section {
+		// calls within a section don't depend on where it's placed
+		sy.refs++
+		ctx.section.relocateLabel(ctx.addr, elf.R_ARM_THM_PC22, sy)
+		return encodeBLOffset(uint32((int64(sy.addr-sy.section.addr)+op.value-4)>>1) & (1<<24 - 1)), nil
+	}
+	imm24, err := ctx.branchOffset(op, 24)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBLOffset(imm24), nil
+}
+
+// encodeBLOffset splits the halfword offset into the BL fields,
+// with J1 = NOT(I1) XOR S and J2 = NOT(I2) XOR S
+func encodeBLOffset(imm24 uint32) []uint16 {
+	S := uint16(imm24>>23) & 1
+	I1 := uint16(imm24>>22) & 1
+	I2 := uint16(imm24>>21) & 1
+	imm10 := uint16(imm24>>11) & bits9_0
+	imm11 := uint16(imm24) & bits10_0
+	J1 := (I1 ^ 1) ^ S
+	J2 := (I2 ^ 1) ^ S
+	hw1 := 0b1111_0000_0000_0000 | S<<10 | imm10
+	hw2 := 0b1101_0000_0000_0000 | J1<<13 | J2<<11 | imm11
+	return []uint16{hw1, hw2}
+}
+
+// BX/BLX <Rm>
+func branchReg(base uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		if err := ctx.want(1); err != nil {
+			return nil, err
+		}
+		rm, err := ctx.reg(ctx.ops()[0])
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{base | rm<<3}, nil
+	}
+}
+
+// CMP <Rn>, #<imm8>
+// CMP <Rn>, <Rm>
+func encodeCMP(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	ops := ctx.ops()
+	if ctx.isImm(1) {
+		return encodeRdImm8(ctx, 0b0010_1000_0000_0000, ops[0], ops[1], 1)
+	}
+	if ctx.isLowReg(0) && ctx.isLowReg(1) {
+		return encodeLow2(ctx, 0b0100_0010_1000_0000, ops[0], ops[1])
+	}
+	return encodeHiDN(ctx, 0b0100_0101_0000_0000, ops[0], ops[1])
+}
+
+// DMB/DSB/ISB [<option>]
+// DMB/DSB/ISB #<imm4>
+func barrier(base uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		option := uint16(0b1111)
+		ops := ctx.ops()
+		if len(ops) == 1 {
+			op := ops[0]
+			ok := false
+			if op.kind == opExpr && op.name != "" && op.value == 0 {
+				for v, name := range barrierNames {
+					if strings.EqualFold(name, op.name) {
+						option, ok = v, true
+					}
+				}
+			} else if op.kind == opExpr && op.name == "" {
+				var err error
+				option, err = ctx.imm(op, 4, 1)
+				if err != nil {
+					return nil, err
+				}
+				ok = true
+			}
+			if !ok {
+				return nil, ctx.errorf("invalid barrier option %v", op)
+			}
+		} else if err := ctx.want(0); err != nil {
+			return nil, err
+		}
+		return []uint16{0b1111_0011_1011_1111, base | option}, nil
+	}
+}
+
+var specialRegs = map[string]uint16{
+	"APSR":    0b0000_0000,
+	"IAPSR":   0b0000_0001,
+	"EAPSR":   0b0000_0010,
+	"XPSR":    0b0000_0011,
+	"IPSR":    0b0000_0101,
+	"EPSR":    0b0000_0110,
+	"IEPSR":   0b0000_0111,
+	"MSP":     0b0000_1000,
+	"PSP":     0b0000_1001,
+	"PRIMASK": 0b0001_0000,
+	"CONTROL": 0b0001_0100,
+}
+
+func (this *instrCtx) specialReg(op *operand, write bool) (uint16, error) {
+	if op.kind != opExpr || op.name == "" || op.value != 0 {
+		return 0, this.errorf("expected special register, found %v", op)
+	}
+	name := strings.ToUpper(op.name)
+	if write {
+		// the PSR forms are only writable with the _nzcvq mask
+		name = strings.TrimSuffix(name, "_NZCVQ")
+	}
+	SYSm, ok := specialRegs[name]
+	if !ok {
+		return 0, this.errorf("unknown special register '%v'", op.name)
+	}
+	return SYSm, nil
+}
+
+// UDF.W #<imm16>
+func encodeUDFW(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(1); err != nil {
+		return nil, err
+	}
+	imm, err := ctx.imm(ctx.ops()[0], 16, 1)
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{0b1111_0111_1111_0000 | imm>>12, 0b1010_0000_0000_0000 | imm&bits11_0}, nil
+}
+
+// MRS <Rd>, <spec_reg>
+func encodeMRS(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	rd, err := ctx.reg(ctx.ops()[0])
+	if err != nil {
+		return nil, err
+	}
+	if rd == 13 || rd == 15 {
+		return nil, ctx.errorf("%v is unpredictable", reg(rd))
+	}
+	SYSm, err := ctx.specialReg(ctx.ops()[1], false)
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{0b1111_0011_1110_1111, 0b1000_0000_0000_0000 | rd<<8 | SYSm}, nil
+}
+
+// MSR <spec_reg>, <Rn>
+func encodeMSR(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	SYSm, err := ctx.specialReg(ctx.ops()[0], true)
+	if err != nil {
+		return nil, err
+	}
+	rn, err := ctx.reg(ctx.ops()[1])
+	if err != nil {
+		return nil, err
+	}
+	if rn == 13 || rn == 15 {
+		return nil, ctx.errorf("%v is unpredictable", reg(rn))
+	}
+	return []uint16{0b1111_0011_1000_0000 | rn, 0b1000_1000_0000_0000 | SYSm}, nil
+}
+
+// MOV <Rd>, <Rm>
+func encodeMOV(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	if ctx.isImm(1) {
+		return nil, ctx.errorf("immediate form is only available as MOVS")
+	}
+	return encodeHiDN(ctx, 0b0100_0110_0000_0000, ctx.ops()[0], ctx.ops()[1])
+}
+
+// MOVS <Rd>, #<imm8>
+// MOVS <Rd>, <Rm>
+func encodeMOVS(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	if ctx.isImm(1) {
+		return encodeRdImm8(ctx, 0b0010_0000_0000_0000, ctx.ops()[0], ctx.ops()[1], 1)
+	}
+	// encoded as LSLS <Rd>, <Rm>, #0
+	return encodeLow2(ctx, 0b0000_0000_0000_0000, ctx.ops()[0], ctx.ops()[1])
+}
+
+// MULS <Rdm>, <Rn>, <Rdm>
+// MULS <Rdm>, <Rn>
+func encodeMULS(ctx *instrCtx) ([]uint16, error) {
+	ops := ctx.ops()
+	if len(ops) == 3 {
+		if !ctx.isReg(0) || !ctx.isReg(2) || ops[0].reg != ops[2].reg {
+			return nil, ctx.errorf("first and last operands must be the same register")
+		}
+	} else if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	return encodeLow2(ctx, 0b0100_0011_0100_0000, ops[0], ops[1])
+}
+
+// RSBS <Rd>, <Rn>, #0
+// NEGS <Rd>, <Rn>
+func encodeRSBS(ctx *instrCtx) ([]uint16, error) {
+	ops := ctx.ops()
+	if len(ops) == 3 {
+		v, err := ctx.asm.eval(ops[2])
+		if err != nil {
+			return nil, err
+		}
+		if v != 0 {
+			return nil, ctx.errorf("immediate must be zero")
+		}
+	} else if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	return encodeLow2(ctx, 0b0100_0010_0100_0000, ops[0], ops[1])
+}
+
+// PUSH/POP <registers>, extra is the register stored in bit 8
+func pushPop(base uint16, extra uint16) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		if err := ctx.want(1); err != nil {
+			return nil, err
+		}
+		op := ctx.ops()[0]
+		if op.kind != opRegList {
+			return nil, ctx.errorf("expected register list, found %v", op)
+		}
+		list := op.list
+		if list&^(bits7_0|1<<extra) != 0 {
+			return nil, ctx.errorf("register list may only hold r0-r7 and %v", reg(extra))
+		}
+		P := (list >> extra) & 1
+		return []uint16{base | P<<8 | list&bits7_0}, nil
+	}
+}
+
+func (this *instrCtx) lowList(op *operand) (uint16, error) {
+	if op.kind != opRegList {
+		return 0, this.errorf("expected register list, found %v", op)
+	}
+	if op.list&^bits7_0 != 0 {
+		return 0, this.errorf("register list may only hold r0-r7")
+	}
+	return op.list, nil
+}
+
+// LDM <Rn>!, <registers>, writeback is implied if Rn is not in the list
+func encodeLDM(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	ops := ctx.ops()
+	if ops[0].kind != opReg || ops[0].reg > 7 {
+		return nil, ctx.errorf("expected low register, found %v", ops[0])
+	}
+	rn := ops[0].reg
+	list, err := ctx.lowList(ops[1])
+	if err != nil {
+		return nil, err
+	}
+	inList := list&(1<<rn) != 0
+	if inList && ops[0].writeback {
+		return nil, ctx.errorf("writeback is not available when %v is in the list", reg(rn))
+	}
+	if !inList && !ops[0].writeback {
+		return nil, ctx.errorf("writeback is mandatory when %v is not in the list, use %v!", reg(rn), reg(rn))
+	}
+	return []uint16{0b1100_1000_0000_0000 | rn<<8 | list}, nil
+}
+
+// STM <Rn>!, <registers>
+func encodeSTM(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	ops := ctx.ops()
+	if ops[0].kind != opReg || ops[0].reg > 7 || !ops[0].writeback {
+		return nil, ctx.errorf("expected low register with writeback, found %v", ops[0])
+	}
+	list, err := ctx.lowList(ops[1])
+	if err != nil {
+		return nil, err
+	}
+	return []uint16{0b1100_0000_0000_0000 | ops[0].reg<<8 | list}, nil
+}
+
+// addrOperands splits [<Rn>, #<imm>] and [<Rn>, <Rm>], an absent
+// offset is returned as a zero immediate
+func (this *instrCtx) addrOperands(op *operand) (*operand, *operand, error) {
+	if op.kind != opAddr || len(op.terms) > 2 {
+		return nil, nil, this.errorf("expected address, found %v", op)
+	}
+	base := op.terms[0]
+	if base.kind != opReg || base.writeback {
+		return nil, nil, this.errorf("expected base register, found %v", base)
+	}
+	if len(op.terms) == 1 {
+		return base, &operand{kind: opExpr, line: op.line}, nil
+	}
+	return base, op.terms[1], nil
+}
+
+// OP <Rt>, [<Rn>, #<imm5>]
+// OP <Rt>, [<Rn>, <Rm>]
+// scale is the access size, zero if there's no immediate form
+func loadStore(immBase, regBase uint16, scale int64) encodeFunc {
+	return func(ctx *instrCtx) ([]uint16, error) {
+		if err := ctx.want(2); err != nil {
+			return nil, err
+		}
+		rt, err := ctx.lowReg(ctx.ops()[0])
+		if err != nil {
+			return nil, err
+		}
+		base, offset, err := ctx.addrOperands(ctx.ops()[1])
+		if err != nil {
+			return nil, err
+		}
+		rn, err := ctx.lowReg(base)
+		if err != nil {
+			return nil, err
+		}
+		if offset.kind == opReg {
+			rm, err := ctx.lowReg(offset)
+			if err != nil {
+				return nil, err
+			}
+			return []uint16{regBase | rm<<6 | rn<<3 | rt}, nil
+		}
+		if scale == 0 {
+			return nil, ctx.errorf("only the register offset form is available")
+		}
+		imm, err := ctx.imm(offset, 5, scale)
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{immBase | imm<<6 | rn<<3 | rt}, nil
+	}
+}
+
+// LDR <Rt>, [<Rn>, #<imm5>]
+// LDR <Rt>, [SP, #<imm8>]
+// LDR <Rt>, [PC, #<imm8>]
+// LDR <Rt>, [<Rn>, <Rm>]
+// LDR <Rt>, <label>
+// LDR <Rt>, =<value>
+func encodeLDR(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	ops := ctx.ops()
+	switch ops[1].kind {
+	case opSugar:
+		rt, err := ctx.lowReg(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		imm, err := ctx.literalOffset(int64(ctx.lit.addr))
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{0b0100_1000_0000_0000 | rt<<8 | imm}, nil
+	case opExpr:
+		rt, err := ctx.lowReg(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		target, err := ctx.asm.eval(ops[1])
+		if err != nil {
+			return nil, err
+		}
+		imm, err := ctx.literalOffset(target)
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{0b0100_1000_0000_0000 | rt<<8 | imm}, nil
+	}
+	return spRelative(ctx, 0b0110_1000_0000_0000, 0b0101_1000_0000_0000, 0b1001_1000_0000_0000, true)
+}
+
+// STR <Rt>, [<Rn>, #<imm5>]
+// STR <Rt>, [SP, #<imm8>]
+// STR <Rt>, [<Rn>, <Rm>]
+func encodeSTR(ctx *instrCtx) ([]uint16, error) {
+	if err := ctx.want(2); err != nil {
+		return nil, err
+	}
+	return spRelative(ctx, 0b0110_0000_0000_0000, 0b0101_0000_0000_0000, 0b1001_0000_0000_0000, false)
+}
+
+func spRelative(ctx *instrCtx, immBase, regBase, spBase uint16, allowPC bool) ([]uint16, error) {
+	base, offset, err := ctx.addrOperands(ctx.ops()[1])
+	if err != nil {
+		return nil, err
+	}
+	switch base.reg {
+	case 13:
+		return encodeRdImm8(ctx, spBase, ctx.ops()[0], offset, 4)
+	case 15:
+		if !allowPC {
+			return nil, ctx.errorf("PC can not be used as base register")
+		}
+		return encodeRdImm8(ctx, 0b0100_1000_0000_0000, ctx.ops()[0], offset, 4)
+	}
+	return loadStore(immBase, regBase, 4)(ctx)
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// ARMv6-M exception model with the system control space of the core:
+// SysTick, the NVIC and the system control block
+
+// exception numbers
+const (
+	excNMI       = 2
+	excHardFault = 3
+	excSVCall    = 11
+	excPendSV    = 14
+	excSysTick   = 15
+	excIRQ0      = 16
+	numIRQs      = 32
+)
+
+// EXC_RETURN values
+const (
+	excReturnHandler = 0xFFFFFFF1
+	excReturnMSP     = 0xFFFFFFF9
+	excReturnPSP     = 0xFFFFFFFD
+)
+
+// cycles taken by the exception entry and return of a Cortex-M0+
+const exceptionCycles = 15
+
+// private peripheral bus, only seen by the core
+const (
+	ppbBase = 0xE0000000
+	ppbEnd  = 0xE0100000
+)
+
+// system registers
+const (
+	systCSR   = 0xE000E010
+	systRVR   = 0xE000E014
+	systCVR   = 0xE000E018
+	systCALIB = 0xE000E01C
+	nvicISER  = 0xE000E100
+	nvicICER  = 0xE000E180
+	nvicISPR  = 0xE000E200
+	nvicICPR  = 0xE000E280
+	nvicIPR0  = 0xE000E400
+	nvicIPR7  = 0xE000E41C
+	scbCPUID  = 0xE000ED00
+	scbICSR   = 0xE000ED04
+	scbVTOR   = 0xE000ED08
+	scbAIRCR  = 0xE000ED0C
+	scbSCR    = 0xE000ED10
+	scbCCR    = 0xE000ED14
+	scbSHPR2  = 0xE000ED1C
+	scbSHPR3  = 0xE000ED20
+)
+
+// Cortex-M0+ r0p1
+const cpuID = 0x410CC601
+
+// systemControl holds the state of the exceptions, priorities are the
+// two implemented bits, from 0 (highest) to 3
+type systemControl struct {
+	vtor uint32
+	// bit n is exception n
+	pending uint64
+	active  uint64
+	// bit n is IRQ n
+	enabled     uint32
+	irqPriority [numIRQs]uint8
+	svcPriority uint8
+	// PendSV and SysTick
+	pendSVPriority  uint8
+	sysTickPriority uint8
+	scr             uint32
+	resetRequested  bool
+
+	// SysTick
+	tickEnable, tickInt, tickClock bool
+	countFlag                      bool
+	reload, current                uint32
+}
+
+func newSystemControl(vtor uint32) *systemControl {
+	return &systemControl{vtor: vtor}
+}
+
+// priority of an exception, the fixed ones are negative
+func (this *systemControl) priority(n uint32) int {
+	switch {
+	case n == excNMI:
+		return -2
+	case n == excHardFault:
+		return -1
+	case n == excSVCall:
+		return int(this.svcPriority)
+	case n == excPendSV:
+		return int(this.pendSVPriority)
+	case n == excSysTick:
+		return int(this.sysTickPriority)
+	}
+	return int(this.irqPriority[n-excIRQ0])
+}
+
+// highest returns the pending exception to take first, the lowest
+// number wins between equal priorities. Disabled IRQs stay pending
+func (this *systemControl) highest() (uint32, bool) {
+	pending := this.pending &^ (uint64(^this.enabled) << excIRQ0)
+	best, found := uint32(0), false
+	for pending != 0 {
+		n := uint32(bits.TrailingZeros64(pending))
+		pending &^= 1 << n
+		if !found || this.priority(n) < this.priority(best) {
+			best, found = n, true
+		}
+	}
+	return best, found
+}
+
+func (this *systemControl) pend(n uint32) {
+	this.pending |= 1 << n
+}
+
+func (this *systemControl) isPending(n uint32) bool {
+	return this.pending&(1<<n) != 0
+}
+
+// tick counts the SysTick down by n cycles, the external reference
+// clock is taken as the processor clock
+func (this *systemControl) tick(n uint64) {
+	for this.tickEnable && n > 0 {
+		if this.current == 0 {
+			// reloading takes a cycle
+			this.current = this.reload
+			n--
+			continue
+		}
+		if uint64(this.current) > n {
+			this.current -= uint32(n)
+			return
+		}
+		n -= uint64(this.current)
+		this.current = 0
+		this.countFlag = true
+		if this.tickInt {
+			this.pend(excSysTick)
+		}
+		if this.reload == 0 {
+			return
+		}
+	}
+}
+
+// untilTick returns the cycles until the SysTick raises its exception
+func (this *systemControl) untilTick() (uint64, bool) {
+	if !this.tickEnable || !this.tickInt || this.reload == 0 {
+		return 0, false
+	}
+	if this.current == 0 {
+		return 1 + uint64(this.reload), true
+	}
+	return uint64(this.current), true
+}
+
+// packPriorities reads 4 byte wide priorities, only bits 7:6 exist
+func packPriorities(p []uint8) uint32 {
+	out := uint32(0)
+	for i, v := range p {
+		out |= uint32(v) << (i*8 + 6)
+	}
+	return out
+}
+
+func unpackPriorities(p []uint8, v uint32) {
+	for i := range p {
+		p[i] = uint8(v>>(i*8+6)) & 0b11
+	}
+}
+
+func (this *systemControl) read(addr uint32, size uint32) (uint32, error) {
+	if size != 4 {
+		return 0, fmt.Errorf("system registers take word accesses")
+	}
+	switch {
+	case addr == systCSR:
+		out := uint32(0)
+		for i, f := range []bool{this.tickEnable, this.tickInt, this.tickClock} {
+			if f {
+				out |= 1 << i
+			}
+		}
+		if this.countFlag {
+			out |= 1 << 16
+		}
+		this.countFlag = false
+		return out, nil
+	case addr == systRVR:
+		return this.reload, nil
+	case addr == systCVR:
+		return this.current, nil
+	case addr == systCALIB:
+		return 0, nil
+	case addr == nvicISER, addr == nvicICER:
+		return this.enabled, nil
+	case addr == nvicISPR, addr == nvicICPR:
+		return uint32(this.pending >> excIRQ0), nil
+	case addr >= nvicIPR0 && addr <= nvicIPR7:
+		i := (addr - nvicIPR0)
+		return packPriorities(this.irqPriority[i : i+4]), nil
+	case addr == scbCPUID:
+		return cpuID, nil
+	case addr == scbICSR:
+		return this.icsr(), nil
+	case addr == scbVTOR:
+		return this.vtor, nil
+	case addr == scbAIRCR:
+		return 0xFA050000, nil
+	case addr == scbSCR:
+		return this.scr, nil
+	case addr == scbCCR:
+		// STKALIGN and UNALIGN_TRP are always set
+		return 0x208, nil
+	case addr == scbSHPR2:
+		return uint32(this.svcPriority) << 30, nil
+	case addr == scbSHPR3:
+		return uint32(this.pendSVPriority)<<22 | uint32(this.sysTickPriority)<<30, nil
+	}
+	return 0, fmt.Errorf("unmodelled system register")
+}
+
+func (this *systemControl) write(addr uint32, size uint32, value uint32) error {
+	if size != 4 {
+		return fmt.Errorf("system registers take word accesses")
+	}
+	switch {
+	case addr == systCSR:
+		this.tickEnable = value&1 != 0
+		this.tickInt = value&2 != 0
+		this.tickClock = value&4 != 0
+	case addr == systRVR:
+		this.reload = value & 0xFFFFFF
+	case addr == systCVR:
+		this.current = 0
+		this.countFlag = false
+	case addr == nvicISER:
+		this.enabled |= value
+	case addr == nvicICER:
+		this.enabled &^= value
+	case addr == nvicISPR:
+		this.pending |= uint64(value) << excIRQ0
+	case addr == nvicICPR:
+		this.pending &^= uint64(value) << excIRQ0
+	case addr >= nvicIPR0 && addr <= nvicIPR7:
+		i := (addr - nvicIPR0)
+		unpackPriorities(this.irqPriority[i:i+4], value)
+	case addr == scbICSR:
+		this.setICSR(value)
+	case addr == scbVTOR:
+		this.vtor = value &^ 0xFF
+	case addr == scbAIRCR:
+		// writes without the key are ignored
+		if value>>16 == 0x05FA && value&(1<<2) != 0 {
+			this.resetRequested = true
+		}
+	case addr == scbSCR:
+		// SLEEPONEXIT, SLEEPDEEP and SEVONPEND, kept without effect
+		this.scr = value & 0b10110
+	case addr == scbSHPR2:
+		this.svcPriority = uint8(value >> 30)
+	case addr == scbSHPR3:
+		this.pendSVPriority = uint8(value>>22) & 0b11
+		this.sysTickPriority = uint8(value >> 30)
+	case addr == systCALIB, addr == scbCPUID, addr == scbCCR:
+		// read only
+	default:
+		return fmt.Errorf("unmodelled system register")
+	}
+	return nil
+}
+
+func (this *systemControl) icsr() uint32 {
+	out := uint32(0)
+	if n, ok := this.highest(); ok {
+		out |= n << 12
+	}
+	if this.pending>>excIRQ0 != 0 {
+		out |= 1 << 22
+	}
+	if this.isPending(excSysTick) {
+		out |= 1 << 26
+	}
+	if this.isPending(excPendSV) {
+		out |= 1 << 28
+	}
+	if this.isPending(excNMI) {
+		out |= 1 << 31
+	}
+	return out
+}
+
+// setICSR pends or clears NMI, PendSV and SysTick, VECTACTIVE is added
+// by the cpu
+func (this *systemControl) setICSR(v uint32) {
+	if v&(1<<31) != 0 {
+		this.pend(excNMI)
+	}
+	if v&(1<<28) != 0 {
+		this.pend(excPendSV)
+	}
+	if v&(1<<27) != 0 {
+		this.pending &^= 1 << excPendSV
+	}
+	if v&(1<<26) != 0 {
+		this.pend(excSysTick)
+	}
+	if v&(1<<25) != 0 {
+		this.pending &^= 1 << excSysTick
+	}
+}
+
+// privateBus puts the system control space of the core in front of
+// the bus
+type privateBus struct {
+	bus
+	cpu *cpu
+}
+
+func (this *privateBus) check(addr, size uint32, write bool) error {
+	if addr < ppbBase || addr >= ppbEnd {
+		return nil
+	}
+	if !this.cpu.privileged() {
+		return &busError{addr: addr, size: size, write: write, msg: "unprivileged access to the system control space"}
+	}
+	return nil
+}
+
+func (this *privateBus) read(addr uint32, size uint32) (uint32, error) {
+	if addr < ppbBase || addr >= ppbEnd {
+		return this.bus.read(addr, size)
+	}
+	if err := this.check(addr, size, false); err != nil {
+		return 0, err
+	}
+	v, err := this.cpu.scs.read(addr, size)
+	if err != nil {
+		return 0, &busError{addr: addr, size: size, msg: err.Error()}
+	}
+	if addr == scbICSR {
+		v |= this.cpu.ipsr
+	}
+	return v, nil
+}
+
+func (this *privateBus) write(addr uint32, size uint32, value uint32) error {
+	if addr < ppbBase || addr >= ppbEnd {
+		return this.bus.write(addr, size, value)
+	}
+	if err := this.check(addr, size, true); err != nil {
+		return err
+	}
+	if err := this.cpu.scs.write(addr, size, value); err != nil {
+		return &busError{addr: addr, size: size, write: true, msg: err.Error()}
+	}
+	return nil
+}
+
+// privileged tells if the core may use the system registers, thread
+// mode is unprivileged when CONTROL.nPRIV is set
+func (this *cpu) privileged() bool {
+	return this.ipsr != 0 || this.control&1 == 0
+}
+
+// activePriority is the highest priority of the active exceptions, or
+// 4 in thread mode, below any configurable priority
+func (this *cpu) activePriority() int {
+	out := 4
+	for active := this.scs.active; active != 0; active &= active - 1 {
+		out = min(out, this.scs.priority(uint32(bits.TrailingZeros64(active))))
+	}
+	return out
+}
+
+// executionPriority is the priority of the running code, PRIMASK
+// raises it to 0
+func (this *cpu) executionPriority() int {
+	if this.primask {
+		return min(this.activePriority(), 0)
+	}
+	return this.activePriority()
+}
+
+// nextException returns the pending exception that preempts the
+// running code
+func (this *cpu) nextException() (uint32, bool) {
+	n, ok := this.scs.highest()
+	if !ok || this.scs.priority(n) >= this.executionPriority() {
+		return 0, false
+	}
+	return n, true
+}
+
+func exceptionName(n uint32) string {
+	if int(n) < len(vectorNames) && vectorNames[n] != "" {
+		return vectorNames[n]
+	}
+	return fmt.Sprintf("exception %v", n)
+}
+
+// enter takes an exception: pushes r0-r3, r12, lr, the return address
+// and xPSR on the current stack, aligned to 8 bytes, and runs the
+// handler of the vector table on the main stack
+func (this *cpu) enter(n uint32, returnAddr uint32) *halt {
+	handler, err := this.bus.read(this.scs.vtor+4*n, 4)
+	if err != nil {
+		return &halt{kind: haltFault, pc: this.r[15], msg: fmt.Sprintf("reading the %v vector: %v", exceptionName(n), err)}
+	}
+	if handler&1 == 0 {
+		return &halt{kind: haltFault, pc: this.r[15], msg: fmt.Sprintf("%v vector 0x%08X without the Thumb bit", exceptionName(n), handler)}
+	}
+	xpsr := this.xpsr()
+	sp := this.r[13] - 0x20
+	if sp&4 != 0 {
+		sp -= 4
+		xpsr |= 1 << 9
+	}
+	frame := []uint32{this.r[0], this.r[1], this.r[2], this.r[3], this.r[12], this.r[14], returnAddr, xpsr}
+	for i, v := range frame {
+		if err := this.bus.write(sp+uint32(i)*4, 4, v); err != nil {
+			return &halt{kind: haltFault, pc: this.r[15], msg: fmt.Sprintf("stacking for %v: %v", exceptionName(n), err)}
+		}
+	}
+	this.setSP(sp)
+	switch {
+	case this.ipsr != 0:
+		this.r[14] = excReturnHandler
+	case this.spsel():
+		this.r[14] = excReturnPSP
+		this.control &^= 0b10
+		this.r[13], this.otherSP = this.otherSP, this.r[13]
+	default:
+		this.r[14] = excReturnMSP
+	}
+	this.ipsr = n
+	this.scs.pending &^= 1 << n
+	this.scs.active |= 1 << n
+	this.r[15] = handler &^ 1
+	this.entered = n
+	this.addCycles(exceptionCycles)
+	return nil
+}
+
+// exceptionReturn leaves the running handler for the mode and stack
+// given by the EXC_RETURN value, and unstacks the frame
+func (this *cpu) exceptionReturn(v uint32) *halt {
+	if v != excReturnHandler && v != excReturnMSP && v != excReturnPSP {
+		return this.faultf("invalid EXC_RETURN 0x%08X", v)
+	}
+	others := this.scs.active &^ (1 << this.ipsr)
+	if (v == excReturnHandler) != (others != 0) {
+		return this.faultf("EXC_RETURN 0x%08X does not match the active exceptions", v)
+	}
+	this.scs.active = others
+	if v == excReturnPSP {
+		this.control |= 0b10
+		this.r[13], this.otherSP = this.otherSP, this.r[13]
+	}
+	sp := this.r[13]
+	frame := make([]uint32, 8)
+	for i := range frame {
+		w, err := this.bus.read(sp+uint32(i)*4, 4)
+		if err != nil {
+			return &halt{kind: haltFault, pc: this.r[15], msg: "unstacking: " + err.Error()}
+		}
+		frame[i] = w
+	}
+	this.r[0], this.r[1], this.r[2], this.r[3] = frame[0], frame[1], frame[2], frame[3]
+	this.r[12], this.r[14] = frame[4], frame[5]
+	this.r[15] = frame[6] &^ 1
+	xpsr := frame[7]
+	sp += 0x20
+	if xpsr&(1<<9) != 0 {
+		sp += 4
+	}
+	this.setSP(sp)
+	this.setAPSR(xpsr)
+	this.ipsr = xpsr & 0x3F
+	this.addCycles(exceptionCycles)
+	return nil
+}
+
+// hardFault takes a HardFault for a fault of the running code, or
+// halts when the host catches them or the core locks up
+func (this *cpu) hardFault(h *halt) *halt {
+	if this.catchHardFault {
+		return h
+	}
+	if this.executionPriority() < 0 {
+		return &halt{kind: haltFault, pc: h.pc, msg: "lockup: " + h.msg}
+	}
+	if h2 := this.enter(excHardFault, this.r[15]); h2 != nil {
+		h2.msg = h.msg + ", " + h2.msg
+		return h2
+	}
+	return nil
+}
+
+// escalate pends a HardFault for an exception that can't be taken,
+// the instruction that raised it completes
+func (this *cpu) escalate(h *halt) *halt {
+	if this.catchHardFault {
+		return h
+	}
+	if this.executionPriority() < 0 {
+		return &halt{kind: haltFault, pc: h.pc, msg: "lockup: " + h.msg}
+	}
+	this.scs.pend(excHardFault)
+	return nil
+}
+
+// svc raises SVCall, which must preempt the running code
+func (this *cpu) svc(in *instr) *halt {
+	if this.scs.priority(excSVCall) < this.executionPriority() {
+		this.scs.pend(excSVCall)
+		return nil
+	}
+	return this.escalate(&halt{kind: haltFault, pc: in.addr, msg: fmt.Sprintf("SVC #%v escalated to HardFault", in.args[0].value)})
+}
+
+// sleep waits in WFI or WFE for an exception, skipping the cycles until
+// the SysTick fires when nothing is pending
+func (this *cpu) sleep(in *instr) *halt {
+	if this.waking() {
+		return nil
+	}
+	if n, ok := this.scs.untilTick(); ok {
+		this.addCycles(n)
+		if this.waking() {
+			return nil
+		}
+	}
+	return &halt{kind: haltWait, pc: in.addr, msg: fmt.Sprintf("%v with no interrupt to wait for", in.op)}
+}
+
+// waking tells if a pending exception wakes the core, PRIMASK masks the
+// exception but not the wake up
+func (this *cpu) waking() bool {
+	n, ok := this.scs.highest()
+	return ok && this.scs.priority(n) < this.activePriority()
+}
+
+func (this *cpu) addCycles(n uint64) {
+	this.cycles += n
+	this.scs.tick(n)
+}
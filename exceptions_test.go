@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// runVectors runs a program with a vector table pointing at the
+// handlers labelled in vectors
+func runVectors(t *testing.T, catch bool, vectors map[uint32]string, src string) (*cpu, *halt) {
+	t.Helper()
+	table := "section text at 0x20000000:\n\t$0x20001000 w\n\t$_start+1 w\n"
+	for n := uint32(2); n < excIRQ0+2; n++ {
+		if label, ok := vectors[n]; ok {
+			table += fmt.Sprintf("\t$%v+1 w\n", label)
+		} else {
+			table += "\t$0 w\n"
+		}
+	}
+	c := newCPU(newSparseMemory(assembleModule(t, table+"_start:\n"+src)))
+	c.catchHardFault = catch
+	if err := c.reset(0x20000000); err != nil {
+		t.Fatal(err)
+	}
+	return c, c.run(100000)
+}
+
+func expectRegs(t *testing.T, c *cpu, h *halt, regs map[uint16]uint32) {
+	t.Helper()
+	if h.kind != haltBreakpoint {
+		t.Fatalf("halted with %v", h)
+	}
+	for r, v := range regs {
+		if c.r[r] != v {
+			t.Errorf("%v is 0x%08X, expected 0x%08X", reg(r), c.r[r], v)
+		}
+	}
+}
+
+func TestSysTick(t *testing.T) {
+	c, h := runVectors(t, true, map[uint32]string{excSysTick: "tick"}, `
+	movs r4, #0
+	ldr r0, =0xE000E010
+	movs r1, #100
+	str r1, [r0, #4]
+	movs r1, #3
+	str r1, [r0]
+loop:
+	cmp r4, #3
+	bne loop
+	bkpt #0
+tick:
+	adds r4, #1
+	mov r5, lr
+	mrs r6, ipsr
+	bx lr
+`)
+	expectRegs(t, c, h, map[uint16]uint32{4: 3, 5: excReturnMSP, 6: excSysTick, 13: 0x20001000})
+	if c.ipsr != 0 || c.scs.active != 0 {
+		t.Errorf("ipsr is %v with active exceptions 0x%X after the return", c.ipsr, c.scs.active)
+	}
+}
+
+// the handler sees and changes the stacked frame
+func TestSVCall(t *testing.T) {
+	c, h := runVectors(t, true, map[uint32]string{excSVCall: "svcall"}, `
+	movs r0, #5
+	svc #1
+	bkpt #0
+svcall:
+	ldr r4, [sp, #24]
+	ldr r5, [sp, #28]
+	ldr r1, [sp]
+	adds r1, #37
+	str r1, [sp]
+	bx lr
+`)
+	expectRegs(t, c, h, map[uint16]uint32{0: 42, 4: h.pc, 5: 1 << 24})
+}
+
+func TestHardFault(t *testing.T) {
+	c, h := runVectors(t, false, map[uint32]string{excHardFault: "hardfault"}, `
+	udf #0
+hardfault:
+	mrs r4, ipsr
+	bkpt #0
+`)
+	expectRegs(t, c, h, map[uint16]uint32{4: excHardFault, 14: excReturnMSP})
+
+	// SVC from a handler of the same priority escalates
+	c, h = runVectors(t, false, map[uint32]string{excSVCall: "svcall", excHardFault: "hardfault"}, `
+	svc #0
+svcall:
+	svc #1
+	bkpt #1
+hardfault:
+	mrs r4, ipsr
+	bkpt #0
+`)
+	expectRegs(t, c, h, map[uint16]uint32{4: excHardFault, 14: excReturnHandler})
+
+	tests := []struct {
+		catch bool
+		src   string
+		msg   string
+	}{
+		{false, "\tudf #0\nsvcall:\nhardfault:\n\tudf #1\n", "lockup: UDF #1"},
+		{true, "\tsvc #0\nsvcall:\n\tldr r0, =0xFFFFFFF5\n\tbx r0\nhardfault:\n", "invalid EXC_RETURN 0xFFFFFFF5"},
+		{true, "\tsvc #0\nsvcall:\nhardfault:\n\tsvc #0\n", "SVC #0 escalated to HardFault"},
+	}
+	for _, test := range tests {
+		_, h := runVectors(t, test.catch, map[uint32]string{excSVCall: "svcall", excHardFault: "hardfault"}, test.src)
+		if h.kind != haltFault || !strings.Contains(h.msg, test.msg) {
+			t.Errorf("%q halted with %v, expected %q", test.src, h, test.msg)
+		}
+	}
+	_, h = runVectors(t, false, nil, "\tudf #0\n")
+	if h.kind != haltFault || !strings.Contains(h.msg, "HardFault vector") {
+		t.Errorf("halted with %v without a HardFault handler", h)
+	}
+}
+
+func TestNVIC(t *testing.T) {
+	c, h := runVectors(t, true, map[uint32]string{excIRQ0: "irq0"}, `
+	movs r4, #0
+	cpsid i
+	ldr r0, =0xE000E100
+	movs r1, #1
+	str r1, [r0]
+	ldr r0, =0xE000E200
+	movs r1, #3
+	str r1, [r0]
+	mov r5, r4
+	cpsie i
+	mov r6, r4
+	ldr r7, [r0]
+	bkpt #0
+irq0:
+	adds r4, #1
+	bx lr
+`)
+	// IRQ 1 is pending but not enabled
+	expectRegs(t, c, h, map[uint16]uint32{4: 1, 5: 0, 6: 1, 7: 2})
+}
+
+// a higher priority IRQ preempts a running handler
+func TestPreemption(t *testing.T) {
+	c, h := runVectors(t, true, map[uint32]string{excIRQ0: "irq0", excIRQ0 + 1: "irq1"}, `
+	ldr r0, =0xE000E400
+	ldr r1, =0x40C0
+	str r1, [r0]
+	ldr r0, =0xE000E100
+	movs r1, #3
+	str r1, [r0]
+	ldr r0, =0xE000E200
+	movs r1, #1
+	str r1, [r0]
+	bkpt #0
+irq0:
+	movs r1, #2
+	str r1, [r0]
+	mov r4, r5
+	bx lr
+irq1:
+	movs r5, #7
+	mov r6, lr
+	bx lr
+`)
+	expectRegs(t, c, h, map[uint16]uint32{4: 7, 6: excReturnHandler})
+}
+
+func TestProcessStack(t *testing.T) {
+	c, h := runVectors(t, true, map[uint32]string{excSVCall: "svcall"}, `
+	ldr r0, =0x20000800
+	msr psp, r0
+	movs r0, #2
+	msr control, r0
+	isb
+	svc #0
+	mov r6, sp
+	mrs r7, control
+	bkpt #0
+svcall:
+	mov r4, lr
+	mrs r5, psp
+	mov r3, sp
+	bx lr
+`)
+	expectRegs(t, c, h, map[uint16]uint32{4: excReturnPSP, 5: 0x200007E0, 6: 0x20000800, 7: 2})
+}
+
+func TestWFI(t *testing.T) {
+	c, h := runVectors(t, true, map[uint32]string{excSysTick: "tick"}, `
+	movs r4, #0
+	ldr r0, =0xE000E010
+	ldr r1, =1000
+	str r1, [r0, #4]
+	movs r1, #3
+	str r1, [r0]
+	wfi
+	bkpt #0
+tick:
+	adds r4, #1
+	movs r1, #0
+	str r1, [r0]
+	bx lr
+`)
+	expectRegs(t, c, h, map[uint16]uint32{4: 1})
+	if c.cycles < 1000 {
+		t.Errorf("slept for %v cycles", c.cycles)
+	}
+}
+
+func TestSystemRegisters(t *testing.T) {
+	c, h := runVectors(t, true, nil, `
+	cpsid i
+	ldr r0, =0xE000ED00
+	ldr r4, [r0]
+	ldr r1, =0x10000000
+	str r1, [r0, #4]
+	ldr r5, [r0, #4]
+	ldr r6, [r0, #8]
+	bkpt #0
+`)
+	expectRegs(t, c, h, map[uint16]uint32{4: cpuID, 5: 1<<28 | excPendSV<<12, 6: 0x20000000})
+
+	tests := []struct {
+		src  string
+		kind haltKind
+		msg  string
+	}{
+		{"\tldr r0, =0x05FA0004\n\tldr r1, =0xE000ED0C\n\tstr r0, [r1]\n", haltReset, "system reset requested"},
+		{"\tldr r1, =0xE000ED00\n\tldrb r0, [r1]\n", haltFault, "word accesses"},
+		{"\tldr r1, =0xE000EF00\n\tldr r0, [r1]\n", haltFault, "unmodelled system register"},
+		{"\tmovs r0, #1\n\tmsr control, r0\n\tldr r1, =0xE000ED00\n\tldr r0, [r1]\n", haltFault, "unprivileged"},
+	}
+	for _, test := range tests {
+		_, h := runVectors(t, true, nil, test.src)
+		if h.kind != test.kind || !strings.Contains(h.msg, test.msg) {
+			t.Errorf("%q halted with %v, expected %q", test.src, h, test.msg)
+		}
+	}
+}
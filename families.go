@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UF2 family IDs, from the registry in the UF2 specification
+var familyNames = map[uint32]string{
+	0xE48BFF56: "RP2040",
+	0xE48BFF57: "RP2XXX_ABSOLUTE",
+	0xE48BFF58: "RP2XXX_DATA",
+	0xE48BFF59: "RP2350_ARM_S",
+	0xE48BFF5A: "RP2350_RISCV",
+	0xE48BFF5B: "RP2350_ARM_NS",
+	0x68ED2B88: "SAMD21",
+	0x55114460: "SAMD51",
+	0x1851780A: "SAML21",
+	0x1B57745F: "NRF52",
+	0x621E937A: "NRF52833",
+	0xADA52840: "NRF52840",
+	0x647824B6: "STM32F0",
+	0x5EE21072: "STM32F1",
+	0x5D1A0A2E: "STM32F2",
+	0x6B846188: "STM32F3",
+	0x57755A57: "STM32F4",
+	0x6D0922FA: "STM32F407",
+	0x8FB060FE: "STM32F407VG",
+	0x53B80F00: "STM32F7",
+	0x300F5633: "STM32G0",
+	0x4C71240A: "STM32G4",
+	0x6DB66082: "STM32H7",
+	0x202E3A91: "STM32L0",
+	0x1E1F432D: "STM32L1",
+	0x00FF6919: "STM32L4",
+	0x04240BDF: "STM32L5",
+	0x70D16653: "STM32WB",
+	0x21460FF0: "STM32WL",
+	0x1C5F21B0: "ESP32",
+	0xBFDD4EEE: "ESP32S2",
+	0xC47E5767: "ESP32S3",
+	0xD42BA06C: "ESP32C3",
+	0x2B88D29C: "ESP32C2",
+	0x540DDF62: "ESP32C6",
+	0x332726F6: "ESP32H2",
+	0x7EAB61ED: "ESP8266",
+	0x4FB2D5BD: "MIMXRT10XX",
+	0x2ABC77EC: "LPC55",
+	0x16573617: "ATMEGA32",
+}
+
+func familyName(id uint32) string {
+	if name, ok := familyNames[id]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// parseFamily accepts a family name, like rp2040, or a number
+func parseFamily(s string) (uint32, error) {
+	for id, name := range familyNames {
+		if strings.EqualFold(name, s) {
+			return id, nil
+		}
+	}
+	return parseNum(s)
+}
+
+type familyGroup struct {
+	// present is false for blocks without a family ID
+	present bool
+	id      uint32
+	blocks  []*uf2block
+}
+
+func (this *familyGroup) String() string {
+	if !this.present {
+		return "no family ID"
+	}
+	return fmt.Sprintf("family %v (0x%08X)", familyName(this.id), this.id)
+}
+
+// groupByFamily splits the blocks by family ID, so that blocks meant for
+// different chips are never joined in the same region. Blocks without
+// a family ID come first, then families in order of appearance. File
+// container blocks are left out since they are not memory
+func groupByFamily(blocks []*uf2block) []*familyGroup {
+	out := []*familyGroup{}
+	find := func(b *uf2block) *familyGroup {
+		for _, g := range out {
+			if g.present == b.flags.FamilyIDPresent && (!g.present || g.id == b.something) {
+				return g
+			}
+		}
+		g := &familyGroup{present: b.flags.FamilyIDPresent}
+		if g.present {
+			g.id = b.something
+		}
+		out = append(out, g)
+		return g
+	}
+	for _, b := range blocks {
+		if b.flags.FileContainer {
+			continue
+		}
+		g := find(b)
+		g.blocks = append(g.blocks, b)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return !out[i].present && out[j].present
+	})
+	return out
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+)
+
+// codeMap holds the instructions reached by following the control
+// flow from a set of entry points, and the literal words they load
+type codeMap struct {
+	maps []*memoryMap
+	code map[uint32]*instr
+	data map[uint32]bool
+}
+
+// traverse decodes everything reachable from the entry points,
+// following branches and calls. The Thumb bit of entries is ignored.
+// The flow stops at literal pools, which are only known once the
+// loads are decoded, so the walk is repeated until no new literal
+// turns up
+func traverse(maps []*memoryMap, entries []uint32) *codeMap {
+	this := &codeMap{maps: maps, data: map[uint32]bool{}}
+	for {
+		known := len(this.data)
+		this.code = map[uint32]*instr{}
+		this.walk(entries)
+		if len(this.data) == known {
+			return this
+		}
+	}
+}
+
+func (this *codeMap) walk(entries []uint32) {
+	work := []uint32{}
+	for _, e := range entries {
+		work = append(work, e&^1)
+	}
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		for {
+			if _, ok := this.code[addr]; ok || this.isData(addr) {
+				break
+			}
+			in := this.decodeAt(addr)
+			if in == nil || in.op == mnInvalid || this.isData(addr+in.size-2) {
+				break
+			}
+			this.code[addr] = in
+			for _, a := range in.args {
+				if a.kind != argTarget {
+					continue
+				}
+				if !a.aligned {
+					work = append(work, in.target(a))
+				} else if in.op == mnLDR {
+					this.data[in.target(a)] = true
+				}
+			}
+			if endsFlow(in) {
+				break
+			}
+			addr += in.size
+		}
+	}
+}
+
+// isData tells if the halfword at addr is part of a literal word
+func (this *codeMap) isData(addr uint32) bool {
+	return this.data[addr&^3]
+}
+
+func (this *codeMap) decodeAt(addr uint32) *instr {
+	for _, m := range this.maps {
+		if m.contains(addr) {
+			in := &instr{addr: addr}
+			rb := newReadBuffer(m.contents[addr-m.addr:])
+			if !decodeInstr(rb, in) {
+				return nil
+			}
+			return in
+		}
+	}
+	return nil
+}
+
+// endsFlow tells if execution never falls through to the next instruction
+func endsFlow(in *instr) bool {
+	switch in.op {
+	case mnB:
+		// only B<c> has a condition
+		return len(in.args) == 1
+	case mnBX, mnUDF, mnUDFW:
+		return true
+	case mnPOP:
+		return in.args[0].list&(1<<15) != 0
+	case mnMOV, mnADD:
+		return in.args[0].kind == argReg && in.args[0].reg == 15
+	}
+	return false
+}
+
+// listing splits the region into the reached instructions and data,
+// data is grouped in aligned words where possible
+func (this *codeMap) listing(m *memoryMap) []*instr {
+	out := []*instr{}
+	addr := m.addr
+	end := m.addr + uint32(len(m.contents))
+	for addr < end {
+		if in, ok := this.code[addr]; ok && addr+in.size <= end {
+			out = append(out, in)
+			addr += in.size
+			continue
+		}
+		size := uint32(1)
+		switch {
+		case this.data[addr] && addr+4 <= end:
+			size = 4
+		case addr%4 == 0 && addr+4 <= end && !this.isCode(addr+2):
+			size = 4
+		case addr%2 == 0 && addr+2 <= end:
+			size = 2
+		}
+		out = append(out, dataInstr(m, addr, size))
+		addr += size
+	}
+	return out
+}
+
+func (this *codeMap) isCode(addr uint32) bool {
+	_, ok := this.code[addr]
+	return ok
+}
+
+// dataInstr wraps size bytes of the region in a .word, .hword or .byte
+func dataInstr(m *memoryMap, addr, size uint32) *instr {
+	bytes := m.contents[addr-m.addr : addr-m.addr+size]
+	out := &instr{addr: addr, size: size}
+	for i := len(bytes) - 1; i >= 0; i-- {
+		out.word = out.word<<8 | uint32(bytes[i])
+		out.chunk = append(out.chunk, bytes[i])
+	}
+	switch size {
+	case 4:
+		out.op = mnWord
+	case 2:
+		out.op = mnHword
+	default:
+		out.op = mnByte
+	}
+	return out
+}
+
+func isData(op mnemonic) bool {
+	return op == mnWord || op == mnHword || op == mnByte
+}
+
+func formatData(in *instr) string {
+	return fmt.Sprintf("%v 0x%0*X", in.op, in.size*2, in.word)
+}
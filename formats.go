@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// image formats understood by convert
+const (
+	formatUF2  = "uf2"
+	formatBin  = "bin"
+	formatHex  = "hex"
+	formatSrec = "srec"
+	formatELF  = "elf"
+)
+
+// formatFromExt guesses the format from the file extension,
+// returns an empty string if unknown
+func formatFromExt(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".uf2":
+		return formatUF2
+	case ".bin":
+		return formatBin
+	case ".hex", ".ihex", ".ihx":
+		return formatHex
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return formatSrec
+	case ".elf", ".axf", ".o":
+		return formatELF
+	}
+	return ""
+}
+
+// detectFormat looks at the contents first, since extensions lie
+func detectFormat(filename string, data []byte) string {
+	switch {
+	case len(data) >= 8 && bytes.Equal(data[:8], appendU32(appendU32(nil, uf2Magic1), uf2Magic2)):
+		return formatUF2
+	case bytes.HasPrefix(data, []byte("\x7fELF")):
+		return formatELF
+	case len(data) > 0 && data[0] == ':' && isText(data):
+		return formatHex
+	case len(data) > 1 && data[0] == 'S' && data[1] >= '0' && data[1] <= '9' && isText(data):
+		return formatSrec
+	}
+	if f := formatFromExt(filename); f != "" {
+		return f
+	}
+	return formatBin
+}
+
+func isText(data []byte) bool {
+	for _, b := range data {
+		if b != '\r' && b != '\n' && b != '\t' && (b < 0x20 || b > 0x7E) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeMaps sorts the regions and joins the adjacent ones
+func mergeMaps(maps []*memoryMap) ([]*memoryMap, error) {
+	sorted := append([]*memoryMap{}, maps...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].addr < sorted[j].addr
+	})
+	out := []*memoryMap{}
+	for _, m := range sorted {
+		if len(m.contents) == 0 {
+			continue
+		}
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			end := last.addr + uint32(len(last.contents))
+			if end > m.addr {
+				return nil, fmt.Errorf("data at 0x%08X overlaps data at 0x%08X", m.addr, last.addr)
+			}
+			if end == m.addr {
+				last.contents = append(last.contents, m.contents...)
+				continue
+			}
+		}
+		out = append(out, &memoryMap{addr: m.addr, contents: append([]byte{}, m.contents...)})
+	}
+	return out, nil
+}
+
+// flatten lays out the regions from the lowest address, with gaps
+// filled with zeroes, like objcopy -O binary does
+func flatten(maps []*memoryMap) []byte {
+	if len(maps) == 0 {
+		return []byte{}
+	}
+	base := maps[0].addr
+	out := []byte{}
+	for _, m := range maps {
+		offset := int(m.addr - base)
+		for len(out) < offset {
+			out = append(out, 0)
+		}
+		out = append(out[:offset], m.contents...)
+	}
+	return out
+}
+
+// readHex reads Intel HEX data records, with both segment and
+// linear extended addresses
+func readHex(data []byte) ([]*memoryMap, error) {
+	maps := []*memoryMap{}
+	base := uint32(0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rec, err := hexRecord(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", i+1, err)
+		}
+		length := int(rec[0])
+		addr := uint32(rec[1])<<8 | uint32(rec[2])
+		kind := rec[3]
+		payload := rec[4 : 4+length]
+		switch kind {
+		case 0x00:
+			maps = append(maps, &memoryMap{addr: base + addr, contents: payload})
+		case 0x01:
+			return mergeMaps(maps)
+		case 0x02:
+			if length != 2 {
+				return nil, fmt.Errorf("line %v: bad segment address record", i+1)
+			}
+			base = (uint32(payload[0])<<8 | uint32(payload[1])) << 4
+		case 0x04:
+			if length != 2 {
+				return nil, fmt.Errorf("line %v: bad linear address record", i+1)
+			}
+			base = (uint32(payload[0])<<8 | uint32(payload[1])) << 16
+		case 0x03, 0x05:
+			// start addresses, not part of the image
+		default:
+			return nil, fmt.Errorf("line %v: unknown record type %02X", i+1, kind)
+		}
+	}
+	return nil, fmt.Errorf("missing end of file record")
+}
+
+// hexRecord decodes and checks a ':' line, the result starts
+// with the length, address and type bytes
+func hexRecord(line string) ([]byte, error) {
+	if line[0] != ':' {
+		return nil, fmt.Errorf("record does not start with ':'")
+	}
+	rec, err := hexBytes(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(rec) < 5 || len(rec) != 5+int(rec[0]) {
+		return nil, fmt.Errorf("bad record length")
+	}
+	sum := byte(0)
+	for _, b := range rec {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("bad checksum")
+	}
+	return rec, nil
+}
+
+func hexBytes(s string) ([]byte, error) {
+	if len(s)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits")
+	}
+	out := make([]byte, len(s)/2)
+	for i := range out {
+		b, err := strconv.ParseUint(s[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex digits '%v'", s[i*2:i*2+2])
+		}
+		out[i] = byte(b)
+	}
+	return out, nil
+}
+
+// writeHex writes 16 byte data records, with a linear address record
+// whenever the upper half of the address changes
+func writeHex(maps []*memoryMap, entry uint32) []byte {
+	out := ""
+	record := func(kind byte, addr uint16, data []byte) {
+		rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), kind}, data...)
+		sum := byte(0)
+		for _, b := range rec {
+			sum += b
+		}
+		out += fmt.Sprintf(":%X%02X\n", rec, -sum)
+	}
+	upper := -1
+	for _, m := range maps {
+		for i := 0; i < len(m.contents); {
+			addr := m.addr + uint32(i)
+			if int(addr>>16) != upper {
+				upper = int(addr >> 16)
+				record(0x04, 0, []byte{byte(upper >> 8), byte(upper)})
+			}
+			// records do not cross a 64K boundary
+			n := 16
+			if left := 0x10000 - int(addr&0xFFFF); n > left {
+				n = left
+			}
+			if left := len(m.contents) - i; n > left {
+				n = left
+			}
+			record(0x00, uint16(addr), m.contents[i:i+n])
+			i += n
+		}
+	}
+	if entry != 0 {
+		record(0x05, 0, []byte{byte(entry >> 24), byte(entry >> 16), byte(entry >> 8), byte(entry)})
+	}
+	record(0x01, 0, nil)
+	return []byte(out)
+}
+
+// readSrec reads the S1, S2 and S3 data records
+func readSrec(data []byte) ([]*memoryMap, error) {
+	maps := []*memoryMap{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) < 4 || line[0] != 'S' {
+			return nil, fmt.Errorf("line %v: record does not start with 'S'", i+1)
+		}
+		rec, err := hexBytes(line[2:])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", i+1, err)
+		}
+		if len(rec) < 1 || len(rec) != 1+int(rec[0]) {
+			return nil, fmt.Errorf("line %v: bad record length", i+1)
+		}
+		sum := byte(0)
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0xFF {
+			return nil, fmt.Errorf("line %v: bad checksum", i+1)
+		}
+		addrSize := 0
+		switch line[1] {
+		case '1':
+			addrSize = 2
+		case '2':
+			addrSize = 3
+		case '3':
+			addrSize = 4
+		case '0', '5', '6', '7', '8', '9':
+			// header, count and start address records
+			continue
+		default:
+			return nil, fmt.Errorf("line %v: unknown record type S%c", i+1, line[1])
+		}
+		if len(rec) < 2+addrSize {
+			return nil, fmt.Errorf("line %v: bad record length", i+1)
+		}
+		addr := uint32(0)
+		for _, b := range rec[1 : 1+addrSize] {
+			addr = addr<<8 | uint32(b)
+		}
+		maps = append(maps, &memoryMap{addr: addr, contents: rec[1+addrSize : len(rec)-1]}) // minus the checksum
+	}
+	return mergeMaps(maps)
+}
+
+// writeSrec writes S3 records, with 32 bit addresses, ending with an
+// S7 record holding the entry point
+func writeSrec(maps []*memoryMap, entry uint32) []byte {
+	out := ""
+	record := func(kind byte, addr uint32, data []byte) {
+		rec := appendU32BE([]byte{byte(4 + len(data) + 1)}, addr)
+		rec = append(rec, data...)
+		sum := byte(0)
+		for _, b := range rec {
+			sum += b
+		}
+		out += fmt.Sprintf("S%c%X%02X\n", kind, rec, ^sum)
+	}
+	out += fmt.Sprintf("S0%X\n", srecHeader("ras"))
+	for _, m := range maps {
+		for i := 0; i < len(m.contents); i += 16 {
+			end := i + 16
+			if end > len(m.contents) {
+				end = len(m.contents)
+			}
+			record('3', m.addr+uint32(i), m.contents[i:end])
+		}
+	}
+	record('7', entry, nil)
+	return []byte(out)
+}
+
+// srecHeader builds the S0 record contents, with a 16 bit zero address
+func srecHeader(text string) []byte {
+	rec := append([]byte{byte(2 + len(text) + 1), 0, 0}, text...)
+	sum := byte(0)
+	for _, b := range rec {
+		sum += b
+	}
+	return append(rec, ^sum)
+}
+
+func appendU32BE(buff []byte, w uint32) []byte {
+	return append(buff, byte(w>>24), byte(w>>16), byte(w>>8), byte(w))
+}
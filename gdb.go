@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// GDB remote serial protocol, enough for arm-none-eabi-gdb to load
+// symbols from its own ELF and debug the emulated core
+
+// gdbRegs are the registers in the order of their gdb numbers, the
+// first 17 make the org.gnu.gdb.arm.m-profile feature
+var gdbRegs = []struct {
+	name string
+	kind string
+}{
+	{"r0", ""}, {"r1", ""}, {"r2", ""}, {"r3", ""},
+	{"r4", ""}, {"r5", ""}, {"r6", ""}, {"r7", ""},
+	{"r8", ""}, {"r9", ""}, {"r10", ""}, {"r11", ""},
+	{"r12", ""}, {"sp", "data_ptr"}, {"lr", ""}, {"pc", "code_ptr"},
+	{"xpsr", ""},
+	{"msp", "data_ptr"}, {"psp", "data_ptr"}, {"primask", ""}, {"control", ""},
+}
+
+const gdbProfileRegs = 17
+
+// special register numbers of MRS and MSR for the system registers
+var gdbSystemRegs = []uint16{0b0000_1000, 0b0000_1001, 0b0001_0000, 0b0001_0100}
+
+// the Cortex-M0+ breakpoint unit has 4 comparators
+const gdbHWBreakpoints = 4
+
+const gdbPacketSize = 0x4000
+
+// stop signals
+const (
+	sigINT  = 2
+	sigILL  = 4
+	sigTRAP = 5
+	sigSEGV = 11
+)
+
+func targetXML() string {
+	out := "<?xml version=\"1.0\"?>\n<!DOCTYPE target SYSTEM \"gdb-target.dtd\">\n<target version=\"1.0\">\n"
+	out += "<architecture>arm</architecture>\n"
+	out += "<feature name=\"org.gnu.gdb.arm.m-profile\">\n"
+	for i, r := range gdbRegs {
+		if i == gdbProfileRegs {
+			out += "</feature>\n<feature name=\"org.gnu.gdb.arm.m-system\">\n"
+		}
+		kind := ""
+		if r.kind != "" {
+			kind = fmt.Sprintf(" type=\"%v\"", r.kind)
+		}
+		out += fmt.Sprintf("<reg name=\"%v\" bitsize=\"32\" regnum=\"%v\"%v/>\n", r.name, i, kind)
+	}
+	return out + "</feature>\n</target>\n"
+}
+
+type gdbServer struct {
+	cpu   *cpu
+	rw    io.ReadWriter
+	input chan byte
+	noAck bool
+	// software and hardware breakpoints, both are checked by the server
+	// so no BKPT is ever written to memory
+	swBreaks map[uint32]bool
+	hwBreaks map[uint32]bool
+	detached bool
+}
+
+func newGDBServer(c *cpu, rw io.ReadWriter) *gdbServer {
+	return &gdbServer{
+		cpu:      c,
+		rw:       rw,
+		swBreaks: map[uint32]bool{},
+		hwBreaks: map[uint32]bool{},
+	}
+}
+
+// serve answers the packets of gdb until it detaches, kills the target
+// or closes the connection
+func (this *gdbServer) serve() error {
+	this.input = make(chan byte, 4096)
+	go func() {
+		buff := make([]byte, 4096)
+		for {
+			n, err := this.rw.Read(buff)
+			for _, b := range buff[:n] {
+				this.input <- b
+			}
+			if err != nil {
+				close(this.input)
+				return
+			}
+		}
+	}()
+	for !this.detached {
+		packet, ok := this.readPacket()
+		if !ok {
+			return nil
+		}
+		reply, ok := this.handle(packet)
+		if !ok {
+			return nil
+		}
+		if err := this.send(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPacket returns the contents of the next valid packet, acks and
+// interrupts outside of a continue are dropped
+func (this *gdbServer) readPacket() (string, bool) {
+	for {
+		b, ok := <-this.input
+		if !ok {
+			return "", false
+		}
+		if b != '$' {
+			continue
+		}
+		data := []byte{}
+		sum := byte(0)
+		for {
+			b, ok = <-this.input
+			if !ok {
+				return "", false
+			}
+			if b == '#' {
+				break
+			}
+			data = append(data, b)
+			sum += b
+		}
+		check := make([]byte, 2)
+		for i := range check {
+			if check[i], ok = <-this.input; !ok {
+				return "", false
+			}
+		}
+		expected, err := strconv.ParseUint(string(check), 16, 8)
+		if err != nil || byte(expected) != sum {
+			if !this.noAck {
+				this.rw.Write([]byte("-"))
+			}
+			continue
+		}
+		if !this.noAck {
+			if _, err := this.rw.Write([]byte("+")); err != nil {
+				return "", false
+			}
+		}
+		return string(unescape(data)), true
+	}
+}
+
+// unescape removes the 0x7D escapes of binary data
+func unescape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			out = append(out, data[i]^0x20)
+			continue
+		}
+		out = append(out, data[i])
+	}
+	return out
+}
+
+func (this *gdbServer) send(data string) error {
+	sum := byte(0)
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	_, err := fmt.Fprintf(this.rw, "$%v#%02x", data, sum)
+	return err
+}
+
+// handle returns the reply to a packet, false ends the session
+func (this *gdbServer) handle(packet string) (string, bool) {
+	if packet == "" {
+		return "", true
+	}
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", sigTRAP), true
+	case 'g':
+		out := ""
+		for i := range gdbRegs {
+			out += hexU32(this.readReg(i))
+		}
+		return out, true
+	case 'G':
+		for i := range gdbRegs {
+			if len(args) < 8*(i+1) {
+				break
+			}
+			v, err := parseHexU32(args[8*i : 8*(i+1)])
+			if err != nil {
+				return "E01", true
+			}
+			this.writeReg(i, v)
+		}
+		return "OK", true
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 32)
+		if err != nil || n >= uint64(len(gdbRegs)) {
+			return "E01", true
+		}
+		return hexU32(this.readReg(int(n))), true
+	case 'P':
+		reg, value, _ := strings.Cut(args, "=")
+		n, err := strconv.ParseUint(reg, 16, 32)
+		if err != nil || n >= uint64(len(gdbRegs)) {
+			return "E01", true
+		}
+		v, err := parseHexU32(value)
+		if err != nil {
+			return "E01", true
+		}
+		this.writeReg(int(n), v)
+		return "OK", true
+	case 'm':
+		addr, size, err := parseAddrLen(args)
+		if err != nil {
+			return "E01", true
+		}
+		return this.readMemory(addr, min(size, gdbPacketSize/2)), true
+	case 'M', 'X':
+		head, data, _ := strings.Cut(args, ":")
+		addr, size, err := parseAddrLen(head)
+		if err != nil {
+			return "E01", true
+		}
+		bytes := []byte(data)
+		if packet[0] == 'M' {
+			if bytes, err = hex.DecodeString(data); err != nil {
+				return "E01", true
+			}
+		}
+		if uint32(len(bytes)) != size {
+			return "E01", true
+		}
+		return this.writeMemory(addr, bytes), true
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 32)
+			if err != nil {
+				return "E01", true
+			}
+			this.cpu.r[15] = uint32(addr) &^ 1
+		}
+		return this.resume(packet[0] == 's')
+	case 'Z', 'z':
+		return this.breakpoint(packet[0] == 'Z', args), true
+	case 'D':
+		this.detached = true
+		return "OK", true
+	case 'k':
+		return "", false
+	case 'H':
+		return "OK", true
+	case 'q', 'Q':
+		return this.query(packet), true
+	}
+	return "", true
+}
+
+// query answers the general query packets
+func (this *gdbServer) query(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return fmt.Sprintf("PacketSize=%x;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+", gdbPacketSize)
+	case packet == "QStartNoAckMode":
+		this.noAck = true
+		return "OK"
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		addr, size, err := parseAddrLen(strings.TrimPrefix(packet, "qXfer:features:read:target.xml:"))
+		if err != nil {
+			return "E01"
+		}
+		xml := targetXML()
+		if addr >= uint32(len(xml)) {
+			return "l"
+		}
+		end := min(addr+size, uint32(len(xml)))
+		if end == uint32(len(xml)) {
+			return "l" + xml[addr:end]
+		}
+		return "m" + xml[addr:end]
+	case packet == "qAttached":
+		return "1"
+	case packet == "qC":
+		return "QC1"
+	case packet == "qfThreadInfo":
+		return "m1"
+	case packet == "qsThreadInfo":
+		return "l"
+	}
+	return ""
+}
+
+func (this *gdbServer) readReg(n int) uint32 {
+	switch {
+	case n < 16:
+		return this.cpu.r[n]
+	case n == 16:
+		return this.cpu.xpsr()
+	}
+	return this.cpu.readSpecial(gdbSystemRegs[n-gdbProfileRegs])
+}
+
+func (this *gdbServer) writeReg(n int, v uint32) {
+	switch {
+	case n == 13:
+		this.cpu.setSP(v)
+	case n == 15:
+		this.cpu.r[15] = v &^ 1
+	case n < 16:
+		this.cpu.r[n] = v
+	case n == 16:
+		this.cpu.setAPSR(v)
+	default:
+		this.cpu.writeSpecial(gdbSystemRegs[n-gdbProfileRegs], v)
+	}
+}
+
+// accessSize reads and writes aligned words where possible, since the
+// system registers only take word accesses
+func accessSize(addr, left uint32) uint32 {
+	if addr%4 == 0 && left >= 4 {
+		return 4
+	}
+	return 1
+}
+
+// readMemory returns the bytes up to the first one that can't be read
+func (this *gdbServer) readMemory(addr, size uint32) string {
+	out := []byte{}
+	for i := uint32(0); i < size; {
+		n := accessSize(addr+i, size-i)
+		v, err := this.cpu.bus.read(addr+i, n)
+		if err != nil {
+			break
+		}
+		out = append(out, appendU32(nil, v)[:n]...)
+		i += n
+	}
+	if len(out) == 0 && size > 0 {
+		return "E01"
+	}
+	return hex.EncodeToString(out)
+}
+
+func (this *gdbServer) writeMemory(addr uint32, data []byte) string {
+	for i := uint32(0); i < uint32(len(data)); {
+		n := accessSize(addr+i, uint32(len(data))-i)
+		if err := this.cpu.bus.write(addr+i, n, readLE(data[i:], n)); err != nil {
+			return "E01"
+		}
+		i += n
+	}
+	return "OK"
+}
+
+// breakpoint handles Z and z for software and hardware breakpoints,
+// watchpoints are not supported
+func (this *gdbServer) breakpoint(insert bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 3 {
+		return "E01"
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return "E01"
+	}
+	var set map[uint32]bool
+	switch parts[0] {
+	case "0":
+		set = this.swBreaks
+	case "1":
+		set = this.hwBreaks
+		if insert && !set[uint32(addr)] && len(set) == gdbHWBreakpoints {
+			return "E01"
+		}
+	default:
+		return ""
+	}
+	if insert {
+		set[uint32(addr)] = true
+	} else {
+		delete(set, uint32(addr))
+	}
+	return "OK"
+}
+
+// resume steps or continues until a breakpoint, a halt or an interrupt
+// from gdb, the instruction at the current PC always runs
+func (this *gdbServer) resume(step bool) (string, bool) {
+	for i := 0; ; i++ {
+		if h := this.cpu.step(); h != nil {
+			return this.stopped(h), true
+		}
+		if step {
+			return fmt.Sprintf("S%02x", sigTRAP), true
+		}
+		pc := this.cpu.r[15]
+		if this.swBreaks[pc] {
+			return fmt.Sprintf("T%02xswbreak:;", sigTRAP), true
+		}
+		if this.hwBreaks[pc] {
+			return fmt.Sprintf("T%02xhwbreak:;", sigTRAP), true
+		}
+		if i%4096 == 0 {
+			select {
+			case b, ok := <-this.input:
+				if !ok {
+					return "", false
+				}
+				if b == 0x03 {
+					return fmt.Sprintf("S%02x", sigINT), true
+				}
+			default:
+			}
+		}
+	}
+}
+
+// stopped tells gdb why the core halted, the message goes to the gdb
+// console first
+func (this *gdbServer) stopped(h *halt) string {
+	this.send("O" + hex.EncodeToString([]byte(h.Error()+"\n")))
+	switch h.kind {
+	case haltFault:
+		return fmt.Sprintf("S%02x", sigSEGV)
+	case haltUndefined:
+		return fmt.Sprintf("S%02x", sigILL)
+	}
+	return fmt.Sprintf("S%02x", sigTRAP)
+}
+
+// hexU32 is the target byte order hex of a register
+func hexU32(v uint32) string {
+	return hex.EncodeToString(appendU32(nil, v))
+}
+
+func parseHexU32(s string) (uint32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, fmt.Errorf("invalid register value '%v'", s)
+	}
+	return readLE(b, 4), nil
+}
+
+// parseAddrLen parses the addr,length arguments of memory packets
+func parseAddrLen(s string) (uint32, uint32, error) {
+	a, l, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected addr,length, found '%v'", s)
+	}
+	addr, err := strconv.ParseUint(a, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := strconv.ParseUint(l, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(addr), uint32(size), nil
+}
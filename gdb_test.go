@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startGDB serves a program to a client over a pipe
+func startGDB(t *testing.T, src string) (*gdbClient, *cpu, chan error) {
+	t.Helper()
+	c := newCPU(newSparseMemory(assembleSource(t, src)))
+	if err := c.reset(0x20000000); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- newGDBServer(c, server).serve()
+		server.Close()
+	}()
+	return &gdbClient{t: t, conn: client, r: bufio.NewReader(client)}, c, done
+}
+
+func (this *gdbClient) send(packet string) {
+	sum := byte(0)
+	for i := 0; i < len(packet); i++ {
+		sum += packet[i]
+	}
+	fmt.Fprintf(this.conn, "$%v#%02x", packet, sum)
+}
+
+// reply reads the next packet, skipping the acks
+func (this *gdbClient) reply() string {
+	this.t.Helper()
+	s, err := this.r.ReadString('#')
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	s = strings.TrimLeft(s, "+")
+	if !strings.HasPrefix(s, "$") {
+		this.t.Fatalf("invalid packet %q", s)
+	}
+	check := make([]byte, 2)
+	if _, err := this.r.Read(check); err != nil {
+		this.t.Fatal(err)
+	}
+	return s[1 : len(s)-1]
+}
+
+func (this *gdbClient) cmd(packet string) string {
+	this.t.Helper()
+	this.send(packet)
+	return this.reply()
+}
+
+func (this *gdbClient) expect(packet, reply string) {
+	this.t.Helper()
+	if got := this.cmd(packet); got != reply {
+		this.t.Errorf("%v: got %q, expected %q", packet, got, reply)
+	}
+}
+
+const gdbProgram = `
+	movs r0, #1
+	movs r1, #2
+loop:
+	adds r0, r0, r1
+	cmp r0, #9
+	bne loop
+	ldr r2, =0x20000800
+	str r0, [r2, #0]
+	bkpt #0
+forever:
+	b forever
+`
+
+func TestGDBSession(t *testing.T) {
+	c, _, done := startGDB(t, gdbProgram)
+	if !strings.Contains(c.cmd("qSupported:swbreak+"), "qXfer:features:read+") {
+		t.Error("target.xml is not offered")
+	}
+	c.expect("QStartNoAckMode", "OK")
+	xml := c.cmd("qXfer:features:read:target.xml:0,20")
+	if xml != "m"+targetXML()[:0x20] {
+		t.Errorf("target.xml starts with %q", xml)
+	}
+	c.expect("qXfer:features:read:target.xml:10000,20", "l")
+	c.expect("?", "S05")
+	c.expect("pf", "08000020")
+	c.expect("pd", "00100020")
+	c.expect("p10", "00000001")
+	c.expect("m20000000,8", "0010002009000020")
+	if g := c.cmd("g"); len(g) != len(gdbRegs)*8 || g[15*8:16*8] != "08000020" {
+		t.Errorf("g replied %q", g)
+	}
+	// the breakpoint at loop is hit on the way in and on every iteration
+	c.expect("Z0,2000000c,2", "OK")
+	c.expect("c", "T05swbreak:;")
+	c.expect("c", "T05swbreak:;")
+	c.expect("p0", "03000000")
+	c.expect("z0,2000000c,2", "OK")
+	c.expect("s", "S05")
+	c.expect("pf", "0e000020")
+	c.expect("P1=04000000", "OK")
+	c.expect("c", "O"+fmt.Sprintf("%x", "0x20000016: BKPT #0\n"))
+	if got := c.reply(); got != "S05" {
+		t.Errorf("stopped with %q", got)
+	}
+	c.expect("m20000800,4", "09000000")
+	c.expect("M20000800,2:abcd", "OK")
+	c.expect("X20000802,2:\x7d\x03\x7d\x04", "OK")
+	c.expect("m20000800,4", "abcd2324")
+	for i := 0; i < gdbHWBreakpoints; i++ {
+		c.expect(fmt.Sprintf("Z1,%x,2", 0x20000000+2*i), "OK")
+	}
+	c.expect("Z1,20000100,2", "E01")
+	c.expect("Z2,20000800,4", "")
+	c.expect("D", "OK")
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGDBInterrupt(t *testing.T) {
+	c, cpu, done := startGDB(t, "forever:\n\tb forever\n")
+	// nothing reads the ack of the kill
+	c.expect("QStartNoAckMode", "OK")
+	c.send("c")
+	c.conn.Write([]byte{0x03})
+	if got := c.reply(); got != "S02" {
+		t.Errorf("interrupted with %q", got)
+	}
+	if cpu.r[15] != 0x20000008 {
+		t.Errorf("stopped at 0x%08X", cpu.r[15])
+	}
+	c.send("k")
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DisassembleGNU renders the regions as GNU as source, each region in
+// its own section named after its address, so that a linker script
+// placing .text.rXXXXXXXX at 0xXXXXXXXX reproduces the same bytes.
+// Instructions that as could encode differently are written as .inst
+func DisassembleGNU(maps []*memoryMap, list lister, symbols *symbolTable) string {
+	out := "\t.syntax unified\n\t.cpu cortex-m0plus\n\t.thumb\n"
+	for _, m := range maps {
+		out += fmt.Sprintf("\n@ 0x%08X, %v bytes\n", m.addr, len(m.contents))
+		out += fmt.Sprintf("\t.section .text.r%08X, \"ax\", %%progbits\n", m.addr)
+
+		instrs := list(m)
+		p := &printer{
+			maps:   []*memoryMap{m},
+			labels: labelsFor(instrs, symbols),
+		}
+		size := uint32(0)
+		for _, in := range instrs {
+			if label, ok := p.labels[in.addr]; ok {
+				out += label + ":\n"
+			}
+			out += "\t" + p.formatGNU(in) + "\n"
+			size += in.size
+		}
+		// a truncated 32 bit instruction or an odd byte at the end
+		for _, b := range m.contents[size:] {
+			out += fmt.Sprintf("\t.byte 0x%02X\n", b)
+		}
+	}
+	return out
+}
+
+// formatGNU renders a decoded instruction in unified syntax
+func (this *printer) formatGNU(in *instr) string {
+	if isData(in.op) {
+		return formatData(in)
+	}
+	if !this.gnuSafe(in) {
+		if in.size == 4 {
+			return fmt.Sprintf(".inst.w 0x%08X", in.word)
+		}
+		return fmt.Sprintf(".inst.n 0x%04X", in.word)
+	}
+	mnemonic := strings.ToLower(in.op.String())
+	args := []string{}
+	for _, a := range in.args {
+		if a.kind == argCond {
+			mnemonic += strings.ToLower(cond(uint8(a.value)))
+			continue
+		}
+		args = append(args, this.formatArgGNU(in, a))
+	}
+	switch in.op {
+	case mnCPSIE, mnCPSID:
+		args = append(args, "i")
+	case mnNEGS:
+		// RSBS #0 is the unified syntax name of NEGS
+		mnemonic = "rsbs"
+		args = append(args, "#0")
+	case mnADR:
+		// ADR with a plain offset is written as an add to PC
+		mnemonic = "add"
+		args = []string{args[0], "pc", fmt.Sprintf("#%d", in.args[1].value)}
+	}
+	if len(args) == 0 {
+		return mnemonic
+	}
+	return mnemonic + "\t" + strings.Join(args, ", ")
+}
+
+func (this *printer) formatArgGNU(in *instr, a arg) string {
+	switch a.kind {
+	case argReg:
+		if a.writeback {
+			return reg(a.reg) + "!"
+		}
+		return reg(a.reg)
+	case argRegList:
+		return reglist(a.list)
+	case argImm:
+		return fmt.Sprintf("#%d", a.value)
+	case argTarget:
+		if a.aligned {
+			// only literal loads reach here, ADR is rewritten
+			return fmt.Sprintf("[pc, #%d]", a.value)
+		}
+		return this.labels[in.target(a)]
+	case argSysReg:
+		name, _ := specialRegName(uint16(a.value))
+		name = strings.ToLower(name)
+		if in.op == mnMSR && (strings.HasSuffix(name, "apsr") || name == "xpsr") {
+			name += "_nzcvq"
+		}
+		return name
+	case argBarrier:
+		return strings.ToLower(barrierNames[uint16(a.value)])
+	case argMem:
+		if a.hasIndex {
+			return fmt.Sprintf("[%v, %v]", reg(a.reg), reg(a.index))
+		}
+		return fmt.Sprintf("[%v, #%d]", reg(a.reg), a.value)
+	}
+	return "!!!"
+}
+
+// gnuSafe tells if as assembles the text form of the instruction back
+// into the same encoding
+func (this *printer) gnuSafe(in *instr) bool {
+	if in.op == mnInvalid {
+		return false
+	}
+	for _, a := range in.args {
+		switch a.kind {
+		case argTarget:
+			if _, ok := this.labels[in.target(a)]; !ok && !a.aligned {
+				return false
+			}
+		case argRegList:
+			if a.list == 0 {
+				return false
+			}
+		case argSysReg:
+			if _, ok := specialRegName(uint16(a.value)); !ok {
+				return false
+			}
+		}
+	}
+	switch in.op {
+	case mnDMB, mnDSB, mnISB:
+		// ARMv6-M only names the SY option
+		return in.word&0xF == 0xF
+	case mnUDFW:
+		// as only accepts UDF.W for Thumb-2 targets
+		return false
+	case mnADDS, mnSUBS:
+		// with Rd == Rn the 3 bit immediate form is also
+		// valid for the 8 bit form, as may pick either
+		if len(in.args) == 3 && in.args[2].kind == argImm {
+			return in.args[0].reg != in.args[1].reg
+		}
+	case mnCMP:
+		// the high register form with two low registers
+		// is assembled as the low register form
+		if in.word&0xFF00 == 0b0100_0101_0000_0000 {
+			rn, rm := in.args[0].reg, in.args[1].reg
+			return (rn > 7 || rm > 7) && rn != 15 && rm != 15
+		}
+	}
+	return true
+}
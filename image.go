@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// image is the memory of one target, with the names known for it
+type image struct {
+	// nil unless the image comes from a UF2 file
+	family  *familyGroup
+	maps    []*memoryMap
+	entry   uint32
+	symbols *symbolTable
+}
+
+// loadImages reads a file in any of the supported formats, an empty
+// format is detected from the contents. UF2 files give one image per
+// family, other formats a single image. base is where raw binaries
+// are loaded
+func loadImages(filename, format string, base uint32) []*image {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fatal(err)
+	}
+	if format == "" {
+		format = detectFormat(filename, data)
+	}
+	img := &image{symbols: newSymbolTable()}
+	switch format {
+	case formatUF2:
+		blocks, errs := readUF2(data)
+		for _, err := range errs {
+			fmt.Println("ERROR:", err)
+		}
+		out := []*image{}
+		for _, g := range groupByFamily(blocks) {
+			out = append(out, &image{family: g, maps: joinBlocks(g.blocks), symbols: newSymbolTable()})
+		}
+		return out
+	case formatBin:
+		img.maps = []*memoryMap{{addr: base, contents: data}}
+	case formatHex:
+		img.maps, err = readHex(data)
+	case formatSrec:
+		img.maps, err = readSrec(data)
+	case formatELF:
+		img.maps, img.entry, err = readELF(data)
+		if err == nil {
+			img.symbols, err = readELFSymbols(data)
+		}
+	default:
+		fatal("unknown input format: " + format)
+	}
+	if err != nil {
+		fatal(filename + ": " + err.Error())
+	}
+	return []*image{img}
+}
+
+// sliceMaps returns the part of the regions between start and end
+func sliceMaps(maps []*memoryMap, start, end uint32) []*memoryMap {
+	out := []*memoryMap{}
+	for _, m := range maps {
+		from, to := m.addr, m.addr+uint32(len(m.contents))
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		if from < to {
+			out = append(out, &memoryMap{addr: from, contents: m.contents[from-m.addr : to-m.addr]})
+		}
+	}
+	return out
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tkKind int
+
+const (
+	tkEOF tkKind = iota
+	tkNL
+	tkId
+	tkReg
+	tkNum
+	tkStr
+	tkComma
+	tkColon
+	tkEquals
+	tkDollar
+	tkHash
+	tkPlus
+	tkMinus
+	tkBang
+	tkLBrack
+	tkRBrack
+	tkLBrace
+	tkRBrace
+)
+
+func (this tkKind) String() string {
+	switch this {
+	case tkEOF:
+		return "end of file"
+	case tkNL:
+		return "new line"
+	case tkId:
+		return "identifier"
+	case tkReg:
+		return "register"
+	case tkNum:
+		return "number"
+	case tkStr:
+		return "string"
+	case tkComma:
+		return "','"
+	case tkColon:
+		return "':'"
+	case tkEquals:
+		return "'='"
+	case tkDollar:
+		return "'$'"
+	case tkHash:
+		return "'#'"
+	case tkPlus:
+		return "'+'"
+	case tkMinus:
+		return "'-'"
+	case tkBang:
+		return "'!'"
+	case tkLBrack:
+		return "'['"
+	case tkRBrack:
+		return "']'"
+	case tkLBrace:
+		return "'{'"
+	case tkRBrace:
+		return "'}'"
+	}
+	return "???"
+}
+
+type token struct {
+	kind tkKind
+	text string
+	// value holds the register number for tkReg and the value for tkNum
+	value int64
+	line  int
+}
+
+func (this token) String() string {
+	switch this.kind {
+	case tkId, tkReg, tkNum:
+		return fmt.Sprintf("'%v'", this.text)
+	case tkStr:
+		return fmt.Sprintf("%q", this.text)
+	}
+	return this.kind.String()
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{
+		src:  src,
+		pos:  0,
+		line: 1,
+	}
+}
+
+func lineErr(line int, format string, a ...any) error {
+	return fmt.Errorf("%v: %v", line, fmt.Sprintf(format, a...))
+}
+
+func (this *lexer) peekByte() byte {
+	if this.pos >= len(this.src) {
+		return 0
+	}
+	return this.src[this.pos]
+}
+
+func (this *lexer) all() ([]token, error) {
+	out := []token{}
+	for {
+		tk, err := this.next()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tk)
+		if tk.kind == tkEOF {
+			return out, nil
+		}
+	}
+}
+
+func (this *lexer) next() (token, error) {
+	this.skipBlank()
+	if this.pos >= len(this.src) {
+		return token{kind: tkEOF, line: this.line}, nil
+	}
+	c := this.src[this.pos]
+	switch {
+	case c == '\n':
+		tk := token{kind: tkNL, text: "\n", line: this.line}
+		this.pos++
+		this.line++
+		return tk, nil
+	case isLetter(c):
+		return this.ident(), nil
+	case isDecDigit(c):
+		return this.number()
+	case c == '\'':
+		return this.char()
+	case c == '"':
+		return this.str()
+	}
+	kind, ok := punctuation[c]
+	if !ok {
+		return token{}, lineErr(this.line, "invalid character %q", c)
+	}
+	this.pos++
+	return token{kind: kind, text: string(c), line: this.line}, nil
+}
+
+var punctuation = map[byte]tkKind{
+	',': tkComma,
+	':': tkColon,
+	'=': tkEquals,
+	'$': tkDollar,
+	'#': tkHash,
+	'+': tkPlus,
+	'-': tkMinus,
+	'!': tkBang,
+	'[': tkLBrack,
+	']': tkRBrack,
+	'{': tkLBrace,
+	'}': tkRBrace,
+}
+
+// skips spaces, tabs, carriage returns and comments, but not line feeds
+func (this *lexer) skipBlank() {
+	for this.pos < len(this.src) {
+		c := this.src[this.pos]
+		if c == ';' {
+			for this.pos < len(this.src) && this.src[this.pos] != '\n' {
+				this.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\r' {
+			return
+		}
+		this.pos++
+	}
+}
+
+func (this *lexer) ident() token {
+	start := this.pos
+	for this.pos < len(this.src) && isLetterDigit(this.src[this.pos]) {
+		this.pos++
+	}
+	text := this.src[start:this.pos]
+	if r, ok := regByName(text); ok {
+		return token{kind: tkReg, text: text, value: int64(r), line: this.line}
+	}
+	return token{kind: tkId, text: text, line: this.line}
+}
+
+// accepts r0-r15 and the sp, lr and pc aliases, in any case
+func regByName(name string) (uint16, bool) {
+	lower := strings.ToLower(name)
+	switch lower {
+	case "sp":
+		return 13, true
+	case "lr":
+		return 14, true
+	case "pc":
+		return 15, true
+	}
+	if len(lower) < 2 || lower[0] != 'r' {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(lower[1:], 10, 8)
+	if err != nil || n > 15 || (len(lower) > 2 && lower[1] == '0') {
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+func (this *lexer) number() (token, error) {
+	start := this.pos
+	for this.pos < len(this.src) && isLetterDigit(this.src[this.pos]) {
+		this.pos++
+	}
+	text := this.src[start:this.pos]
+	base := 10
+	digits := text
+	if len(text) > 2 && text[0] == '0' {
+		switch text[1] {
+		case 'x', 'X':
+			base = 16
+			digits = text[2:]
+		case 'b', 'B':
+			base = 2
+			digits = text[2:]
+		}
+	}
+	digits = strings.ReplaceAll(digits, "_", "")
+	v, err := strconv.ParseUint(digits, base, 32)
+	if err != nil {
+		return token{}, lineErr(this.line, "invalid number '%v'", text)
+	}
+	return token{kind: tkNum, text: text, value: int64(v), line: this.line}, nil
+}
+
+func (this *lexer) char() (token, error) {
+	start := this.pos
+	this.pos++ // '
+	c, err := this.escaped('\'')
+	if err != nil {
+		return token{}, err
+	}
+	if this.peekByte() != '\'' {
+		return token{}, lineErr(this.line, "unterminated character literal")
+	}
+	this.pos++
+	text := this.src[start:this.pos]
+	return token{kind: tkNum, text: text, value: int64(c), line: this.line}, nil
+}
+
+func (this *lexer) str() (token, error) {
+	this.pos++ // "
+	out := []byte{}
+	for this.peekByte() != '"' {
+		c, err := this.escaped('"')
+		if err != nil {
+			return token{}, err
+		}
+		out = append(out, c)
+	}
+	this.pos++
+	return token{kind: tkStr, text: string(out), line: this.line}, nil
+}
+
+// reads a single, possibly escaped, ascii character
+func (this *lexer) escaped(quote byte) (byte, error) {
+	c := this.peekByte()
+	if this.pos >= len(this.src) || c == '\n' {
+		return 0, lineErr(this.line, "unterminated literal")
+	}
+	this.pos++
+	if c == quote {
+		return 0, lineErr(this.line, "empty literal")
+	}
+	if c != '\\' {
+		return c, nil
+	}
+	e := this.peekByte()
+	this.pos++
+	switch e {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '0':
+		return 0, nil
+	case '\\', '\'', '"':
+		return e, nil
+	}
+	return 0, lineErr(this.line, "invalid escape sequence '\\%c'", e)
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '_' || c == '.'
+}
+
+func isDecDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isLetterDigit(c byte) bool {
+	return isLetter(c) || isDecDigit(c)
+}
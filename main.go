@@ -4,8 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 func fatal(a ...any) {
@@ -13,37 +17,778 @@ func fatal(a ...any) {
 	os.Exit(1)
 }
 
+const usage = `usage:
+	ras <file.uf2>
+		dumps and disassembles an UF2 file
+	ras disasm [-syntax ras|gnu] [-mode linear|flow] [-entry addr,...] [-vtor addr]
+			[-func name] [-base addr] <image>
+		disassembles an image in any of the convert formats, the gnu syntax
+		can be fed back to GNU as. The flow mode only decodes code reachable
+		from the entry points. ELF symbols name the code, -func limits the
+		listing to one function
+	ras vectors [-vtor addr] [-base addr] <image>
+		prints the vector table
+	ras verify <file.uf2>
+		checks the structure of an UF2 file, exits with 1 if it's invalid
+	ras unpack [-o dir] <file.uf2>
+		extracts the files of a file container UF2
+	ras pack [-o out.uf2] <dir>
+		builds a file container UF2 with every file under dir
+	ras convert [-i format] [-f format] [-base addr] [uf2 options] <input> <output>
+		converts between uf2, bin, hex (Intel HEX), srec and elf, formats
+		are detected from the contents and extensions if not given
+	ras asm [-o out] [-f bin|uf2|elf|o] [uf2 options] <file.ras>
+		assembles a source file into a raw binary, UF2 file, ELF executable
+		or relocatable object. Objects relocate the undefined symbols and
+		the words and calls referring to labels, so the linker may place
+		the sections anywhere
+	ras uf2 [-o out.uf2] [-base addr] [uf2 options] <file.bin>
+		wraps a raw binary into an UF2 file
+	ras run [-max n] [emulator options] <image>
+		runs the image in the emulator from its reset handler until it
+		halts, exits with 1 unless it stopped at a BKPT. The RP2040
+		bootrom stub, flash, SRAM, SIO and UART0 are modelled, UART0
+		writes to stdout. Exceptions, the NVIC and SysTick are modelled
+	ras gdbserver [-port n] [emulator options] <image>
+		serves the emulator to gdb over the remote serial protocol on a
+		local TCP port, default 3333, for target remote :3333
+	ras trace [-f text|bin] [-o file] [-max n] [emulator options] <image>
+		runs the image and logs every instruction with the registers and
+		memory it changed, as text or as a binary trace for tracediff
+	ras tracediff [-context n] <a.trace> <b.trace>
+		shows where two binary traces diverge
+	ras profile [-by func|addr] [-max n] [emulator options] <image>
+		runs the image and counts the executions and the approximate
+		Cortex-M0+ cycles of every function or address
+
+uf2 options:
+	-family id	family name or ID, 0 omits it, defaults to rp2040
+	-md5		adds the MD5 of the payload to every block
+	-version str, -desc str, -pagesize n, -sha2
+			extension tags, placed in the first block
+
+emulator options:
+	-vtor addr	vector table, defaults to the image base after boot2
+	-base addr	address of raw binaries, defaults to 0x10000000
+	-flat		runs over a plain memory instead of the RP2040
+	-catch=false	runs the HardFault handler instead of stopping on faults`
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
-	filename := args[0]
+	if len(args) == 0 {
+		fatal(usage)
+	}
+
+	switch args[0] {
+	case "asm":
+		asmCmd(args[1:])
+	case "uf2":
+		uf2Cmd(args[1:])
+	case "disasm":
+		disasmCmd(args[1:])
+	case "vectors":
+		vectorsCmd(args[1:])
+	case "verify":
+		verifyCmd(args[1:])
+	case "unpack":
+		unpackCmd(args[1:])
+	case "pack":
+		packCmd(args[1:])
+	case "convert":
+		convertCmd(args[1:])
+	case "run":
+		runCmd(args[1:])
+	case "gdbserver":
+		gdbserverCmd(args[1:])
+	case "trace":
+		traceCmd(args[1:])
+	case "tracediff":
+		tracediffCmd(args[1:])
+	case "profile":
+		profileCmd(args[1:])
+	default:
+		dumpCmd(args[0])
+	}
+}
 
-	bytes, err := ioutil.ReadFile(filename)
+func asmCmd(args []string) {
+	fs := flag.NewFlagSet("asm", flag.ExitOnError)
+	output := fs.String("o", "", "output file, defaults to the input with the format extension")
+	format := fs.String("f", "", "output format, bin, uf2, elf or o, defaults to the output extension or bin")
+	opts := addUF2Flags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	filename := fs.Arg(0)
+	if *format == "" {
+		*format = "bin"
+		switch strings.ToLower(filepath.Ext(*output)) {
+		case ".uf2":
+			*format = "uf2"
+		case ".elf":
+			*format = "elf"
+		case ".o":
+			*format = "o"
+		}
+	}
+	if *format != "bin" && *format != "uf2" && *format != "elf" && *format != "o" {
+		fatal("unknown format: " + *format)
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + *format
+	}
+
+	src, err := ioutil.ReadFile(filename)
 	if err != nil {
 		fatal(err)
 	}
-	if len(bytes)%512 != 0 {
-		fatal("size is not 512-byte-aligned")
+	mod, err := parse(string(src))
+	if err != nil {
+		fatal(filename + ":" + err.Error())
+	}
+	var obj *object
+	if *format == "o" {
+		obj, err = assembleObject(mod)
+	} else {
+		obj, err = assemble(mod)
+	}
+	if err != nil {
+		fatal(filename + ":" + err.Error())
+	}
+	var data []byte
+	switch *format {
+	case "uf2":
+		data = opts.build(obj.memoryMaps())
+	case "elf":
+		data = writeExecutable(obj, obj.entry())
+	case "o":
+		data = writeObject(obj)
+	default:
+		data = obj.flat()
 	}
-	blocks := []*uf2block{}
-	rb := newReadBuffer(bytes)
+	err = ioutil.WriteFile(*output, data, 0644)
+	if err != nil {
+		fatal(err)
+	}
+}
 
-	out := readChunk(rb)
-	for out != nil {
-		blocks = append(blocks, out)
+func uf2Cmd(args []string) {
+	fs := flag.NewFlagSet("uf2", flag.ExitOnError)
+	output := fs.String("o", "", "output file, defaults to the input with a .uf2 extension")
+	base := fs.String("base", "0x10000000", "address where the binary is loaded")
+	opts := addUF2Flags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	filename := fs.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".uf2"
+	}
+	addr, err := parseNum(*base)
+	if err != nil {
+		fatal(err)
+	}
 
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fatal(err)
+	}
+	m := &memoryMap{addr: addr, contents: contents}
+	data := opts.build([]*memoryMap{m})
+	err = ioutil.WriteFile(*output, data, 0644)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// uf2Options holds the flags of the commands that write UF2 files
+type uf2Options struct {
+	family      *string
+	md5         *bool
+	version     *string
+	description *string
+	pageSize    *uint
+	sha2        *bool
+}
+
+func addUF2Flags(fs *flag.FlagSet) *uf2Options {
+	return &uf2Options{
+		family:      fs.String("family", "rp2040", "UF2 family name or ID, 0 omits it"),
+		md5:         fs.Bool("md5", false, "add the MD5 of the payload to every block"),
+		version:     fs.String("version", "", "firmware version tag"),
+		description: fs.String("desc", "", "device description tag"),
+		pageSize:    fs.Uint("pagesize", 0, "page size tag"),
+		sha2:        fs.Bool("sha2", false, "add the SHA-256 of the image as a tag"),
+	}
+}
+
+func (this *uf2Options) build(maps []*memoryMap) []byte {
+	familyID, err := parseFamily(*this.family)
+	if err != nil {
+		fatal(err)
+	}
+	blocks := buildUF2(maps, familyID)
+	if *this.md5 {
+		addChecksums(blocks)
+	}
+	tags := imageTags(maps, *this.version, *this.description, uint32(*this.pageSize), *this.sha2)
+	if err := addTags(blocks, tags); err != nil {
+		fatal(err)
+	}
+	return writeUF2(blocks)
+}
+
+// parseNum accepts decimal, 0x hexadecimal and 0b binary numbers
+func parseNum(s string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.ReplaceAll(s, "_", ""), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %v", s)
+	}
+	return uint32(n), nil
+}
+
+func disasmCmd(args []string) {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	syntax := fs.String("syntax", "ras", "output syntax, ras or gnu")
+	mode := fs.String("mode", "linear", "linear decodes every halfword, flow follows branches from the entry points")
+	entries := fs.String("entry", "", "comma separated entry points, defaults to the vector table handlers")
+	vtor := fs.String("vtor", "", "address of the vector table, defaults to the image base")
+	function := fs.String("func", "", "only disassemble the named function")
+	base := fs.String("base", "0x10000000", "address where raw binaries are loaded")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	addrs := []uint32{}
+	for _, s := range strings.Split(*entries, ",") {
+		if s == "" {
+			continue
+		}
+		addr, err := parseNum(s)
+		if err != nil {
+			fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if *mode != "linear" && *mode != "flow" {
+		fatal("unknown mode: " + *mode)
+	}
+	if *syntax != "ras" && *syntax != "gnu" {
+		fatal("unknown syntax: " + *syntax)
+	}
+	baseAddr, err := parseNum(*base)
+	if err != nil {
+		fatal(err)
+	}
+
+	images := loadImages(fs.Arg(0), "", baseAddr)
+	for _, img := range images {
+		if len(images) > 1 {
+			printFamily(img.family, *syntax == "gnu")
+		}
+		boot, maps := splitBoot2(img.maps)
+		table, tableErr := readVectorTable(maps, vtorAddr(maps, *vtor))
+		regions := maps
+		if boot != nil {
+			regions = append([]*memoryMap{boot.region}, maps...)
+		}
+		loaded := regions
+		entries := addrs
+		symbols := img.symbols
+		if tableErr == nil {
+			for addr, name := range vectorLabels(table) {
+				symbols.add(name, addr, 0, true)
+			}
+		}
+
+		if *function != "" {
+			sym, ok := symbols.lookup(*function)
+			if !ok {
+				fatal("unknown function: " + *function)
+			}
+			start, end := symbols.extent(sym, regions)
+			regions = sliceMaps(regions, start, end)
+			if len(regions) == 0 {
+				fatal(*function + " is not part of the image")
+			}
+			boot, maps = nil, regions
+			if len(entries) == 0 {
+				entries = []uint32{start}
+			}
+		}
+
+		list := decodeAll
+		if *mode == "flow" {
+			if len(entries) == 0 {
+				if tableErr != nil && len(symbols.functions()) == 0 {
+					fatal(tableErr.Error() + ", use -entry")
+				}
+				if tableErr == nil {
+					entries = vectorEntries(maps, table)
+				}
+				entries = append(entries, symbols.functions()...)
+				if boot != nil {
+					entries = append(entries, boot2Addr)
+				}
+			}
+			list = traverse(regions, entries).listing
+		}
+
+		if *syntax == "ras" {
+			printListing(boot, maps, loaded, list, symbols)
+			continue
+		}
+		if boot != nil {
+			for _, line := range strings.Split(strings.TrimSpace(boot.String()), "\n") {
+				fmt.Println("@ " + strings.TrimSpace(line))
+			}
+		} else if msg := boot2Missing(loaded); msg != "" {
+			fmt.Println("@ " + msg)
+		}
+		fmt.Print(DisassembleGNU(regions, list, symbols))
+	}
+}
+
+// printFamily separates the output of each family in multi-family files
+func printFamily(g *familyGroup, gnu bool) {
+	if gnu {
+		fmt.Printf("\n@ %v\n", g)
+		return
+	}
+	fmt.Printf("\n=========== %v ===========\n", g)
+}
+
+func vectorsCmd(args []string) {
+	fs := flag.NewFlagSet("vectors", flag.ExitOnError)
+	vtor := fs.String("vtor", "", "address of the vector table, defaults to the image base")
+	base := fs.String("base", "0x10000000", "address where raw binaries are loaded")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	baseAddr, err := parseNum(*base)
+	if err != nil {
+		fatal(err)
+	}
+	images := loadImages(fs.Arg(0), "", baseAddr)
+	for _, img := range images {
+		if len(images) > 1 {
+			printFamily(img.family, false)
+		}
+		_, maps := splitBoot2(img.maps)
+		table, err := readVectorTable(maps, vtorAddr(maps, *vtor))
+		if err != nil {
+			fatal(err)
+		}
+		for _, v := range table {
+			fmt.Println(v)
+		}
+	}
+}
+
+func verifyCmd(args []string) {
+	if len(args) != 1 {
+		fatal(usage)
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	problems := verifyUF2(data)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("ok, %v blocks\n", len(data)/uf2BlockSize)
+}
+
+func unpackCmd(args []string) {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	output := fs.String("o", ".", "output directory")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	files, errs := unpackFiles(loadUF2(fs.Arg(0)))
+	for _, err := range errs {
+		fmt.Println("ERROR:", err)
+	}
+	if err := writeFiles(*output, files); err != nil {
+		fatal(err)
+	}
+	for _, f := range files {
+		fmt.Printf("%v\t%v bytes\n", f.name, len(f.contents))
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func packCmd(args []string) {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	output := fs.String("o", "", "output file, defaults to the directory name with a .uf2 extension")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	dir := fs.Arg(0)
+	if *output == "" {
+		*output = filepath.Clean(dir) + ".uf2"
+	}
+	files, err := readFiles(dir)
+	if err != nil {
+		fatal(err)
+	}
+	blocks, err := packFiles(files)
+	if err != nil {
+		fatal(err)
+	}
+	err = ioutil.WriteFile(*output, writeUF2(blocks), 0644)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func convertCmd(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	inFormat := fs.String("i", "", "input format")
+	outFormat := fs.String("f", "", "output format")
+	base := fs.String("base", "0x10000000", "address where raw binaries are loaded")
+	opts := addUF2Flags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fatal(usage)
+	}
+	input, output := fs.Arg(0), fs.Arg(1)
+	if *outFormat == "" {
+		*outFormat = formatFromExt(output)
+		if *outFormat == "" {
+			fatal("unknown output format, use -f")
+		}
+	}
+	addr, err := parseNum(*base)
+	if err != nil {
+		fatal(err)
+	}
+
+	images := loadImages(input, *inFormat, addr)
+	if len(images) > 1 {
+		fatal("the file holds more than one family")
+	}
+	var maps []*memoryMap
+	entry := uint32(0)
+	if len(images) == 1 {
+		maps, entry = images[0].maps, images[0].entry
+	}
+	if entry == 0 {
+		entry = resetEntry(maps)
+	}
+
+	var out []byte
+	switch *outFormat {
+	case formatUF2:
+		out = opts.build(maps)
+	case formatBin:
+		out = flatten(maps)
+	case formatHex:
+		out = writeHex(maps, entry)
+	case formatSrec:
+		out = writeSrec(maps, entry)
+	case formatELF:
+		out = writeELF(maps, entry)
+	default:
+		fatal("unknown output format: " + *outFormat)
+	}
+	err = ioutil.WriteFile(output, out, 0644)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// emulatorFlags are the flags of the commands that run an image
+type emulatorFlags struct {
+	vtor  *string
+	base  *string
+	flat  *bool
+	catch *bool
+}
+
+func addEmulatorFlags(fs *flag.FlagSet) *emulatorFlags {
+	return &emulatorFlags{
+		vtor:  fs.String("vtor", "", "address of the vector table, defaults to the image base after the boot2 block"),
+		base:  fs.String("base", "0x10000000", "address where raw binaries are loaded"),
+		flat:  fs.Bool("flat", false, "run over a flat memory instead of the RP2040 address space"),
+		catch: fs.Bool("catch", true, "stop on faults instead of running the HardFault handler"),
+	}
+}
+
+// load builds the emulator for the image, reset from its vector table
+func (this *emulatorFlags) load(filename string) (*cpu, *image) {
+	addr, err := parseNum(*this.base)
+	if err != nil {
+		fatal(err)
+	}
+	images := loadImages(filename, "", addr)
+	if len(images) != 1 {
+		fatal("the file holds more than one family")
+	}
+	_, maps := splitBoot2(images[0].maps)
+	var b bus = newSparseMemory(images[0].maps)
+	if !*this.flat {
+		b, err = newRP2040(images[0].maps, os.Stdout)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	c := newCPU(b)
+	c.catchHardFault = *this.catch
+	vtor := vtorAddr(maps, *this.vtor)
+	if err := c.reset(vtor); err != nil {
+		fatal(err)
+	}
+	if table, err := readVectorTable(maps, vtor); err == nil {
+		for addr, name := range vectorLabels(table) {
+			images[0].symbols.add(name, addr, 0, true)
+		}
+	}
+	return c, images[0]
+}
+
+func runCmd(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	emu := addEmulatorFlags(fs)
+	max := fs.Uint64("max", 100000000, "maximum number of instructions, 0 for no limit")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	c, _ := emu.load(fs.Arg(0))
+	h := c.run(*max)
+	fmt.Printf("%v, after %v instructions\n", h, c.steps)
+	fmt.Print(c)
+	if h.kind != haltBreakpoint {
+		os.Exit(1)
+	}
+}
+
+// traceWriter is a text or binary trace output
+type traceWriter interface {
+	add(s *traceStep) error
+	close() error
+}
+
+func traceCmd(args []string) {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	emu := addEmulatorFlags(fs)
+	max := fs.Uint64("max", 1000000, "maximum number of instructions, 0 for no limit")
+	format := fs.String("f", "text", "trace format, text or bin")
+	output := fs.String("o", "", "output file, defaults to stdout for text")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	if *format != "text" && *format != "bin" {
+		fatal("unknown format: " + *format)
+	}
+	if *format == "bin" && *output == "" {
+		fatal("binary traces need an output file")
+	}
+	c, img := emu.load(fs.Arg(0))
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	var w traceWriter
+	if *format == "text" {
+		w = newTraceText(out, img)
+	} else {
+		bin, err := newTraceBinary(out)
+		if err != nil {
+			fatal(err)
+		}
+		w = bin
+	}
+	t := newTracer(c)
+	var h *halt
+	for *max == 0 || c.steps < *max {
+		var s *traceStep
+		if s, h = t.step(); h != nil {
+			break
+		}
+		if err := w.add(s); err != nil {
+			fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		fatal(err)
+	}
+	if h == nil {
+		h = &halt{kind: haltLimit, pc: c.r[15], msg: "instruction limit reached"}
+	}
+	fmt.Printf("%v, after %v instructions\n", h, c.steps)
+}
+
+func tracediffCmd(args []string) {
+	fs := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	context := fs.Int("context", 5, "number of identical instructions shown before the difference")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fatal(usage)
+	}
+	traces := [][]*traceStep{}
+	for _, filename := range fs.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fatal(err)
+		}
+		steps, err := readTrace(data)
+		if err != nil {
+			fatal(filename + ": " + err.Error())
+		}
+		traces = append(traces, steps)
+	}
+	diff := diffTraces(traces[0], traces[1], *context)
+	if diff == "" {
+		fmt.Printf("the traces are the same, %v instructions\n", len(traces[0]))
+		return
+	}
+	fmt.Print(diff)
+	os.Exit(1)
+}
+
+func profileCmd(args []string) {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	emu := addEmulatorFlags(fs)
+	max := fs.Uint64("max", 100000000, "maximum number of instructions, 0 for no limit")
+	by := fs.String("by", "func", "totals by func or by addr")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	if *by != "func" && *by != "addr" {
+		fatal("unknown grouping: " + *by)
+	}
+	c, img := emu.load(fs.Arg(0))
+	p := newProfile()
+	var h *halt
+	for *max == 0 || c.steps < *max {
+		if h = c.step(); h != nil {
+			break
+		}
+		if c.executed != nil {
+			p.add(c.executed, c.branched)
+		}
+	}
+	if h == nil {
+		h = &halt{kind: haltLimit, pc: c.r[15], msg: "instruction limit reached"}
+	}
+	count, cycles := p.total()
+	fmt.Printf("%v, after %v instructions, about %v cycles\n\n", h, count, cycles)
+	if *by == "func" {
+		fmt.Print(p.byFunction(functionSymbols(img), img.maps))
+	} else {
+		fmt.Print(p.byAddress(imagePrinter(img)))
+	}
+}
+
+func gdbserverCmd(args []string) {
+	fs := flag.NewFlagSet("gdbserver", flag.ExitOnError)
+	emu := addEmulatorFlags(fs)
+	port := fs.Int("port", 3333, "TCP port to listen on")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(usage)
+	}
+	c, _ := emu.load(fs.Arg(0))
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", *port))
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println("waiting for gdb on", l.Addr())
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println("gdb connected from", conn.RemoteAddr())
+	err = newGDBServer(c, conn).serve()
+	conn.Close()
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// vtorAddr parses the -vtor flag, an empty value means the image base
+func vtorAddr(maps []*memoryMap, s string) uint32 {
+	if s == "" {
+		if len(maps) == 0 {
+			fatal("empty image")
+		}
+		return maps[0].addr
+	}
+	addr, err := parseNum(s)
+	if err != nil {
+		fatal(err)
+	}
+	return addr
+}
+
+// loadUF2 reads every valid block of the file, reporting the broken ones
+func loadUF2(filename string) []*uf2block {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fatal(err)
+	}
+	blocks, errs := readUF2(bytes)
+	for _, err := range errs {
+		fmt.Println("ERROR:", err)
+	}
+	return blocks
+}
+
+func dumpCmd(filename string) {
+	blocks := loadUF2(filename)
+	for _, out := range blocks {
 		fmt.Print(out.Header())
 		fmt.Println()
 		fmt.Print(out.HexPayload())
 		fmt.Println()
+	}
 
-		out = readChunk(rb)
+	groups := groupByFamily(blocks)
+	for _, g := range groups {
+		if len(groups) > 1 {
+			printFamily(g, false)
+		}
+		regions := joinBlocks(g.blocks)
+		boot, maps := splitBoot2(regions)
+		printListing(boot, maps, regions, decodeAll, nil)
 	}
+}
 
-	maps := joinBlocks(blocks)
+// printListing prints the boot2 block, if any, apart from the application.
+// regions is all the loaded memory
+func printListing(boot *boot2, maps, regions []*memoryMap, list lister, symbols *symbolTable) {
+	if boot != nil {
+		fmt.Printf("\n----------- BOOT2 0x%04X  %v bytes-----------\n", boot.region.addr, len(boot.region.contents))
+		fmt.Print(boot)
+		fmt.Print(Disassemble(boot.region, regions, list, nil))
+	} else if msg := boot2Missing(regions); msg != "" {
+		fmt.Printf("\n%v\n", msg)
+	}
 	for _, m := range maps {
 		fmt.Printf("\n----------- REGION 0x%04X  %v bytes-----------\n", m.addr, len(m.contents))
-		fmt.Print(Disassemble(m))
+		fmt.Print(Disassemble(m, regions, list, symbols))
 	}
 }
 
@@ -74,6 +819,20 @@ func newMMap(block *uf2block) *memoryMap {
 	}
 }
 
+func (this *memoryMap) contains(addr uint32) bool {
+	return addr >= this.addr && addr-this.addr < uint32(len(this.contents))
+}
+
+// word reads a little endian word, if it's entirely inside the region
+func (this *memoryMap) word(addr uint32) (uint32, bool) {
+	if !this.contains(addr) || !this.contains(addr+3) {
+		return 0, false
+	}
+	offset := addr - this.addr
+	rb := newReadBuffer(this.contents[offset : offset+4])
+	return rb.getU32()
+}
+
 func (this *memoryMap) append(block *uf2block) {
 	this.contents = append(this.contents, block.payload...)
 }
@@ -106,6 +865,9 @@ func joinBlocks(blocks []*uf2block) []*memoryMap {
 }
 
 type uf2block struct {
+	// offset of the block in the file
+	offset int
+
 	flags       uf2flags
 	addr        uint32
 	payloadSize uint32
@@ -115,13 +877,21 @@ type uf2block struct {
 	something uint32
 
 	payload []byte
+
+	// set by ChecksumPresent and ExtensionTagsPresent
+	checksum *uf2Checksum
+	tags     []uf2Tag
+	// set by FileContainer
+	fileName string
 }
 
 func (this *uf2block) Header() string {
 	out := ""
 	out += fmt.Sprintf("\t%v", this.flags)
-	if this.flags.FamilyIDPresent {
-		out += fmt.Sprintf("\t\t%08X\n", this.something)
+	if this.flags.FileContainer {
+		out += fmt.Sprintf("\t\t%q, %v bytes\n", this.fileName, this.something)
+	} else if this.flags.FamilyIDPresent {
+		out += fmt.Sprintf("\t\t%v (%08X)\n", familyName(this.something), this.something)
 	} else {
 		out += fmt.Sprintf("\t\t%08X\n", this.something)
 	}
@@ -131,6 +901,12 @@ func (this *uf2block) Header() string {
 		this.seqBlockNum+1,
 		this.totBlockNum,
 	)
+	if this.checksum != nil {
+		out += fmt.Sprintf("\n\t%v", this.checksum)
+	}
+	for _, t := range this.tags {
+		out += fmt.Sprintf("\n\t%v", t)
+	}
 	return out
 }
 
@@ -138,7 +914,9 @@ func (this *uf2block) HexPayload() string {
 	return hexPrint(this.payload)
 }
 func strchunk(chunk []byte) string {
-	if len(chunk) == 2 {
+	if len(chunk) == 1 {
+		return fmt.Sprintf("      %02X", chunk[0])
+	} else if len(chunk) == 2 {
 		return fmt.Sprintf("    %02X%02X", chunk[1], chunk[0])
 	} else if len(chunk) == 4 {
 		return fmt.Sprintf("%02X%02X%02X%02X", chunk[3], chunk[2], chunk[1], chunk[0])
@@ -147,12 +925,6 @@ func strchunk(chunk []byte) string {
 	}
 }
 
-type instr struct {
-	text  string
-	size  uint32
-	chunk []byte
-}
-
 const (
 	bits15_14 uint16 = 0b1100_0000_0000_0000
 	bits15_12 uint16 = 0b1111_0000_0000_0000
@@ -165,6 +937,7 @@ const (
 	bits15_5  uint16 = 0b1111_1111_1110_0000
 	bits15_4  uint16 = 0b1111_1111_1111_0000
 
+	bits11_0 uint16 = 0b0000_1111_1111_1111
 	bits10_0 uint16 = 0b0000_0111_1111_1111
 	bits9_0  uint16 = 0b0000_0011_1111_1111
 	bits7_0  uint16 = 0b0000_0000_1111_1111
@@ -188,588 +961,6 @@ const (
 	bit7  uint16 = 0b0000_0000_1000_0000
 )
 
-func Disassemble(m *memoryMap) string {
-	out := ""
-	rb := newReadBuffer(m.contents)
-
-	var instrOut instr
-	startAddr := m.addr
-	for decodeInstr(rb, &instrOut) {
-		out += fmt.Sprintf("%08X", startAddr) +
-			" " + strchunk(instrOut.chunk) +
-			"\t" + instrOut.text + "\n"
-		startAddr += instrOut.size
-	}
-
-	return out
-}
-
-func decodeInstr(rb *ReadBuffer, out *instr) bool {
-	hw, ok := rb.getU16()
-	if !ok {
-		return false
-	}
-	first := uint8((hw >> 8) & 0xFF)
-	last := uint8(hw & 0xFF)
-
-	out.chunk = []byte{first, last} // little endian
-	out.text = "???"
-	out.size = 2
-
-	if hw&bits15_6 == 0b0100_0001_0100_0000 { // ADCS <Rdn>, <Rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := hw & bits2_0
-		out.text = fmt.Sprintf("ADCS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_9 == 0b0001_1100_0000_0000 { // ADDS <Rd>, <Rn>, #<imm3>
-		imm3 := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("ADDS %v, %v, #%01X", reg(rd), reg(rn), imm3)
-	}
-
-	if hw&bits15_11 == 0b0011_0000_0000_0000 { // ADDS <Rdn>, #<imm8>
-		imm8 := hw & bits7_0
-		rdn := (hw & bits10_8) >> 8
-		out.text = fmt.Sprintf("ADDS %v, #%02X", reg(rdn), imm8)
-	}
-
-	if hw&bits15_9 == 0b0001_1000_0000_0000 { // ADDS <Rd>, <Rn>, <Rm>
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rd := (hw & bits2_0)
-		out.text = fmt.Sprintf("ADDS %v, %v, %v", reg(rd), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_8 == 0b0100_0100_0000_0000 { // ADD <Rdn>, <Rm>
-		DN := (hw & bit7) >> 4
-		rdn := hw & bits2_0
-		d := DN | rdn
-		rm := (hw & bits6_3) >> 3
-		out.text = fmt.Sprintf("ADD %v, %v", reg(d), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b1010_1000_0000_0000 { // ADD <Rd>, SP, #<imm8>
-		rd := (hw & bits10_8) >> 8
-		imm8 := (hw & bits7_0) << 2
-		out.text = fmt.Sprintf("ADD %v, SP, #%02X", reg(rd), imm8)
-	}
-
-	if hw&bits15_7 == 0b1011_0000_0000_0000 { // ADD SP, SP, #<imm7>
-		imm7 := (hw & bits6_0) << 2
-		out.text = fmt.Sprintf("ADD SP, SP, #%02X", imm7)
-	}
-
-	if hw&(bits15_8|bits6_3) == 0b0100_0100_0110_1000 { // ADD <Rdm>, SP, <Rdm>
-		DM := (hw & bit7) >> 4
-		Rdm := (hw & bits2_0)
-		d := DM | Rdm
-		out.text = fmt.Sprintf("ADD %v, SP, %v", d, d)
-	}
-
-	if hw&(bits15_7|bits2_0) == 0b0100_0100_1000_0101 { // ADD SP, <rm>
-		rm := (hw & bits6_3) >> 3
-		out.text = fmt.Sprintf("ADD SP, %v", reg(rm))
-	}
-
-	if hw&bits15_11 == 0b1010_0000_0000_0000 { // ADR <Rd>, PC, #<const>
-		rd := (hw & bits10_8) >> 8
-		imm8 := (hw & bits7_0) << 2
-		out.text = fmt.Sprintf("ADR %v, PC, #%02X", reg(rd), imm8)
-	}
-
-	if hw&bits15_6 == 0b0100_0000_0000_0000 { // ANDS <Rdn>, <Rm>
-		rdn := hw & bits2_0
-		rm := (hw & bits5_3) >> 3
-		out.text = fmt.Sprintf("ANDS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b0001_0000_0000_0000 { // ASRS <Rd>, <Rm>, #<imm5>
-		rm := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		imm5 := (hw & bits10_6) >> 6
-
-		shift_n := imm5
-		if imm5 == 0b00000 {
-			shift_n = 32
-		}
-		out.text = fmt.Sprintf("ASRS %v, %v, #%02X", reg(rd), reg(rm), shift_n)
-	}
-
-	if hw&bits15_6 == 0b0100_0001_0000_0000 { // ASRS <Rdn>, <Rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := hw & bits2_0
-		out.text = fmt.Sprintf("ASRS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_12 == 0b1101_0000_0000_0000 { // B<c> <label>
-		c := uint8((hw & bits11_8) >> 8)
-		imm8 := hw & bits7_0
-		if c == 0b1110 {
-			out.text = fmt.Sprintf("UDF #%02X", imm8)
-		} else if c == 0b1111 {
-			out.text = fmt.Sprintf("SVC #%02X", imm8)
-		} else {
-			offset := int32(int8(imm8)) << 1
-			out.text = fmt.Sprintf("B%v [PC, #%02X]", cond(c), offset)
-		}
-	}
-
-	if hw&bits15_11 == 0b1110_0000_0000_0000 { // b <label>
-		imm11 := hw & bits10_0
-		imm32 := int32(int16(imm11<<5) >> 4)
-		out.text = fmt.Sprintf("B [PC, #%02X]", imm32)
-	}
-
-	if hw&bits15_6 == 0b0100_0011_1000_0000 { // BICS <rdn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := hw & bits2_0
-		out.text = fmt.Sprintf("BICS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_8 == 0b1011_1110_0000_0000 { // BKPT #<imm8>
-		imm8 := hw & bits7_0
-		out.text = fmt.Sprintf("BKPT #%02X", imm8)
-	}
-
-	if hw&(bits15_7|bits2_0) == 0b0100_0111_1000_0000 { // BLX <rm>
-		rm := (hw & bits6_3) >> 3
-		out.text = fmt.Sprintf("BLX %v", reg(rm))
-	}
-
-	if hw&(bits15_7|bits2_0) == 0b0100_0111_0000_0000 { // BX <rm>
-		rm := (hw & bits6_3) >> 3
-		out.text = fmt.Sprintf("BX %v", reg(rm))
-	}
-
-	if hw&bits15_6 == 0b0100_0010_1100_0000 { // CMN <rn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rn := (hw & bits2_0)
-		out.text = fmt.Sprintf("CMN %v, %v", reg(rn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b0010_1000_0000_0000 { // CMP <rn>, #<imm8>
-		rn := (hw & bits10_8) >> 8
-		imm8 := (hw & bits7_0)
-		out.text = fmt.Sprintf("CMP %v, #%02X", reg(rn), imm8)
-	}
-
-	if hw&bits15_6 == 0b0100_0010_1000_0000 { // CMP <rn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rn := hw & bits2_0
-		out.text = fmt.Sprintf("CMP %v, %v", reg(rn), reg(rm))
-	}
-
-	if hw&bits15_8 == 0b0100_0101_0000_0000 { // CMP <rn>, <rm>
-		N := (hw & bit7) >> 4
-		rn := hw & bits2_0
-		n := N | rn
-		rm := (hw & bits6_3) >> 3
-		out.text = fmt.Sprintf("CMP %v, %v", reg(n), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b0100_0000_0100_0000 { // EORS <rdn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := hw & bits2_0
-		out.text = fmt.Sprintf("EORS %v, %v", reg(rdn), reg(rm))
-	}
-	if hw&bits15_11 == 0b1100_1000_0000_0000 { // LDM <rn>, <registers>
-		rn := (hw & bits10_8) >> 8
-		list := (hw & bits7_0)
-		out.text = fmt.Sprintf("LDM %v, %v", reg(rn), reglist(list))
-	}
-
-	if hw&bits15_11 == 0b0110_1000_0000_0000 { // LDR <rt>, [<rn>, #<imm5>]
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-		imm5 := (hw & bits10_6) >> 4
-		out.text = fmt.Sprintf("LDR %v, [%v, #%02X]", reg(rt), reg(rn), imm5)
-	}
-
-	if hw&bits15_11 == 0b1001_1000_0000_0000 { // LDR <Rt>, [SP, #imm8]
-		rt := (hw & bits10_8) >> 8
-		imm8 := (hw & bits7_0) << 2
-		out.text = fmt.Sprintf("LDR %v, [SP, #%02X]", reg(rt), imm8)
-	}
-
-	if hw&bits15_11 == 0b0100_1000_0000_0000 { // LDR <rt>, <label>
-		rt := (hw & bits10_8) >> 8
-		imm8 := hw & bits7_0 << 2
-		out.text = fmt.Sprintf("LDR %v, [PC, #%02X]", reg(rt), imm8)
-	}
-
-	if hw&bits15_9 == 0b0101_1000_0000_0000 { // LDR <rt>, [<rn, <rm>]
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-		out.text = fmt.Sprintf("LDR %v, [%v, %v]", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b0111_1000_0000_0000 { // LDRB <rt>, [<rn>, #<imm5>]
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-		imm5 := (hw & bits10_6) >> 6
-
-		out.text = fmt.Sprintf("LDRB %v, [%v, #%02X]", reg(rt), reg(rn), imm5)
-	}
-
-	if hw&bits15_9 == 0b0101_1100_0000_0000 { // LDRB <rt>, [<rn>, <rm>]
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("LDRB %v, [%v, %v]", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b1000_1000_0000_0000 { // LDRH <rt>, [<rn>, #<imm5>]
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-		imm5 := (hw & bits10_6) >> 5
-
-		out.text = fmt.Sprintf("LDRH %v, [%v, #%02X]", reg(rt), reg(rn), imm5)
-	}
-
-	if hw&bits15_9 == 0b0101_1010_0000_0000 { // LDRH <rt>, [<rn>, <rm>]
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("LDRH %v, [%v, %v]", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_9 == 0b0101_0110_0000_0000 { // LDRSB <rt>, [<rn>, <rm>]
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("LDRSB %v, [%v, %v]", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_9 == 0b0101_1110_0000_0000 { // LDRSH <rt>, [<rn>, <rm>]
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("LDRSH %v, [%v, %v]", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b0000_0000_0000_0000 { // LSLS <rd>, <rm>, #<imm5>
-		rm := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		imm5 := (hw & bits10_6) >> 6
-
-		if imm5 == 0b00000 { // MOV
-			out.text = fmt.Sprintf("MOV %v, %v", reg(rd), reg(rm))
-		} else {
-			out.text = fmt.Sprintf("LSLS %v, %v, #%02X", reg(rd), reg(rm), imm5)
-		}
-	}
-
-	if hw&bits15_6 == 0b0100_0000_1000_0000 { // LSLS <rdn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := hw & bits2_0
-		out.text = fmt.Sprintf("LSLS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b0000_1000_0000_0000 { // LSRS <rd>, <rm>, #<imm5>
-		rm := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		imm5 := (hw & bits10_6) >> 6
-		shift_n := imm5
-		if imm5 == 0 {
-			shift_n = 32
-		}
-		out.text = fmt.Sprintf("LSRS %v, %v, #%02X", reg(rd), reg(rm), shift_n)
-	}
-
-	if hw&bits15_6 == 0b0100_0000_1100_0000 { // LSRS <rdn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := hw & bits2_0
-		out.text = fmt.Sprintf("LSRS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b0010_0000_0000_0000 { // MOVS <rd>, #<imm8>
-		rd := (hw & bits10_8) >> 8
-		imm8 := hw & bits7_0
-		out.text = fmt.Sprintf("MOV %v, #%02X", reg(rd), imm8)
-	}
-
-	if hw&bits15_8 == 0b0100_0110_0000_0000 { // MOV <rd>, <rm>
-		D := (hw & bit7) >> 4
-		rd := (hw & bits2_0)
-		d := D | rd
-
-		rm := (hw & bits6_3) >> 3
-		out.text = fmt.Sprintf("MOV %v, %v", reg(d), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b0100_0011_0100_0000 { // MULS <rdm>, <rn>, <rdm>
-		rn := (hw & bits5_3) >> 3
-		rdm := hw & bits2_0
-		out.text = fmt.Sprintf("MULS %v, %v, %v", reg(rdm), reg(rn), reg(rdm))
-	}
-
-	if hw&bits15_6 == 0b0100_0011_1100_0000 { // MVN <rd>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("MVNS %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b0100_0010_0100_0000 { // NEGS <rd>, <rm>
-		rn := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("NEGS %v, %v", reg(rd), reg(rn))
-	}
-
-	if hw&bits15_6 == 0b0100_0011_0000_0000 { // ORRS <rdn>, <rm>
-		rdn := hw & bits2_0
-		rm := (hw & bits5_3) >> 3
-		out.text = fmt.Sprintf("ORRS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_9 == 0b1011_1100_0000_0000 { // POP <registers>
-		P := (hw & bit8) << 7
-		list := P | (hw & bits7_0)
-		out.text = fmt.Sprintf("POP %v", reglist(list))
-	}
-
-	if hw&bits15_9 == 0b1011_0100_0000_0000 { // PUSH <registers>
-		M := (hw & bit8) << 6
-		list := M | (hw & bits7_0)
-		out.text = fmt.Sprintf("PUSH %v", reglist(list))
-	}
-
-	if hw&bits15_6 == 0b1011_1010_0000_0000 { // REV <rd>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rd := (hw & bits2_0)
-		out.text = fmt.Sprintf("REV %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b1011_1010_0100_0000 { // REV16 <rd>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rd := (hw & bits2_0)
-		out.text = fmt.Sprintf("REV16 %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b1011_1010_1100_0000 { // REVSH <rd>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rd := (hw & bits2_0)
-		out.text = fmt.Sprintf("REVSH %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b0100_0001_1100_0000 { // RORS <rdn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := (hw & bits2_0)
-		out.text = fmt.Sprintf("RORS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b0100_0001_1000_0000 { // SBCS <rdn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rdn := (hw & bits2_0)
-		out.text = fmt.Sprintf("SBCS %v, %v", reg(rdn), reg(rm))
-	}
-
-	if hw == 0b1011_1111_0100_0000 { // SEV
-		out.text = "SEV"
-	}
-
-	if hw&bits15_11 == 0b1100_0000_0000_0000 { // STM <rn>!, <registers>
-		rn := (hw & bits10_8) >> 8
-		list := hw & bits7_0
-		out.text = fmt.Sprintf("STM %v, %v", reg(rn), reglist(list))
-	}
-
-	if hw&bits15_11 == 0b0110_0000_0000_0000 { // STR <rt>, [<rn>, #<imm5>]
-		imm5 := (hw & bits10_6) >> 4
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-		out.text = fmt.Sprintf("STR %v, [%v, #%02X]", reg(rt), reg(rn), imm5)
-	}
-
-	if hw&bits15_11 == 0b1001_0000_0000_0000 { // STR <rt>, [SP, #<imm8>]
-		rt := (hw & bits10_8) >> 8
-		imm8 := (hw & bits7_0) << 2
-		out.text = fmt.Sprintf("STR %v, [SP, #%02X]", reg(rt), imm8)
-	}
-
-	if hw&bits15_9 == 0b0101_0000_0000_0000 { // STR <rt>, <rn>, <rm>
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("STR %v, %v, %v", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b0111_0000_0000_0000 { // STRB <rt>, [<rn>, #<imm5>]
-		imm5 := (hw & bits10_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("STRB %v, [%v, #%02X]", reg(rt), reg(rn), imm5)
-	}
-
-	if hw&bits15_9 == 0b0101_0100_0000_0000 { // STRB <rt>, [<rn>, <rm>]
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("STRB %v, [%v, %v]", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_11 == 0b1000_0000_0000_0000 { // STRH <rt>, [<rn>, #<imm5>]
-		imm5 := (hw & bits10_6) >> 5
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("STRH %v, [%v, #%02X]", reg(rt), reg(rn), imm5)
-	}
-
-	if hw&bits15_9 == 0b0101_0010_0000_0000 { // STRH <rt>, [<rn>, <rm>]
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rt := hw & bits2_0
-
-		out.text = fmt.Sprintf("STRH %v, [%v, %v]", reg(rt), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_9 == 0b0001_1110_0000_0000 { // SUBS <rd>, <rn>, #<imm3>
-		imm3 := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-
-		out.text = fmt.Sprintf("SUBS %v, %v, #%02X", reg(rd), reg(rn), imm3)
-	}
-
-	if hw&bits15_11 == 0b0011_1000_0000_0000 { // SUBS <rdn>, #<imm8>
-		imm8 := hw & bits7_0
-		rdn := (hw & bits10_8) >> 8
-
-		out.text = fmt.Sprintf("SUBS %v, #%02X", reg(rdn), imm8)
-	}
-
-	if hw&bits15_9 == 0b0001_1010_0000_0000 { // SUBS <rd>, <rn>, <rm>
-		rm := (hw & bits8_6) >> 6
-		rn := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("SUBS %v, %v, %v", reg(rd), reg(rn), reg(rm))
-	}
-
-	if hw&bits15_7 == 0b1011_0000_1000_0000 { // SUB SP, SP, #<imm7>
-		imm7 := hw & bits6_0
-		out.text = fmt.Sprintf("SUB SP, SP, #%02X", imm7)
-	}
-
-	if hw&bits15_6 == 0b1011_0010_0100_0000 { // SXTB <rd>, <rm>
-		rm := hw & bits5_3 >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("SXTB %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b1011_0010_0000_0000 { // SXTH <rd>, <rm
-		rm := hw & bits5_3 >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("SXTH %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b0100_0010_0000_0000 { // TST <rn>, <rm>
-		rm := (hw & bits5_3) >> 3
-		rn := hw & bits2_0
-		out.text = fmt.Sprintf("TST %v, %v", reg(rn), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b1011_0010_1100_0000 { // UXTB <rd> , <rm>
-		rm := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("UTXB %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw&bits15_6 == 0b1011_0010_1000_0000 { // UXTH <rd> , <rm>
-		rm := (hw & bits5_3) >> 3
-		rd := hw & bits2_0
-		out.text = fmt.Sprintf("UTXH %v, %v", reg(rd), reg(rm))
-	}
-
-	if hw == 0b1011_1111_0010_0000 { // WFE
-		out.text = "WFE"
-	}
-
-	if hw == 0b1011_1111_0011_0000 { // WFI
-		out.text = "WFI"
-	}
-
-	if hw == 0b1011_1111_0001_0000 { // YIELD
-		out.text = "YIELD"
-	}
-
-	if hw&bits15_11 == 0b1111_0000_0000_0000 { // 32 bit instruction
-		hw2, ok := rb.getU16()
-		if !ok {
-			out.text = fmt.Sprintf("32 bit instruction")
-			return false
-		}
-
-		first := uint8((hw2 >> 8) & 0xFF)
-		last := uint8(hw2 & 0xFF)
-
-		out.chunk = append([]byte{first, last}, out.chunk...)
-		out.size += 2
-		out.text = fmt.Sprintf("32 bit instruction")
-		if hw2&(bits15_14|bit12) == 0b1101_0000_0000_0000 { // BL <label>
-			imm10 := uint32(hw & bits9_0)
-			S := (hw & bit10) >> 10
-
-			imm11 := uint32(hw2 & bits10_0)
-			J1 := (hw2 & bit13) >> 13
-			J2 := (hw2 & bit11) >> 11
-
-			I1 := uint32(^(J1 ^ S)) // why??
-			I2 := uint32(^(J2 ^ S))
-
-			u24 := (uint32(S) << 23) | (I1 << 22) | (I2 << 21) | (imm10 << 11) | imm11
-			i32 := int32(u24<<8) >> 8
-
-			imm32 := i32 << 1
-
-			out.text = fmt.Sprintf("BL [PC, #%04X]", imm32)
-		}
-
-		if hw == 0b1111_0011_1011_1111 { // DMB / DSB
-			if hw2&bits15_4 == 0b1000_1111_0101_0000 {
-				out.text = "DMB"
-			} else if hw2&bits15_4 == 0b1000_1111_0100_0000 {
-				out.text = "DSB"
-			} else if hw2&bits15_4 == 0b1000_1111_0110_0000 {
-				out.text = "ISB"
-			} else {
-				out.text = "!!!"
-			}
-		}
-
-		if hw == 0b1111_0011_1110_1111 { // MRS <rd>, <spec_reg>
-			if hw2&bits15_12 == 0b1000_0000_0000_0000 {
-				rd := (hw2 & bits15_12) >> 12
-				SYSm := uint8(hw2 & bits7_0)
-				out.text = fmt.Sprintf("MRS %v, <%08b>", reg(rd), SYSm)
-			} else {
-				out.text = "!!!"
-			}
-		}
-
-		if hw&bits15_4 == 0b1111_0011_1000_0000 { // MSR <spec_reg>, <rn>
-			if hw2&bits15_8 == 0b1000_1000_0000_0000 {
-				rn := hw & bits3_0
-				SYSm := uint8(hw & bits7_0)
-				out.text = fmt.Sprintf("MSR <%08b>, %v", SYSm, reg(rn))
-			} else {
-				out.text = "!!!"
-			}
-		}
-	}
-
-	return true
-}
-
 func reglist(hw uint16) string {
 	out := "{"
 	var mask uint16 = 1
@@ -839,21 +1030,26 @@ func reg(r uint16) string {
 	return fmt.Sprintf("r%v", r)
 }
 
-func readChunk(rb *ReadBuffer) *uf2block {
-	if rb.len() < 512 {
-		return nil
+// readChunk parses the block at the start of rb, if the block is
+// invalid rb is left untouched
+func readChunk(rb *ReadBuffer) (*uf2block, *uf2Error) {
+	start := rb.start
+	if rb.len() < uf2BlockSize {
+		return nil, &uf2Error{offset: start, field: "block size", found: uint32(rb.len()), expected: uf2BlockSize}
+	}
+	fail := func(offset int, field string, found, expected uint32) (*uf2block, *uf2Error) {
+		rb.start = start
+		return nil, &uf2Error{offset: start + offset, field: field, found: found, expected: expected}
 	}
 	magic1, _ := rb.getU32()
-	if magic1 != 0x0A324655 {
-		fmt.Printf("ERROR: first magic number is wrong, found: 0x%X, expected: 0x0A324655\n", magic1)
-		return nil
+	if magic1 != uf2Magic1 {
+		return fail(uf2OffMagic1, "first magic", magic1, uf2Magic1)
 	}
 	magic2, _ := rb.getU32()
-	if magic2 != 0x9E5D5157 {
-		fmt.Printf("ERROR: second magic number is wrong, found: 0x%X, expected: 0x9E5D5157\n", magic2)
-		return nil
+	if magic2 != uf2Magic2 {
+		return fail(uf2OffMagic2, "second magic", magic2, uf2Magic2)
 	}
-	block := uf2block{}
+	block := uf2block{offset: start}
 
 	// we can safely ignore the second return because we checked for
 	// the size of the whole block
@@ -865,17 +1061,30 @@ func readChunk(rb *ReadBuffer) *uf2block {
 	block.totBlockNum, _ = rb.getU32()
 	block.something, _ = rb.getU32()
 
-	block.payload = rb.data[rb.start : rb.start+int(block.payloadSize)]
+	if block.payloadSize > uf2DataSize {
+		return fail(uf2OffPayloadSize, "payload size", block.payloadSize, uf2DataSize)
+	}
+	data := rb.data[rb.start : rb.start+uf2DataSize]
+	// capped, so that appending to the payload never overwrites the block
+	block.payload = data[:block.payloadSize:block.payloadSize]
+	if block.flags.FileContainer {
+		block.fileName = parseFileName(data, block.payloadSize)
+	}
+	if block.flags.ChecksumPresent {
+		block.checksum = parseChecksum(data)
+	}
+	if block.flags.ExtensionTagsPresent {
+		block.tags = parseTags(data, tagsStart(&block), block.flags.ChecksumPresent)
+	}
 
-	rb.start += 476
+	rb.start += uf2DataSize
 
 	magic3, _ := rb.getU32()
-	if magic3 != 0x0AB16F30 {
-		fmt.Printf("ERROR: final magic number is wrong, found: 0x%X, expected: 0x0AB16F30\n", magic3)
-		return nil
+	if magic3 != uf2MagicFinal {
+		return fail(uf2OffMagicFinal, "final magic", magic3, uf2MagicFinal)
 	}
 
-	return &block
+	return &block, nil
 }
 
 type uf2flags struct {
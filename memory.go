@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+)
+
+// bus is the address space seen by the cpu. Accesses are 1, 2 or 4
+// bytes, little endian and aligned to their size
+type bus interface {
+	read(addr uint32, size uint32) (uint32, error)
+	write(addr uint32, size uint32, value uint32) error
+}
+
+const pageSize = 4096
+
+// sparseMemory is a flat 4GB address space where only the pages that
+// hold data exist, reading anywhere else returns zero
+type sparseMemory struct {
+	pages map[uint32][]byte
+}
+
+func newSparseMemory(maps []*memoryMap) *sparseMemory {
+	out := &sparseMemory{pages: map[uint32][]byte{}}
+	for _, m := range maps {
+		for i, b := range m.contents {
+			out.page(m.addr + uint32(i))[(m.addr+uint32(i))%pageSize] = b
+		}
+	}
+	return out
+}
+
+// page returns the page that holds addr, creating it if needed
+func (this *sparseMemory) page(addr uint32) []byte {
+	base := addr &^ (pageSize - 1)
+	p, ok := this.pages[base]
+	if !ok {
+		p = make([]byte, pageSize)
+		this.pages[base] = p
+	}
+	return p
+}
+
+func (this *sparseMemory) read(addr uint32, size uint32) (uint32, error) {
+	p, ok := this.pages[addr&^(pageSize-1)]
+	if !ok {
+		return 0, nil
+	}
+	return readLE(p[addr%pageSize:], size), nil
+}
+
+func (this *sparseMemory) write(addr uint32, size uint32, value uint32) error {
+	writeLE(this.page(addr)[addr%pageSize:], size, value)
+	return nil
+}
+
+func readLE(b []byte, size uint32) uint32 {
+	out := uint32(0)
+	for i := int(size) - 1; i >= 0; i-- {
+		out = out<<8 | uint32(b[i])
+	}
+	return out
+}
+
+func writeLE(b []byte, size uint32, value uint32) {
+	for i := uint32(0); i < size; i++ {
+		b[i] = byte(value >> (i * 8))
+	}
+}
+
+// busError is an access the bus can not complete
+type busError struct {
+	addr  uint32
+	size  uint32
+	write bool
+	msg   string
+}
+
+func (this *busError) Error() string {
+	access := "read"
+	if this.write {
+		access = "write"
+	}
+	return fmt.Sprintf("%v of %v bytes at 0x%08X: %v", access, this.size, this.addr, this.msg)
+}
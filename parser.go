@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type module struct {
+	consts   []*constDef
+	sections []*sectionNode
+}
+
+type constDef struct {
+	name  string
+	value int64
+	line  int
+}
+
+type sectionNode struct {
+	name  string
+	addr  uint32
+	stmts []*statement
+	line  int
+}
+
+type stmtKind int
+
+const (
+	stLabel stmtKind = iota
+	stInstr
+	stMem
+)
+
+type statement struct {
+	kind stmtKind
+	line int
+
+	// stLabel
+	label string
+
+	// stInstr
+	mnemonic string
+	operands []*operand
+
+	// stMem, either a single value of memSize bytes or a string
+	value   *operand
+	memSize uint32
+	str     []byte
+}
+
+type opKind int
+
+const (
+	opReg opKind = iota
+	opExpr
+	opAddr
+	opRegList
+	opSugar
+)
+
+type operand struct {
+	kind opKind
+	line int
+
+	// opReg
+	reg       uint16
+	writeback bool
+
+	// opExpr: name + value, name is empty for plain numbers,
+	// hash tells if the expression was written with a '#'
+	name  string
+	value int64
+	hash  bool
+
+	// opRegList
+	list uint16
+
+	// opAddr holds the terms, opSugar holds a single expression
+	terms []*operand
+}
+
+func (this *operand) String() string {
+	switch this.kind {
+	case opReg:
+		return reg(this.reg)
+	case opExpr:
+		if this.name == "" {
+			return fmt.Sprintf("%v", this.value)
+		}
+		if this.value != 0 {
+			return fmt.Sprintf("%v%+d", this.name, this.value)
+		}
+		return this.name
+	case opAddr:
+		terms := []string{}
+		for _, t := range this.terms {
+			terms = append(terms, t.String())
+		}
+		return "[" + strings.Join(terms, ", ") + "]"
+	case opRegList:
+		return reglist(this.list)
+	case opSugar:
+		return "=" + this.terms[0].String()
+	}
+	return "???"
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parse(src string) (*module, error) {
+	tokens, err := newLexer(src).all()
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	return p.module()
+}
+
+func (this *parser) peek() token {
+	return this.tokens[this.pos]
+}
+
+func (this *parser) peekNext() token {
+	if this.pos+1 >= len(this.tokens) {
+		return this.tokens[len(this.tokens)-1]
+	}
+	return this.tokens[this.pos+1]
+}
+
+func (this *parser) consume() token {
+	tk := this.tokens[this.pos]
+	if tk.kind != tkEOF {
+		this.pos++
+	}
+	return tk
+}
+
+func (this *parser) is(kind tkKind) bool {
+	return this.peek().kind == kind
+}
+
+func (this *parser) expect(kind tkKind) (token, error) {
+	tk := this.peek()
+	if tk.kind != kind {
+		return tk, lineErr(tk.line, "expected %v, found %v", kind, tk)
+	}
+	return this.consume(), nil
+}
+
+func (this *parser) expectKeyword(word string) error {
+	tk := this.peek()
+	if tk.kind != tkId || tk.text != word {
+		return lineErr(tk.line, "expected '%v', found %v", word, tk)
+	}
+	this.consume()
+	return nil
+}
+
+func (this *parser) skipNL() {
+	for this.is(tkNL) {
+		this.consume()
+	}
+}
+
+func (this *parser) endOfStatement() error {
+	if this.is(tkEOF) {
+		return nil
+	}
+	_, err := this.expect(tkNL)
+	return err
+}
+
+// Module = {Const {NL}} {Section}.
+func (this *parser) module() (*module, error) {
+	out := &module{}
+	this.skipNL()
+	for this.is(tkId) && this.peekNext().kind == tkEquals {
+		c, err := this.constDef()
+		if err != nil {
+			return nil, err
+		}
+		out.consts = append(out.consts, c)
+		this.skipNL()
+	}
+	for !this.is(tkEOF) {
+		s, err := this.section()
+		if err != nil {
+			return nil, err
+		}
+		out.sections = append(out.sections, s)
+	}
+	return out, nil
+}
+
+// Const = id '=' num.
+func (this *parser) constDef() (*constDef, error) {
+	name := this.consume()
+	this.consume() // =
+	neg := false
+	if this.is(tkMinus) {
+		this.consume()
+		neg = true
+	}
+	num, err := this.expect(tkNum)
+	if err != nil {
+		return nil, err
+	}
+	value := num.value
+	if neg {
+		value = -value
+	}
+	if err := this.endOfStatement(); err != nil {
+		return nil, err
+	}
+	return &constDef{name: name.text, value: value, line: name.line}, nil
+}
+
+// Section = SectionHeader {NL} Code.
+// SectionHeader = 'section' id 'at' num ':'.
+func (this *parser) section() (*sectionNode, error) {
+	line := this.peek().line
+	if err := this.expectKeyword("section"); err != nil {
+		return nil, err
+	}
+	name, err := this.expect(tkId)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.expectKeyword("at"); err != nil {
+		return nil, err
+	}
+	addr, err := this.expect(tkNum)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := this.expect(tkColon); err != nil {
+		return nil, err
+	}
+	out := &sectionNode{
+		name: name.text,
+		addr: uint32(addr.value),
+		line: line,
+	}
+	this.skipNL()
+	for !this.is(tkEOF) {
+		if this.is(tkId) && this.peek().text == "section" {
+			break
+		}
+		if this.is(tkNL) {
+			this.consume()
+			continue
+		}
+		stmt, err := this.statement()
+		if err != nil {
+			return nil, err
+		}
+		out.stmts = append(out.stmts, stmt)
+	}
+	return out, nil
+}
+
+// Statement = (DefLabel | Instr | Mem) NL.
+func (this *parser) statement() (*statement, error) {
+	tk := this.peek()
+	var out *statement
+	var err error
+	switch {
+	case tk.kind == tkId && this.peekNext().kind == tkColon:
+		this.consume()
+		this.consume()
+		// labels do not need to be on their own line
+		return &statement{kind: stLabel, line: tk.line, label: tk.text}, nil
+	case tk.kind == tkId:
+		out, err = this.instr()
+	case tk.kind == tkDollar || tk.kind == tkStr:
+		out, err = this.mem()
+	default:
+		return nil, lineErr(tk.line, "expected statement, found %v", tk)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := this.endOfStatement(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Mem = '$' Term size | str.
+func (this *parser) mem() (*statement, error) {
+	tk := this.consume()
+	out := &statement{kind: stMem, line: tk.line}
+	if tk.kind == tkStr {
+		out.str = []byte(tk.text)
+		return out, nil
+	}
+	value, err := this.term()
+	if err != nil {
+		return nil, err
+	}
+	if value.kind != opExpr {
+		return nil, lineErr(tk.line, "expected a value, found %v", value)
+	}
+	size, err := this.expect(tkId)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(size.text) {
+	case "w", "word":
+		out.memSize = 4
+	case "hw", "halfword":
+		out.memSize = 2
+	case "b", "byte":
+		out.memSize = 1
+	default:
+		return nil, lineErr(size.line, "invalid size '%v'", size.text)
+	}
+	out.value = value
+	return out, nil
+}
+
+// Instr = Operator [OperandList].
+// OperandList = Operand {',' Operand}.
+func (this *parser) instr() (*statement, error) {
+	op := this.consume()
+	out := &statement{
+		kind:     stInstr,
+		line:     op.line,
+		mnemonic: strings.ToUpper(op.text),
+	}
+	if this.is(tkNL) || this.is(tkEOF) {
+		return out, nil
+	}
+	for {
+		operand, err := this.operand()
+		if err != nil {
+			return nil, err
+		}
+		out.operands = append(out.operands, operand)
+		if !this.is(tkComma) {
+			break
+		}
+		this.consume()
+	}
+	return out, nil
+}
+
+// Operand = Term | Addr | RegList | Sugar.
+func (this *parser) operand() (*operand, error) {
+	tk := this.peek()
+	switch tk.kind {
+	case tkLBrack:
+		return this.addr()
+	case tkLBrace:
+		return this.regList()
+	case tkEquals:
+		this.consume()
+		t, err := this.term()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind != opExpr {
+			return nil, lineErr(tk.line, "expected a value after '=', found %v", t)
+		}
+		return &operand{kind: opSugar, line: tk.line, terms: []*operand{t}}, nil
+	}
+	return this.term()
+}
+
+// Addr = '[' TermList ']'.
+// TermList = Term {',' Term}.
+func (this *parser) addr() (*operand, error) {
+	open := this.consume()
+	out := &operand{kind: opAddr, line: open.line}
+	for {
+		t, err := this.term()
+		if err != nil {
+			return nil, err
+		}
+		out.terms = append(out.terms, t)
+		if !this.is(tkComma) {
+			break
+		}
+		this.consume()
+	}
+	if _, err := this.expect(tkRBrack); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RegList = '{' reg {',' reg} '}'.
+func (this *parser) regList() (*operand, error) {
+	open := this.consume()
+	out := &operand{kind: opRegList, line: open.line}
+	for {
+		r, err := this.expect(tkReg)
+		if err != nil {
+			return nil, err
+		}
+		bit := uint16(1) << r.value
+		if out.list&bit != 0 {
+			return nil, lineErr(r.line, "register %v appears twice in list", r.text)
+		}
+		out.list |= bit
+		if !this.is(tkComma) {
+			break
+		}
+		this.consume()
+	}
+	if _, err := this.expect(tkRBrace); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Term = reg ['!'] | ['#'] ['+'|'-'] (num | id) {('+'|'-') num}.
+func (this *parser) term() (*operand, error) {
+	tk := this.peek()
+	if tk.kind == tkReg {
+		this.consume()
+		out := &operand{kind: opReg, line: tk.line, reg: uint16(tk.value)}
+		if this.is(tkBang) {
+			this.consume()
+			out.writeback = true
+		}
+		return out, nil
+	}
+	out := &operand{kind: opExpr, line: tk.line}
+	if this.is(tkHash) {
+		this.consume()
+		out.hash = true
+	}
+	sign := int64(1)
+	if this.is(tkPlus) {
+		this.consume()
+	} else if this.is(tkMinus) {
+		this.consume()
+		sign = -1
+	}
+	tk = this.consume()
+	switch tk.kind {
+	case tkNum:
+		out.value = sign * tk.value
+	case tkId:
+		if sign < 0 {
+			return nil, lineErr(tk.line, "symbols can not be negated")
+		}
+		out.name = tk.text
+	default:
+		return nil, lineErr(tk.line, "expected a term, found %v", tk)
+	}
+	for this.is(tkPlus) || this.is(tkMinus) {
+		op := this.consume()
+		num, err := this.expect(tkNum)
+		if err != nil {
+			return nil, err
+		}
+		if op.kind == tkPlus {
+			out.value += num.value
+		} else {
+			out.value -= num.value
+		}
+	}
+	return out, nil
+}
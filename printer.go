@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type printer struct {
+	// memory used to show the values of literal loads
+	maps []*memoryMap
+	// names used in place of target addresses
+	labels map[uint32]string
+	// used to describe addresses without a label, may be nil
+	symbols *symbolTable
+	// all the loaded memory, only the addresses inside it are described
+	regions []*memoryMap
+}
+
+func (this *printer) word(addr uint32) (uint32, bool) {
+	return wordAt(this.maps, addr)
+}
+
+// describe names a literal value, function pointers have the Thumb bit set
+func (this *printer) describe(v uint32) (string, bool) {
+	if name, ok := this.symbols.describe(v, this.regions); ok {
+		return name, true
+	}
+	if v&1 != 0 {
+		return this.symbols.describe(v&^1, this.regions)
+	}
+	return "", false
+}
+
+// format renders a decoded instruction
+func (this *printer) format(in *instr) string {
+	if isData(in.op) {
+		return formatData(in)
+	}
+	mnemonic := in.op.String()
+	args := []string{}
+	for _, a := range in.args {
+		if a.kind == argCond {
+			mnemonic += cond(uint8(a.value))
+			continue
+		}
+		args = append(args, this.formatArg(in, a))
+	}
+	if in.op == mnCPSIE || in.op == mnCPSID {
+		args = append(args, "i")
+	}
+	out := mnemonic
+	if len(args) > 0 {
+		out += " " + strings.Join(args, ", ")
+	}
+	if in.op == mnLDR && in.args[1].kind == argTarget {
+		if v, ok := this.word(in.target(in.args[1])); ok {
+			out += fmt.Sprintf("\t; =0x%08X", v)
+			if name, ok := this.describe(v); ok {
+				out += " <" + name + ">"
+			}
+		}
+	}
+	return out
+}
+
+func (this *printer) formatArg(in *instr, a arg) string {
+	switch a.kind {
+	case argReg:
+		if a.writeback {
+			return reg(a.reg) + "!"
+		}
+		return reg(a.reg)
+	case argRegList:
+		return reglist(a.list)
+	case argImm:
+		return fmt.Sprintf("#%02X", a.value)
+	case argTarget:
+		target := in.target(a)
+		if label, ok := this.labels[target]; ok {
+			return label
+		}
+		if name, ok := this.symbols.describe(target, this.regions); ok {
+			return fmt.Sprintf("0x%08X <%v>", target, name)
+		}
+		return fmt.Sprintf("0x%08X", target)
+	case argSysReg:
+		if name, ok := specialRegName(uint16(a.value)); ok {
+			return name
+		}
+		return fmt.Sprintf("<%08b>", a.value)
+	case argBarrier:
+		if name, ok := barrierNames[uint16(a.value)]; ok {
+			return name
+		}
+		return fmt.Sprintf("#%02X", a.value)
+	case argMem:
+		if a.hasIndex {
+			return fmt.Sprintf("[%v, %v]", reg(a.reg), reg(a.index))
+		}
+		return fmt.Sprintf("[%v, #%02X]", reg(a.reg), a.value)
+	}
+	return "!!!"
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// cycles estimates the Cortex-M0+ cycles of an instruction, with zero
+// wait state memory and the single cycle multiplier of the RP2040
+func cycles(in *instr, branched bool) uint64 {
+	switch in.op {
+	case mnB:
+		if branched {
+			return 2
+		}
+		return 1
+	case mnBL:
+		return 3
+	case mnBX, mnBLX:
+		return 2
+	case mnADD, mnMOV:
+		// writing the PC refills the pipeline
+		if branched {
+			return 2
+		}
+		return 1
+	case mnLDR, mnLDRB, mnLDRH, mnLDRSB, mnLDRSH, mnSTR, mnSTRB, mnSTRH:
+		return 2
+	case mnLDM, mnSTM, mnPUSH, mnPOP:
+		n := uint64(bits.OnesCount16(in.args[len(in.args)-1].list))
+		if branched {
+			return 3 + n
+		}
+		return 1 + n
+	case mnMRS, mnMSR, mnDMB, mnDSB, mnISB:
+		return 3
+	}
+	return 1
+}
+
+// profile counts the executions and cycles of every address
+type profile struct {
+	count  map[uint32]uint64
+	cycles map[uint32]uint64
+	instrs map[uint32]*instr
+}
+
+func newProfile() *profile {
+	return &profile{
+		count:  map[uint32]uint64{},
+		cycles: map[uint32]uint64{},
+		instrs: map[uint32]*instr{},
+	}
+}
+
+func (this *profile) add(in *instr, branched bool) {
+	this.count[in.addr]++
+	this.cycles[in.addr] += cycles(in, branched)
+	this.instrs[in.addr] = in
+}
+
+func (this *profile) total() (uint64, uint64) {
+	count, cycles := uint64(0), uint64(0)
+	for addr, n := range this.count {
+		count += n
+		cycles += this.cycles[addr]
+	}
+	return count, cycles
+}
+
+func percent(part, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+// byAddress lists the executed instructions in address order
+func (this *profile) byAddress(p *printer) string {
+	addrs := []uint32{}
+	for addr := range this.count {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i] < addrs[j]
+	})
+	_, total := this.total()
+	out := fmt.Sprintf("%12v %12v %6v\n", "count", "cycles", "%")
+	for _, addr := range addrs {
+		if label, ok := p.labels[addr]; ok {
+			out += label + ":\n"
+		}
+		in := this.instrs[addr]
+		out += fmt.Sprintf("%12v %12v %6.2f %08X %v\t%v\n", this.count[addr], this.cycles[addr],
+			percent(this.cycles[addr], total), addr, strchunk(in.chunk), p.format(in))
+	}
+	return out
+}
+
+// functionSymbols adds to the symbols of the image the sub_ labels of
+// the calls, where no symbol is known to cover them, so that images
+// without an ELF symbol table are split by function
+func functionSymbols(img *image) *symbolTable {
+	out := newSymbolTable()
+	for _, e := range img.symbols.entries {
+		out.add(e.name, e.addr, e.size, e.function)
+	}
+	for _, m := range img.maps {
+		for addr, label := range autoLabels(decodeAll(m)) {
+			if !strings.HasPrefix(label, "sub_") {
+				continue
+			}
+			if e, ok := img.symbols.containing(addr, img.maps); ok && (e.addr == addr || e.size != 0) {
+				continue
+			}
+			out.add(label, addr, 0, true)
+		}
+	}
+	return out
+}
+
+// byFunction sums the addresses of each symbol, the most expensive first
+func (this *profile) byFunction(symbols *symbolTable, maps []*memoryMap) string {
+	type function struct {
+		name          string
+		count, cycles uint64
+	}
+	functions := map[string]*function{}
+	for addr, n := range this.count {
+		name := "?"
+		if e, ok := symbols.containing(addr, maps); ok {
+			name = e.name
+		}
+		f, ok := functions[name]
+		if !ok {
+			f = &function{name: name}
+			functions[name] = f
+		}
+		f.count += n
+		f.cycles += this.cycles[addr]
+	}
+	sorted := []*function{}
+	for _, f := range functions {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].cycles != sorted[j].cycles {
+			return sorted[i].cycles > sorted[j].cycles
+		}
+		return sorted[i].name < sorted[j].name
+	})
+	_, total := this.total()
+	out := fmt.Sprintf("%12v %12v %6v  %v\n", "count", "cycles", "%", "function")
+	for _, f := range sorted {
+		out += fmt.Sprintf("%12v %12v %6.2f  %v\n", f.count, f.cycles, percent(f.cycles, total), f.name)
+	}
+	return out
+}
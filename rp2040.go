@@ -0,0 +1,473 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// RP2040 address space, with the memories and the few peripherals
+// programs need to print something and do arithmetic
+
+const (
+	romBase   = 0x00000000
+	romSize   = 16 << 10
+	flashBase = 0x10000000
+	// the Pico flash, seen through the 4 XIP aliases up to 0x14000000
+	flashSize    = 2 << 20
+	flashAliases = 4
+	flashWindow  = 16 << 20
+	sramBase     = 0x20000000
+	// 4 striped banks of 64K, then the two 4K scratch banks
+	sramSize  = 264 << 10
+	sioBase   = 0xD0000000
+	sioSize   = 0x180
+	uart0Base = 0x40034000
+)
+
+// peripherals is the RP2040 peripheral map, used to name the accesses
+// to what is not modelled
+var peripherals = []struct {
+	name string
+	base uint32
+	size uint32
+}{
+	{"xip_ctrl", 0x14000000, 0x4000},
+	{"xip_sram", 0x15000000, 0x4000},
+	{"xip_ssi", 0x18000000, 0x4000},
+	{"sysinfo", 0x40000000, 0x4000},
+	{"syscfg", 0x40004000, 0x4000},
+	{"clocks", 0x40008000, 0x4000},
+	{"resets", 0x4000C000, 0x4000},
+	{"psm", 0x40010000, 0x4000},
+	{"io_bank0", 0x40014000, 0x4000},
+	{"io_qspi", 0x40018000, 0x4000},
+	{"pads_bank0", 0x4001C000, 0x4000},
+	{"pads_qspi", 0x40020000, 0x4000},
+	{"xosc", 0x40024000, 0x4000},
+	{"pll_sys", 0x40028000, 0x4000},
+	{"pll_usb", 0x4002C000, 0x4000},
+	{"busctrl", 0x40030000, 0x4000},
+	{"uart0", 0x40034000, 0x4000},
+	{"uart1", 0x40038000, 0x4000},
+	{"spi0", 0x4003C000, 0x4000},
+	{"spi1", 0x40040000, 0x4000},
+	{"i2c0", 0x40044000, 0x4000},
+	{"i2c1", 0x40048000, 0x4000},
+	{"adc", 0x4004C000, 0x4000},
+	{"pwm", 0x40050000, 0x4000},
+	{"timer", 0x40054000, 0x4000},
+	{"watchdog", 0x40058000, 0x4000},
+	{"rtc", 0x4005C000, 0x4000},
+	{"rosc", 0x40060000, 0x4000},
+	{"vreg_and_chip_reset", 0x40064000, 0x4000},
+	{"tbman", 0x4006C000, 0x4000},
+	{"dma", 0x50000000, 0x1000},
+	{"usbctrl", 0x50100000, 0x20000},
+	{"pio0", 0x50200000, 0x1000},
+	{"pio1", 0x50300000, 0x1000},
+	{"sio", sioBase, 0x1000},
+}
+
+func peripheralName(addr uint32) string {
+	for _, p := range peripherals {
+		if addr >= p.base && addr-p.base < p.size {
+			return p.name
+		}
+	}
+	return ""
+}
+
+type region struct {
+	name string
+	base uint32
+	size uint32
+	dev  bus
+	// registers take word accesses, narrow writes are replicated over
+	// the word like the RP2040 bus fabric does
+	registers bool
+	// the XOR, SET and CLR aliases at +0x1000, +0x2000 and +0x3000
+	atomic bool
+}
+
+type rp2040 struct {
+	regions []*region
+	rom     *memoryBlock
+	flash   *memoryBlock
+	sram    *memoryBlock
+	sio     *sio
+	uart0   *uart
+}
+
+// newRP2040 builds the address space with the image loaded in flash
+// and SRAM, the UART output goes to out
+func newRP2040(maps []*memoryMap, out io.Writer) (*rp2040, error) {
+	this := &rp2040{
+		rom:   &memoryBlock{data: bootromStub(), readOnly: true},
+		flash: newMemoryBlock(flashSize, 0xFF, true),
+		sram:  newMemoryBlock(sramSize, 0, false),
+		sio:   &sio{},
+		uart0: &uart{out: out},
+	}
+	this.regions = []*region{
+		{name: "bootrom", base: romBase, size: romSize, dev: this.rom},
+		{name: "sram", base: sramBase, size: sramSize, dev: this.sram},
+		{name: "sio", base: sioBase, size: sioSize, dev: this.sio, registers: true},
+		{name: "uart0", base: uart0Base, size: 0x4000, dev: this.uart0, registers: true, atomic: true},
+	}
+	for i := uint32(0); i < flashAliases; i++ {
+		this.regions = append(this.regions, &region{
+			name: "flash",
+			base: flashBase + i*flashWindow,
+			size: flashSize,
+			dev:  this.flash,
+		})
+	}
+	for _, m := range maps {
+		if err := this.load(m); err != nil {
+			return nil, err
+		}
+	}
+	return this, nil
+}
+
+// load copies an image region into flash or SRAM
+func (this *rp2040) load(m *memoryMap) error {
+	end := uint64(m.addr) + uint64(len(m.contents))
+	switch {
+	case m.addr >= flashBase && end <= flashBase+flashSize:
+		copy(this.flash.data[m.addr-flashBase:], m.contents)
+	case m.addr >= sramBase && end <= sramBase+sramSize:
+		copy(this.sram.data[m.addr-sramBase:], m.contents)
+	default:
+		return fmt.Errorf("region 0x%08X-0x%08X is not in flash or SRAM", m.addr, end)
+	}
+	return nil
+}
+
+// find returns the region that holds addr
+func (this *rp2040) find(addr, size uint32, write bool) (*region, uint32, error) {
+	for _, r := range this.regions {
+		if addr >= r.base && addr-r.base < r.size {
+			if addr-r.base+size > r.size {
+				break
+			}
+			return r, addr - r.base, nil
+		}
+	}
+	msg := "unmapped"
+	if name := peripheralName(addr); name != "" {
+		msg = "unmodelled peripheral " + name
+	}
+	return nil, 0, &busError{addr: addr, size: size, write: write, msg: msg}
+}
+
+func (this *rp2040) read(addr uint32, size uint32) (uint32, error) {
+	r, offset, err := this.find(addr, size, false)
+	if err != nil {
+		return 0, err
+	}
+	if !r.registers {
+		v, err := r.dev.read(offset, size)
+		if err != nil {
+			return 0, this.wrap(err, addr, size, false)
+		}
+		return v, nil
+	}
+	if r.atomic {
+		offset &= 0xFFF
+	}
+	v, err := r.dev.read(offset&^3, 4)
+	if err != nil {
+		return 0, this.wrap(err, addr, size, false)
+	}
+	return v >> ((offset & 3) * 8) & sizeMask(size), nil
+}
+
+func (this *rp2040) write(addr uint32, size uint32, value uint32) error {
+	r, offset, err := this.find(addr, size, true)
+	if err != nil {
+		return err
+	}
+	if !r.registers {
+		if err := r.dev.write(offset, size, value); err != nil {
+			return this.wrap(err, addr, size, true)
+		}
+		return nil
+	}
+	switch size {
+	case 1:
+		value *= 0x01010101
+	case 2:
+		value *= 0x00010001
+	}
+	alias := uint32(0)
+	if r.atomic {
+		alias = offset >> 12
+		offset &= 0xFFF
+	}
+	offset &^= 3
+	if alias != 0 {
+		old, err := r.dev.read(offset, 4)
+		if err != nil {
+			return this.wrap(err, addr, size, true)
+		}
+		switch alias {
+		case 1:
+			value ^= old
+		case 2:
+			value |= old
+		case 3:
+			value = old &^ value
+		}
+	}
+	if err := r.dev.write(offset, 4, value); err != nil {
+		return this.wrap(err, addr, size, true)
+	}
+	return nil
+}
+
+// wrap gives the full address to the errors of the devices
+func (this *rp2040) wrap(err error, addr, size uint32, write bool) error {
+	return &busError{addr: addr, size: size, write: write, msg: err.Error()}
+}
+
+func sizeMask(size uint32) uint32 {
+	if size == 4 {
+		return 0xFFFFFFFF
+	}
+	return 1<<(size*8) - 1
+}
+
+// memoryBlock is a memory that takes any access
+type memoryBlock struct {
+	data     []byte
+	readOnly bool
+}
+
+func newMemoryBlock(size int, fill byte, readOnly bool) *memoryBlock {
+	out := &memoryBlock{data: make([]byte, size), readOnly: readOnly}
+	for i := range out.data {
+		out.data[i] = fill
+	}
+	return out
+}
+
+func (this *memoryBlock) read(addr uint32, size uint32) (uint32, error) {
+	return readLE(this.data[addr:], size), nil
+}
+
+func (this *memoryBlock) write(addr uint32, size uint32, value uint32) error {
+	if this.readOnly {
+		return fmt.Errorf("read only memory")
+	}
+	writeLE(this.data[addr:], size, value)
+	return nil
+}
+
+// bootromStub has the bootrom header and a table lookup that finds
+// nothing, the reset handler stops on a BKPT since there is no boot code
+func bootromStub() []byte {
+	rom := make([]byte, romSize)
+	writeLE(rom[0x00:], 4, sramBase+sramSize) // initial SP
+	for i := uint32(1); i < 4; i++ {
+		writeLE(rom[i*4:], 4, 0x41) // Reset, NMI, HardFault
+	}
+	copy(rom[0x10:], []byte{'M', 'u', 1, 3}) // magic and version
+	writeLE(rom[0x14:], 2, 0x30)             // function table
+	writeLE(rom[0x16:], 2, 0x30)             // data table
+	writeLE(rom[0x18:], 2, 0x45)             // table lookup
+	writeLE(rom[0x30:], 2, 0)                // empty table
+	writeLE(rom[0x40:], 2, 0xBE00)           // bkpt #0
+	writeLE(rom[0x42:], 2, 0xE7FE)           // b .
+	writeLE(rom[0x44:], 2, 0x2000)           // movs r0, #0
+	writeLE(rom[0x46:], 2, 0x4770)           // bx lr
+	return rom
+}
+
+// SIO registers
+const (
+	sioCPUID        = 0x000
+	sioGPIOIn       = 0x004
+	sioGPIOHiIn     = 0x008
+	sioGPIOOut      = 0x010
+	sioGPIOHiOE     = 0x040
+	sioDivUDividend = 0x060
+	sioDivUDivisor  = 0x064
+	sioDivSDividend = 0x068
+	sioDivSDivisor  = 0x06C
+	sioDivQuotient  = 0x070
+	sioDivRemainder = 0x074
+	sioDivCSR       = 0x078
+)
+
+// sio models the GPIO registers and the hardware divider of core 0, the
+// divider has its result ready right away
+type sio struct {
+	// GPIO_OUT, GPIO_OE, GPIO_HI_OUT and GPIO_HI_OE
+	gpio [4]uint32
+	// level of the pins not driven by the core
+	inputs uint32
+
+	dividend, divisor   uint32
+	quotient, remainder uint32
+	dirty               bool
+}
+
+func (this *sio) read(offset uint32, size uint32) (uint32, error) {
+	switch {
+	case offset == sioCPUID:
+		return 0, nil
+	case offset == sioGPIOIn:
+		out, oe := this.gpio[0], this.gpio[1]
+		return (out&oe | this.inputs&^oe) & 0x3FFFFFFF, nil
+	case offset == sioGPIOHiIn:
+		return this.gpio[2] & this.gpio[3] & 0x3F, nil
+	case offset >= sioGPIOOut && offset < sioGPIOHiOE+0x10:
+		// the SET, CLR and XOR registers read as zero
+		if offset%0x10 != 0 {
+			return 0, nil
+		}
+		return this.gpio[(offset-sioGPIOOut)/0x10], nil
+	case offset == sioDivUDividend, offset == sioDivSDividend:
+		return this.dividend, nil
+	case offset == sioDivUDivisor, offset == sioDivSDivisor:
+		return this.divisor, nil
+	case offset == sioDivQuotient:
+		this.dirty = false
+		return this.quotient, nil
+	case offset == sioDivRemainder:
+		return this.remainder, nil
+	case offset == sioDivCSR:
+		if this.dirty {
+			return 0b11, nil
+		}
+		return 0b01, nil
+	}
+	return 0, fmt.Errorf("unmodelled SIO register 0x%03X", offset)
+}
+
+func (this *sio) write(offset uint32, size uint32, value uint32) error {
+	switch {
+	case offset >= sioGPIOOut && offset < sioGPIOHiOE+0x10:
+		r := &this.gpio[(offset-sioGPIOOut)/0x10]
+		switch offset % 0x10 {
+		case 0x0:
+			*r = value
+		case 0x4:
+			*r |= value
+		case 0x8:
+			*r &^= value
+		case 0xC:
+			*r ^= value
+		}
+	case offset == sioDivUDividend, offset == sioDivSDividend:
+		this.dividend = value
+		this.divide(offset == sioDivSDividend)
+	case offset == sioDivUDivisor, offset == sioDivSDivisor:
+		this.divisor = value
+		this.divide(offset == sioDivSDivisor)
+	case offset == sioDivQuotient:
+		this.quotient = value
+		this.dirty = true
+	case offset == sioDivRemainder:
+		this.remainder = value
+		this.dirty = true
+	case offset == sioCPUID, offset == sioGPIOIn, offset == sioGPIOHiIn, offset == sioDivCSR:
+		// read only
+	default:
+		return fmt.Errorf("unmodelled SIO register 0x%03X", offset)
+	}
+	return nil
+}
+
+// divide starts a division, by zero the quotient is all ones, or 1 for
+// negative signed dividends, and the remainder is the dividend
+func (this *sio) divide(signed bool) {
+	this.dirty = true
+	if this.divisor == 0 {
+		this.quotient = 0xFFFFFFFF
+		if signed && int32(this.dividend) < 0 {
+			this.quotient = 1
+		}
+		this.remainder = this.dividend
+		return
+	}
+	if signed {
+		this.quotient = uint32(int32(this.dividend) / int32(this.divisor))
+		this.remainder = uint32(int32(this.dividend) % int32(this.divisor))
+		return
+	}
+	this.quotient = this.dividend / this.divisor
+	this.remainder = this.dividend % this.divisor
+}
+
+// PL011 registers
+const (
+	uartDR   = 0x000
+	uartFR   = 0x018
+	uartRIS  = 0x03C
+	uartMIS  = 0x040
+	uartICR  = 0x044
+	uartPID0 = 0xFE0
+)
+
+// uartControl are the registers kept but without effect
+var uartControl = map[uint32]string{
+	0x004: "UARTRSR",
+	0x020: "UARTILPR",
+	0x024: "UARTIBRD",
+	0x028: "UARTFBRD",
+	0x02C: "UARTLCR_H",
+	0x030: "UARTCR",
+	0x034: "UARTIFLS",
+	0x038: "UARTIMSC",
+	0x048: "UARTDMACR",
+}
+
+// peripheral and PrimeCell identification
+var uartID = []uint32{0x11, 0x10, 0x34, 0x00, 0x0D, 0xF0, 0x05, 0xB1}
+
+// uart is a PL011 that sends every byte written right away and never
+// receives anything
+type uart struct {
+	out  io.Writer
+	regs map[uint32]uint32
+}
+
+func (this *uart) read(offset uint32, size uint32) (uint32, error) {
+	switch {
+	case offset == uartDR, offset == uartRIS, offset == uartMIS:
+		return 0, nil
+	case offset == uartFR:
+		// TXFE and RXFE, the transmit FIFO is always empty
+		return 0x90, nil
+	case offset >= uartPID0 && offset < uartPID0+uint32(len(uartID))*4:
+		return uartID[(offset-uartPID0)/4], nil
+	}
+	if _, ok := uartControl[offset]; ok {
+		return this.regs[offset], nil
+	}
+	return 0, fmt.Errorf("unmodelled UART register 0x%03X", offset)
+}
+
+func (this *uart) write(offset uint32, size uint32, value uint32) error {
+	switch offset {
+	case uartDR:
+		if this.out != nil {
+			if _, err := this.out.Write([]byte{byte(value)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	case uartICR:
+		return nil
+	}
+	if _, ok := uartControl[offset]; ok {
+		if this.regs == nil {
+			this.regs = map[uint32]uint32{}
+		}
+		this.regs[offset] = value
+		return nil
+	}
+	return fmt.Errorf("unmodelled UART register 0x%03X", offset)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func runRP2040(t *testing.T, src string) (*cpu, *halt, string) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	b, err := newRP2040(assembleSource(t, src), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, h := runOn(t, b)
+	return c, h, out.String()
+}
+
+func TestUART(t *testing.T) {
+	_, h, out := runRP2040(t, `
+	ldr r0, =0x40034000
+	adr r1, text
+loop:
+	ldrb r2, [r1, #0]
+	cmp r2, #0
+	beq done
+wait:
+	ldr r3, [r0, #0x18]
+	movs r4, #0x20
+	tst r3, r4
+	bne wait
+	strb r2, [r0, #0]
+	adds r1, #1
+	b loop
+done:
+	bkpt #0
+	$0 hw
+text:
+	"hello\n"
+	$0 b
+`)
+	if h.kind != haltBreakpoint {
+		t.Fatalf("halted with %v", h)
+	}
+	if out != "hello\n" {
+		t.Errorf("the UART wrote %q", out)
+	}
+}
+
+func TestDivider(t *testing.T) {
+	tests := []struct {
+		dividend, divisor   uint32
+		signed              bool
+		quotient, remainder uint32
+	}{
+		{100, 7, false, 14, 2},
+		{0xFFFFFFF9, 2, false, 0x7FFFFFFC, 1},
+		{0xFFFFFFF9, 2, true, 0xFFFFFFFD, 0xFFFFFFFF},
+		{5, 0, false, 0xFFFFFFFF, 5},
+		{0xFFFFFFFB, 0, true, 1, 0xFFFFFFFB},
+		{5, 0, true, 0xFFFFFFFF, 5},
+		{0x80000000, 0xFFFFFFFF, true, 0x80000000, 0},
+	}
+	for _, test := range tests {
+		offset := 0x60
+		if test.signed {
+			offset = 0x68
+		}
+		c, h, _ := runRP2040(t, `
+	ldr r0, =0xD0000000
+	ldr r1, =`+fmt.Sprint(test.dividend)+`
+	ldr r2, =`+fmt.Sprint(test.divisor)+`
+	str r1, [r0, #`+fmt.Sprint(offset)+`]
+	str r2, [r0, #`+fmt.Sprint(offset+4)+`]
+	ldr r3, [r0, #0x78]
+	ldr r4, [r0, #0x74]
+	ldr r5, [r0, #0x70]
+	ldr r6, [r0, #0x78]
+	bkpt #0
+`)
+		if h.kind != haltBreakpoint {
+			t.Fatalf("halted with %v", h)
+		}
+		if c.r[3] != 3 || c.r[6] != 1 {
+			t.Errorf("CSR is 0x%X then 0x%X", c.r[3], c.r[6])
+		}
+		if c.r[5] != test.quotient || c.r[4] != test.remainder {
+			t.Errorf("0x%X / 0x%X signed %v is 0x%X rem 0x%X, expected 0x%X rem 0x%X",
+				test.dividend, test.divisor, test.signed, c.r[5], c.r[4], test.quotient, test.remainder)
+		}
+	}
+}
+
+func TestGPIO(t *testing.T) {
+	c, h, _ := runRP2040(t, `
+	ldr r0, =0xD0000000
+	movs r1, #0xF0
+	str r1, [r0, #0x20]
+	movs r1, #0x30
+	str r1, [r0, #0x14]
+	movs r1, #0x10
+	str r1, [r0, #0x18]
+	movs r1, #0x41
+	str r1, [r0, #0x1C]
+	ldr r2, [r0, #0x10]
+	ldr r3, [r0, #0x04]
+	bkpt #0
+`)
+	if h.kind != haltBreakpoint {
+		t.Fatalf("halted with %v", h)
+	}
+	if c.r[2] != 0x61 || c.r[3] != 0x60 {
+		t.Errorf("GPIO_OUT is 0x%X and GPIO_IN 0x%X", c.r[2], c.r[3])
+	}
+}
+
+func TestRP2040Faults(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"ldr r0, =0x4000C000\n\tldr r1, [r0, #0]", "0x2000000A: read of 4 bytes at 0x4000C000: unmodelled peripheral resets"},
+		{"ldr r0, =0x30000000\n\tstr r0, [r0, #0]", "0x2000000A: write of 4 bytes at 0x30000000: unmapped"},
+		{"ldr r0, =0x10000000\n\tstr r0, [r0, #4]", "0x2000000A: write of 4 bytes at 0x10000004: read only memory"},
+		{"ldr r0, =0xD0000000\n\tldr r1, [r0, #0x50]", "0x2000000A: read of 4 bytes at 0xD0000050: unmodelled SIO register 0x050"},
+		{"ldr r0, =0x20041FFC\n\tldr r1, [r0, #4]", "0x2000000A: read of 4 bytes at 0x20042000: unmapped"},
+	}
+	for _, test := range tests {
+		_, h, _ := runRP2040(t, "\t"+test.src+"\n\tbkpt #0\n")
+		if h.kind != haltFault || h.Error() != test.msg {
+			t.Errorf("got %q, expected %q", h, test.msg)
+		}
+	}
+}
+
+func TestRP2040Memory(t *testing.T) {
+	b, err := newRP2040([]*memoryMap{{addr: 0x10000100, contents: []byte{1, 2, 3, 4}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []uint32{0x10000100, 0x11000100, 0x13000100} {
+		if v, err := b.read(addr, 4); err != nil || v != 0x04030201 {
+			t.Errorf("0x%08X reads 0x%08X %v", addr, v, err)
+		}
+	}
+	if v, _ := b.read(0x10000200, 4); v != 0xFFFFFFFF {
+		t.Errorf("erased flash reads 0x%08X", v)
+	}
+	if v, _ := b.read(0x10, 4); v != 0x0301754D {
+		t.Errorf("bootrom magic is 0x%08X", v)
+	}
+	// UARTCR through the SET and CLR aliases, and a replicated byte write
+	b.write(0x40034030, 4, 0x001)
+	b.write(0x40036030, 4, 0x300)
+	b.write(0x40037030, 4, 0x001)
+	b.write(0x40034039, 1, 0x0F)
+	if v, _ := b.read(0x40034030, 4); v != 0x300 {
+		t.Errorf("UARTCR is 0x%X", v)
+	}
+	if v, _ := b.read(0x40034038, 4); v != 0x0F0F0F0F {
+		t.Errorf("UARTIMSC is 0x%X", v)
+	}
+	if _, err := newRP2040([]*memoryMap{{addr: 0x30000000, contents: []byte{1}}}, nil); err == nil {
+		t.Error("loaded a region outside of flash and SRAM")
+	}
+}
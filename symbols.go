@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type symEntry struct {
+	name string
+	addr uint32
+	// zero if unknown
+	size     uint32
+	function bool
+}
+
+// symbolTable names addresses of an image, either from an ELF symbol
+// table or from the vector table. Methods accept a nil table
+type symbolTable struct {
+	entries []*symEntry
+	byAddr  map[uint32]*symEntry
+	byName  map[string]*symEntry
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{
+		byAddr: map[uint32]*symEntry{},
+		byName: map[string]*symEntry{},
+	}
+}
+
+// add keeps the first name given to an address and to a name
+func (this *symbolTable) add(name string, addr, size uint32, function bool) {
+	e := &symEntry{name: name, addr: addr, size: size, function: function}
+	if _, ok := this.byName[name]; ok {
+		return
+	}
+	this.byName[name] = e
+	if _, ok := this.byAddr[addr]; !ok {
+		this.byAddr[addr] = e
+	}
+	i := sort.Search(len(this.entries), func(i int) bool {
+		return this.entries[i].addr > addr
+	})
+	this.entries = append(this.entries, nil)
+	copy(this.entries[i+1:], this.entries[i:])
+	this.entries[i] = e
+}
+
+func (this *symbolTable) name(addr uint32) (string, bool) {
+	if this == nil {
+		return "", false
+	}
+	e, ok := this.byAddr[addr]
+	if !ok {
+		return "", false
+	}
+	return e.name, true
+}
+
+func (this *symbolTable) lookup(name string) (*symEntry, bool) {
+	if this == nil {
+		return nil, false
+	}
+	e, ok := this.byName[name]
+	return e, ok
+}
+
+// describe names an address of the loaded memory relative to the
+// symbol that contains it, like func+0x12
+func (this *symbolTable) describe(addr uint32, maps []*memoryMap) (string, bool) {
+	e, ok := this.containing(addr, maps)
+	if !ok {
+		return "", false
+	}
+	if addr == e.addr {
+		return e.name, true
+	}
+	return fmt.Sprintf("%v+0x%X", e.name, addr-e.addr), true
+}
+
+// containing returns the symbol an address of the loaded memory
+// belongs to, within the extent of the symbol
+func (this *symbolTable) containing(addr uint32, maps []*memoryMap) (*symEntry, bool) {
+	if this == nil || !inMaps(maps, addr) {
+		return nil, false
+	}
+	i := sort.Search(len(this.entries), func(i int) bool {
+		return this.entries[i].addr > addr
+	})
+	if i == 0 {
+		return nil, false
+	}
+	e := this.byAddr[this.entries[i-1].addr]
+	if _, end := this.extent(e, maps); addr != e.addr && addr >= end {
+		return nil, false
+	}
+	return e, true
+}
+
+func inMaps(maps []*memoryMap, addr uint32) bool {
+	for _, m := range maps {
+		if m.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// functions returns the address of every function, to be used as
+// entry points
+func (this *symbolTable) functions() []uint32 {
+	out := []uint32{}
+	if this == nil {
+		return out
+	}
+	for _, e := range this.entries {
+		if e.function {
+			out = append(out, e.addr)
+		}
+	}
+	return out
+}
+
+// extent returns the range covered by a symbol, symbols of unknown
+// size extend to the next symbol or to the end of their region
+func (this *symbolTable) extent(e *symEntry, maps []*memoryMap) (uint32, uint32) {
+	if e.size != 0 {
+		return e.addr, e.addr + e.size
+	}
+	end := e.addr
+	for _, m := range maps {
+		if m.contains(e.addr) {
+			end = m.addr + uint32(len(m.contents))
+		}
+	}
+	next := sort.Search(len(this.entries), func(i int) bool {
+		return this.entries[i].addr > e.addr
+	})
+	if next < len(this.entries) && this.entries[next].addr < end {
+		end = this.entries[next].addr
+	}
+	return e.addr, end
+}
+
+// readELFSymbols reads the defined functions, objects and labels of
+// .symtab. ARM mapping symbols ($t, $d, $a) are left out, and the
+// Thumb bit of functions is cleared
+func readELFSymbols(data []byte) (*symbolTable, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	syms, err := f.Symbols()
+	if err == elf.ErrNoSymbols {
+		return newSymbolTable(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// functions first, then globals, so that they win over other
+	// names for the same address
+	rank := func(s elf.Symbol) int {
+		r := 0
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC {
+			r += 2
+		}
+		if elf.ST_BIND(s.Info) != elf.STB_GLOBAL {
+			r += 1
+		}
+		return r
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		return rank(syms[i]) < rank(syms[j])
+	})
+	out := newSymbolTable()
+	for _, s := range syms {
+		kind := elf.ST_TYPE(s.Info)
+		if s.Section == elf.SHN_UNDEF || s.Section == elf.SHN_ABS || s.Name == "" {
+			continue
+		}
+		if kind != elf.STT_FUNC && kind != elf.STT_OBJECT && kind != elf.STT_NOTYPE {
+			continue
+		}
+		if strings.HasPrefix(s.Name, "$") {
+			continue
+		}
+		addr := uint32(s.Value)
+		if kind == elf.STT_FUNC {
+			addr &^= 1
+		}
+		out.add(s.Name, addr, uint32(s.Size), kind == elf.STT_FUNC)
+	}
+	return out, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// execution traces, as text or in a binary format made to compare the
+// runs of two builds
+
+// regAPSR is the register number of the flags in trace records
+const regAPSR = 15
+
+type regChange struct {
+	reg   uint16
+	value uint32
+}
+
+type memWrite struct {
+	addr  uint32
+	size  uint32
+	value uint32
+}
+
+// traceStep is the effect of one instruction, or of the entry of an
+// exception at addr. in is nil for the records read back from a binary
+// trace
+type traceStep struct {
+	addr      uint32
+	in        *instr
+	exception uint32
+	regs      []regChange
+	writes    []memWrite
+}
+
+func (this *traceStep) equal(other *traceStep) bool {
+	if this.addr != other.addr || this.exception != other.exception ||
+		len(this.regs) != len(other.regs) || len(this.writes) != len(other.writes) {
+		return false
+	}
+	for i := range this.regs {
+		if this.regs[i] != other.regs[i] {
+			return false
+		}
+	}
+	for i := range this.writes {
+		if this.writes[i] != other.writes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deltas renders the register and memory changes
+func (this *traceStep) deltas() string {
+	out := ""
+	if this.exception != 0 {
+		out += " <" + exceptionName(this.exception) + ">"
+	}
+	for _, r := range this.regs {
+		if r.reg == regAPSR {
+			out += " apsr=" + formatFlags(r.value)
+		} else {
+			out += fmt.Sprintf(" %v=%08X", reg(r.reg), r.value)
+		}
+	}
+	for _, w := range this.writes {
+		out += fmt.Sprintf(" [%08X]=%0*X", w.addr, w.size*2, w.value)
+	}
+	return out
+}
+
+// watchBus records the writes going through it
+type watchBus struct {
+	bus
+	writes []memWrite
+}
+
+func (this *watchBus) write(addr uint32, size uint32, value uint32) error {
+	if err := this.bus.write(addr, size, value); err != nil {
+		return err
+	}
+	this.writes = append(this.writes, memWrite{addr: addr, size: size, value: value})
+	return nil
+}
+
+// tracer steps the cpu and reports what every instruction changed
+type tracer struct {
+	cpu   *cpu
+	watch *watchBus
+}
+
+func newTracer(c *cpu) *tracer {
+	watch := &watchBus{bus: c.bus}
+	c.bus = watch
+	return &tracer{cpu: c, watch: watch}
+}
+
+func (this *tracer) step() (*traceStep, *halt) {
+	c := this.cpu
+	before := c.r
+	flags := c.apsr()
+	this.watch.writes = this.watch.writes[:0]
+	if h := c.step(); h != nil {
+		return nil, h
+	}
+	out := &traceStep{addr: before[15], in: c.executed, exception: c.entered}
+	for i := uint16(0); i < 15; i++ {
+		if c.r[i] != before[i] {
+			out.regs = append(out.regs, regChange{reg: i, value: c.r[i]})
+		}
+	}
+	if c.apsr() != flags {
+		out.regs = append(out.regs, regChange{reg: regAPSR, value: c.apsr()})
+	}
+	out.writes = append(out.writes, this.watch.writes...)
+	return out, nil
+}
+
+// traceText writes a line per instruction, with the text of Disassemble
+type traceText struct {
+	w       *bufio.Writer
+	printer *printer
+	// formatted instructions by address
+	cache map[uint32]*formatted
+}
+
+type formatted struct {
+	chunk []byte
+	text  string
+}
+
+// imagePrinter names the targets like Disassemble does for the regions
+// of the image
+func imagePrinter(img *image) *printer {
+	labels := map[uint32]string{}
+	for _, m := range img.maps {
+		for addr, label := range labelsFor(decodeAll(m), img.symbols) {
+			labels[addr] = label
+		}
+	}
+	return &printer{maps: img.maps, labels: labels, symbols: img.symbols, regions: img.maps}
+}
+
+func newTraceText(w io.Writer, img *image) *traceText {
+	return &traceText{
+		w:       bufio.NewWriter(w),
+		printer: imagePrinter(img),
+		cache:   map[uint32]*formatted{},
+	}
+}
+
+func (this *traceText) add(s *traceStep) error {
+	if s.in == nil {
+		_, err := fmt.Fprintf(this.w, "%08X %8v\t%v\n", s.addr, "", strings.TrimSpace(s.deltas()))
+		return err
+	}
+	f, ok := this.cache[s.addr]
+	if !ok || !bytes.Equal(f.chunk, s.in.chunk) {
+		f = &formatted{
+			chunk: s.in.chunk,
+			text:  fmt.Sprintf("%08X %v\t%v", s.addr, strchunk(s.in.chunk), this.printer.format(s.in)),
+		}
+		this.cache[s.addr] = f
+	}
+	line := f.text
+	if deltas := s.deltas(); deltas != "" {
+		line = fmt.Sprintf("%-48v ;%v", line, deltas)
+	}
+	_, err := this.w.WriteString(line + "\n")
+	return err
+}
+
+func (this *traceText) close() error {
+	return this.w.Flush()
+}
+
+// binary traces start with the magic and a version byte, followed by
+// one record per instruction, all little endian:
+//
+//	u32 address
+//	u8 exception entered, zero for instructions
+//	u16 mask of the changed registers, r0 to r14 then the APSR
+//	u32 value of every changed register
+//	u8 number of memory writes, then for each one the u8 size,
+//	   u32 address and the value on size bytes
+const (
+	traceMagic   = "RTRC"
+	traceVersion = 2
+)
+
+type traceBinary struct {
+	w *bufio.Writer
+}
+
+func newTraceBinary(w io.Writer) (*traceBinary, error) {
+	out := &traceBinary{w: bufio.NewWriter(w)}
+	_, err := out.w.WriteString(traceMagic + string(rune(traceVersion)))
+	return out, err
+}
+
+func (this *traceBinary) add(s *traceStep) error {
+	buff := appendU32(nil, s.addr)
+	buff = append(buff, byte(s.exception))
+	mask := uint16(0)
+	for _, r := range s.regs {
+		mask |= 1 << r.reg
+	}
+	buff = appendU16(buff, mask)
+	for _, r := range s.regs {
+		buff = appendU32(buff, r.value)
+	}
+	if len(s.writes) > 0xFF {
+		return fmt.Errorf("0x%08X: too many memory writes", s.addr)
+	}
+	buff = append(buff, byte(len(s.writes)))
+	for _, w := range s.writes {
+		buff = append(buff, byte(w.size))
+		buff = appendU32(buff, w.addr)
+		buff = append(buff, appendU32(nil, w.value)[:w.size]...)
+	}
+	_, err := this.w.Write(buff)
+	return err
+}
+
+func (this *traceBinary) close() error {
+	return this.w.Flush()
+}
+
+// readTrace decodes a binary trace
+func readTrace(data []byte) ([]*traceStep, error) {
+	if len(data) < len(traceMagic)+1 || string(data[:len(traceMagic)]) != traceMagic {
+		return nil, fmt.Errorf("not a ras trace")
+	}
+	if data[len(traceMagic)] != traceVersion {
+		return nil, fmt.Errorf("unknown trace version %v", data[len(traceMagic)])
+	}
+	out := []*traceStep{}
+	rb := newReadBuffer(data[len(traceMagic)+1:])
+	for rb.len() > 0 {
+		addr, ok := rb.getU32()
+		exception, ok1 := rb.getU8()
+		s := &traceStep{addr: addr, exception: uint32(exception)}
+		mask, ok2 := rb.getU16()
+		for i := uint16(0); ok2 && i < 16; i++ {
+			if mask&(1<<i) != 0 {
+				var v uint32
+				v, ok2 = rb.getU32()
+				s.regs = append(s.regs, regChange{reg: i, value: v})
+			}
+		}
+		count, ok3 := rb.getU8()
+		if !ok || !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("record %v is truncated", len(out))
+		}
+		for i := uint8(0); i < count; i++ {
+			size, ok := rb.getU8()
+			addr, ok2 := rb.getU32()
+			if !ok || !ok2 || (size != 1 && size != 2 && size != 4) {
+				return nil, fmt.Errorf("record %v has an invalid memory write", len(out))
+			}
+			v := uint32(0)
+			for j := uint8(0); j < size && ok; j++ {
+				var b uint8
+				b, ok = rb.getU8()
+				v |= uint32(b) << (j * 8)
+			}
+			if !ok {
+				return nil, fmt.Errorf("record %v is truncated", len(out))
+			}
+			s.writes = append(s.writes, memWrite{addr: addr, size: uint32(size), value: v})
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// diffTraces describes where two traces diverge, with the records that
+// lead to it, or returns an empty string if they are the same
+func diffTraces(a, b []*traceStep, context int) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i].equal(b[i]) {
+		i++
+	}
+	if i == len(a) && i == len(b) {
+		return ""
+	}
+	out := fmt.Sprintf("the traces differ at instruction %v\n", i)
+	for j := max(0, i-context); j < i; j++ {
+		out += fmt.Sprintf("  %08X%v\n", a[j].addr, a[j].deltas())
+	}
+	for _, side := range []struct {
+		sign  string
+		steps []*traceStep
+	}{{"-", a}, {"+", b}} {
+		if i < len(side.steps) {
+			out += fmt.Sprintf("%v %08X%v\n", side.sign, side.steps[i].addr, side.steps[i].deltas())
+		} else {
+			out += fmt.Sprintf("%v end of trace\n", side.sign)
+		}
+	}
+	return out
+}
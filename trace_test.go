@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const traceProgram = `
+	movs r0, #3
+	ldr r1, =0x20000800
+loop:
+	push {r0}
+	strb r0, [r1, #1]
+	subs r0, #1
+	bne loop
+	bl done
+done:
+	bkpt #0
+`
+
+// traceSource runs a program through the tracer
+func traceSource(t *testing.T, src string) ([]*traceStep, *image) {
+	t.Helper()
+	maps := assembleSource(t, src)
+	c := newCPU(newSparseMemory(maps))
+	if err := c.reset(0x20000000); err != nil {
+		t.Fatal(err)
+	}
+	tr := newTracer(c)
+	out := []*traceStep{}
+	for {
+		s, h := tr.step()
+		if h != nil {
+			if h.kind != haltBreakpoint {
+				t.Fatalf("halted with %v", h)
+			}
+			return out, &image{maps: maps, symbols: newSymbolTable()}
+		}
+		out = append(out, s)
+	}
+}
+
+func TestTraceText(t *testing.T) {
+	steps, img := traceSource(t, traceProgram)
+	buff := &bytes.Buffer{}
+	w := newTraceText(buff, img)
+	for _, s := range steps {
+		if err := w.add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+	lines := strings.Split(buff.String(), "\n")
+	expected := map[int]string{
+		0: "20000008     0320\tMOVS r0, #03                   ; r0=00000003",
+		2: "2000000C     01B4\tPUSH {r0}                      ; sp=20000FFC [20000FFC]=00000003",
+		3: "2000000E     4870\tSTRB r0, [r1, #01]             ; [20000801]=03",
+		4: "20000010     0138\tSUBS r0, #01                   ; r0=00000002 apsr=nzCv",
+		5: "20000012     FBD1\tBNE loc_2000000C",
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Errorf("line %v is\n%q, expected\n%q", i, lines[i], line)
+		}
+	}
+}
+
+func TestTraceBinary(t *testing.T) {
+	steps, _ := traceSource(t, traceProgram)
+	buff := &bytes.Buffer{}
+	w, err := newTraceBinary(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range steps {
+		if err := w.add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+	read, err := readTrace(buff.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffTraces(steps, read, 2); diff != "" {
+		t.Fatalf("the trace changed once written:\n%v", diff)
+	}
+	if _, err := readTrace(buff.Bytes()[:buff.Len()-1]); err == nil {
+		t.Error("read a truncated trace")
+	}
+
+	// the same program with a different store
+	other, _ := traceSource(t, strings.Replace(traceProgram, "#1]", "#2]", 1))
+	diff := diffTraces(steps, other, 1)
+	expected := `the traces differ at instruction 3
+  2000000C sp=20000FFC [20000FFC]=00000003
+- 2000000E [20000801]=03
++ 2000000E [20000802]=03
+`
+	if diff != expected {
+		t.Errorf("diff is\n%v", diff)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	steps, img := traceSource(t, traceProgram)
+	p := newProfile()
+	for i, s := range steps {
+		// taken branches are not followed by the next instruction
+		branched := i+1 < len(steps) && steps[i+1].addr != s.addr+s.in.size
+		p.add(s.in, branched)
+	}
+	count, total := p.total()
+	// movs, ldr, 3 loops of push, strb, subs and bne, then bl
+	if count != 15 || total != 1+2+3*(2+2+1)+2*2+1+3 {
+		t.Errorf("%v instructions and %v cycles", count, total)
+	}
+	if p.count[0x2000000C] != 3 {
+		t.Errorf("the loop ran %v times", p.count[0x2000000C])
+	}
+
+	// the call splits the code after Reset, BKPT itself halts
+	p.add(&instr{addr: 0x20000018, size: 2, op: mnBKPT}, false)
+	img.symbols.add("Reset", 0x20000008, 0, true)
+	expected := `       count       cycles      %  function
+          15           26  96.30  Reset
+           1            1   3.70  sub_20000018
+`
+	if out := p.byFunction(functionSymbols(img), img.maps); out != expected {
+		t.Errorf("profile is\n%v", out)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	uf2Magic1     uint32 = 0x0A324655
+	uf2Magic2     uint32 = 0x9E5D5157
+	uf2MagicFinal uint32 = 0x0AB16F30
+
+	uf2BlockSize   = 512
+	uf2DataSize    = 476
+	uf2PayloadSize = 256
+
+	familyRP2040 uint32 = 0xE48BFF56
+)
+
+func (this uf2flags) encode() uint32 {
+	var out uint32 = 0
+	if this.NotMainFlash {
+		out |= 0x00000001
+	}
+	if this.FileContainer {
+		out |= 0x00001000
+	}
+	if this.FamilyIDPresent {
+		out |= 0x00002000
+	}
+	if this.ChecksumPresent {
+		out |= 0x00004000
+	}
+	if this.ExtensionTagsPresent {
+		out |= 0x00008000
+	}
+	return out
+}
+
+// paginate splits the regions into 256-byte pages aligned to 256 bytes,
+// gaps inside a page are filled with zeroes. Regions that share a page
+// end up in the same block.
+func paginate(maps []*memoryMap) []*uf2block {
+	pages := map[uint32][]byte{}
+	for _, m := range maps {
+		for i, b := range m.contents {
+			addr := m.addr + uint32(i)
+			base := addr &^ (uf2PayloadSize - 1)
+			page, ok := pages[base]
+			if !ok {
+				page = make([]byte, uf2PayloadSize)
+				pages[base] = page
+			}
+			page[addr-base] = b
+		}
+	}
+	out := []*uf2block{}
+	for addr, page := range pages {
+		out = append(out, &uf2block{
+			addr:        addr,
+			payloadSize: uf2PayloadSize,
+			payload:     page,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].addr < out[j].addr
+	})
+	return out
+}
+
+// buildUF2 turns the regions into UF2 blocks, if familyID is zero
+// the FamilyIDPresent flag is not set
+func buildUF2(maps []*memoryMap, familyID uint32) []*uf2block {
+	blocks := paginate(maps)
+	for i, b := range blocks {
+		b.seqBlockNum = uint32(i)
+		b.totBlockNum = uint32(len(blocks))
+		if familyID != 0 {
+			b.flags.FamilyIDPresent = true
+			b.something = familyID
+		}
+	}
+	return blocks
+}
+
+func writeUF2(blocks []*uf2block) []byte {
+	out := make([]byte, 0, len(blocks)*uf2BlockSize)
+	for _, b := range blocks {
+		out = b.encode(out)
+	}
+	return out
+}
+
+// encode appends the 512 bytes of the block to buff
+func (this *uf2block) encode(buff []byte) []byte {
+	start := len(buff)
+	buff = appendU32(buff, uf2Magic1)
+	buff = appendU32(buff, uf2Magic2)
+	buff = appendU32(buff, this.flags.encode())
+	buff = appendU32(buff, this.addr)
+	buff = appendU32(buff, this.payloadSize)
+	buff = appendU32(buff, this.seqBlockNum)
+	buff = appendU32(buff, this.totBlockNum)
+	buff = appendU32(buff, this.something)
+	buff = append(buff, this.payload...)
+	if this.flags.FileContainer {
+		buff = append(buff, this.fileName...)
+		buff = append(buff, 0)
+	}
+	if len(this.tags) > 0 {
+		for (len(buff)-start)%4 != 0 {
+			buff = append(buff, 0)
+		}
+		buff = encodeTags(buff, this.tags)
+	}
+	if this.checksum != nil {
+		for len(buff)-start < uf2OffChecksum {
+			buff = append(buff, 0)
+		}
+		buff = this.checksum.encode(buff)
+	}
+	for len(buff)-start < uf2BlockSize-4 {
+		buff = append(buff, 0)
+	}
+	buff = appendU32(buff, uf2MagicFinal)
+	return buff
+}
+
+type uf2Error struct {
+	// offset of the field in the file
+	offset   int
+	field    string
+	found    uint32
+	expected uint32
+	// bytes skipped to reach the next block
+	skipped int
+}
+
+func (this *uf2Error) Error() string {
+	out := ""
+	switch this.field {
+	case "block size":
+		out = fmt.Sprintf("offset 0x%X: truncated block of %v bytes", this.offset, this.found)
+	case "payload size":
+		out = fmt.Sprintf("offset 0x%X: payload size is %v, expected at most %v", this.offset, this.found, this.expected)
+	default:
+		out = fmt.Sprintf("offset 0x%X: %v is 0x%08X, expected 0x%08X", this.offset, this.field, this.found, this.expected)
+	}
+	if this.skipped > 0 {
+		out += fmt.Sprintf(", skipped %v bytes", this.skipped)
+	}
+	return out
+}
+
+// readUF2 returns every valid block in data. Since blocks stand on their
+// own, an invalid block is skipped by searching for the next pair of
+// start magics, which need not be at a multiple of 512
+func readUF2(data []byte) ([]*uf2block, []*uf2Error) {
+	blocks := []*uf2block{}
+	errs := []*uf2Error{}
+	rb := newReadBuffer(data)
+	for rb.len() > 0 {
+		block, err := readChunk(rb)
+		if err == nil {
+			blocks = append(blocks, block)
+			continue
+		}
+		next := nextBlock(data, rb.start+1)
+		err.skipped = next - rb.start
+		errs = append(errs, err)
+		rb.start = next
+	}
+	return blocks, errs
+}
+
+// nextBlock returns the offset of the first pair of start magics
+// at or after from, or the end of data if there's none
+func nextBlock(data []byte, from int) int {
+	for i := from; i+8 <= len(data); i++ {
+		magic1, _ := newReadBuffer(data[i : i+4]).getU32()
+		magic2, _ := newReadBuffer(data[i+4 : i+8]).getU32()
+		if magic1 == uf2Magic1 && magic2 == uf2Magic2 {
+			return i
+		}
+	}
+	return len(data)
+}
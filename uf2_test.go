@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// flagFile names the testdata file holding the given flags, one bit
+// per flag in the order of uf2flags
+func flagFile(flags uf2flags) string {
+	bits := 0
+	for i, set := range []bool{flags.NotMainFlash, flags.FileContainer, flags.FamilyIDPresent, flags.ChecksumPresent, flags.ExtensionTagsPresent} {
+		if set {
+			bits |= 1 << i
+		}
+	}
+	return filepath.Join("testdata", fmt.Sprintf("flags%02d.uf2", bits))
+}
+
+// allFlags returns every combination of the flags
+func allFlags() []uf2flags {
+	out := []uf2flags{}
+	for bits := 0; bits < 32; bits++ {
+		out = append(out, uf2flags{
+			NotMainFlash:         bits&1 != 0,
+			FileContainer:        bits&2 != 0,
+			FamilyIDPresent:      bits&4 != 0,
+			ChecksumPresent:      bits&8 != 0,
+			ExtensionTagsPresent: bits&16 != 0,
+		})
+	}
+	return out
+}
+
+// flagBlocks builds two blocks with the given flags
+func flagBlocks(flags uf2flags) []*uf2block {
+	contents := make([]byte, 2*uf2PayloadSize)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	familyID := uint32(0)
+	if flags.FamilyIDPresent {
+		familyID = familyRP2040
+	}
+	blocks := buildUF2([]*memoryMap{{addr: 0x10000000, contents: contents}}, familyID)
+	if flags.FileContainer {
+		for _, b := range blocks {
+			b.flags.FileContainer = true
+			b.addr -= 0x10000000
+			b.something = uint32(len(contents))
+			b.fileName = "dir/data.bin"
+		}
+	}
+	for _, b := range blocks {
+		b.flags.NotMainFlash = flags.NotMainFlash
+	}
+	if flags.ChecksumPresent {
+		addChecksums(blocks)
+	}
+	if flags.ExtensionTagsPresent {
+		if err := addTags(blocks, imageTags(nil, "1.0", "flags", 4096, false)); err != nil {
+			panic(err)
+		}
+	}
+	return blocks
+}
+
+func TestUF2Flags(t *testing.T) {
+	for _, flags := range allFlags() {
+		filename := flagFile(flags)
+		if *update {
+			if err := ioutil.WriteFile(filename, writeUF2(flagBlocks(flags)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks, errs := readUF2(data)
+		for _, err := range errs {
+			t.Errorf("%v: %v", filename, err)
+		}
+		if len(blocks) != 2 {
+			t.Fatalf("%v: %v blocks, expected 2", filename, len(blocks))
+		}
+		for i, b := range blocks {
+			b.Header()
+			expected := flags
+			// tags are only in the first block
+			expected.ExtensionTagsPresent = flags.ExtensionTagsPresent && i == 0
+			if b.flags != expected {
+				t.Errorf("%v: flags are %v, expected %v", filename, b.flags, expected)
+			}
+			if flags.FileContainer && b.fileName != "dir/data.bin" {
+				t.Errorf("%v: file name is %q", filename, b.fileName)
+			}
+			if flags.ChecksumPresent && b.checksum == nil {
+				t.Errorf("%v: missing checksum", filename)
+			}
+		}
+		if flags.ExtensionTagsPresent && len(blocks[0].tags) != 3 {
+			t.Errorf("%v: %v tags, expected 3", filename, len(blocks[0].tags))
+		}
+		for _, v := range verifyUF2(data) {
+			t.Errorf("%v: %v", filename, v)
+		}
+	}
+}
+
+func FuzzReadChunk(f *testing.F) {
+	for _, flags := range allFlags() {
+		data, err := ioutil.ReadFile(flagFile(flags))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data[:uf2BlockSize])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rb := newReadBuffer(data)
+		b, err := readChunk(rb)
+		if err != nil {
+			if rb.start != 0 {
+				t.Fatalf("the read buffer moved to %v on error", rb.start)
+			}
+			_ = err.Error()
+			return
+		}
+		b.Header()
+		b.HexPayload()
+		if b.payloadSize != uint32(len(b.payload)) {
+			t.Fatalf("payload of %v bytes, expected %v", len(b.payload), b.payloadSize)
+		}
+	})
+}
+
+func FuzzReadUF2(f *testing.F) {
+	data, err := ioutil.ReadFile(flagFile(uf2flags{FamilyIDPresent: true, ChecksumPresent: true}))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add(data[100:])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		blocks, _ := readUF2(data)
+		for _, g := range groupByFamily(blocks) {
+			joinBlocks(g.blocks)
+		}
+		unpackFiles(blocks)
+		verifyUF2(data)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+)
+
+// the checksum area takes the last 24 bytes of the data area
+const (
+	uf2ChecksumSize   = 24
+	uf2OffChecksum    = uf2OffData + uf2DataSize - uf2ChecksumSize
+	uf2TagHeaderSize  = 4
+	uf2TagMaxDataSize = 255 - uf2TagHeaderSize
+)
+
+// extension tag types
+const (
+	tagVersion     uint32 = 0x9FC7BC
+	tagDescription uint32 = 0x650D9D
+	tagPageSize    uint32 = 0x0BE9F7
+	tagSHA2        uint32 = 0xB46DB0
+	tagDeviceType  uint32 = 0xC8A729
+)
+
+var tagNames = map[uint32]string{
+	tagVersion:     "version",
+	tagDescription: "description",
+	tagPageSize:    "page size",
+	tagSHA2:        "SHA-2",
+	tagDeviceType:  "device type",
+}
+
+// uf2Checksum is the MD5 of a range of flash
+type uf2Checksum struct {
+	addr   uint32
+	length uint32
+	md5    [16]byte
+}
+
+func (this *uf2Checksum) String() string {
+	return fmt.Sprintf("MD5 %X of %v bytes at %08X", this.md5, this.length, this.addr)
+}
+
+type uf2Tag struct {
+	kind uint32
+	data []byte
+}
+
+func (this uf2Tag) String() string {
+	name, ok := tagNames[this.kind]
+	if !ok {
+		return fmt.Sprintf("tag %06X: %X", this.kind, this.data)
+	}
+	switch this.kind {
+	case tagVersion, tagDescription:
+		return fmt.Sprintf("%v: %q", name, this.data)
+	case tagPageSize, tagDeviceType:
+		if len(this.data) == 4 {
+			v, _ := newReadBuffer(this.data).getU32()
+			return fmt.Sprintf("%v: 0x%X", name, v)
+		}
+	}
+	return fmt.Sprintf("%v: %X", name, this.data)
+}
+
+// parseChecksum reads the checksum area from the 476 byte data area
+func parseChecksum(data []byte) *uf2Checksum {
+	rb := newReadBuffer(data[uf2DataSize-uf2ChecksumSize:])
+	out := &uf2Checksum{}
+	out.addr, _ = rb.getU32()
+	out.length, _ = rb.getU32()
+	copy(out.md5[:], rb.data[rb.start:])
+	return out
+}
+
+// parseTags reads the tags that follow the payload and the file name,
+// if any, word aligned, up to the terminating zero tag. A malformed
+// list ends at the broken tag
+func parseTags(data []byte, start uint32, hasChecksum bool) []uf2Tag {
+	end := len(data)
+	if hasChecksum {
+		end -= uf2ChecksumSize
+	}
+	out := []uf2Tag{}
+	pos := int(align(start, 4))
+	for pos+uf2TagHeaderSize <= end {
+		size := int(data[pos])
+		kind := uint32(data[pos+1]) | uint32(data[pos+2])<<8 | uint32(data[pos+3])<<16
+		if size == 0 || size < uf2TagHeaderSize || pos+size > end {
+			break
+		}
+		out = append(out, uf2Tag{kind: kind, data: data[pos+uf2TagHeaderSize : pos+size]})
+		pos += int(align(uint32(size), 4))
+	}
+	return out
+}
+
+// tagsStart is the offset in the data area where the tags may start
+func tagsStart(b *uf2block) uint32 {
+	if b.flags.FileContainer {
+		return b.payloadSize + uint32(len(b.fileName)) + 1
+	}
+	return b.payloadSize
+}
+
+// encodeTags appends the tags and the terminator, word aligned
+func encodeTags(buff []byte, tags []uf2Tag) []byte {
+	for _, t := range tags {
+		size := uf2TagHeaderSize + len(t.data)
+		buff = append(buff, byte(size), byte(t.kind), byte(t.kind>>8), byte(t.kind>>16))
+		buff = append(buff, t.data...)
+		for len(buff)%4 != 0 {
+			buff = append(buff, 0)
+		}
+	}
+	return append(buff, 0, 0, 0, 0)
+}
+
+func (this *uf2Checksum) encode(buff []byte) []byte {
+	buff = appendU32(buff, this.addr)
+	buff = appendU32(buff, this.length)
+	return append(buff, this.md5[:]...)
+}
+
+// addChecksums sets the MD5 of every block to the MD5 of its own payload
+func addChecksums(blocks []*uf2block) {
+	for _, b := range blocks {
+		b.flags.ChecksumPresent = true
+		b.checksum = &uf2Checksum{
+			addr:   b.addr,
+			length: b.payloadSize,
+			md5:    md5.Sum(b.payload),
+		}
+	}
+}
+
+// addTags places the tags in the first block
+func addTags(blocks []*uf2block, tags []uf2Tag) error {
+	if len(blocks) == 0 || len(tags) == 0 {
+		return nil
+	}
+	b := blocks[0]
+	space := uf2DataSize - int(align(tagsStart(b), 4)) - uf2TagHeaderSize
+	if b.flags.ChecksumPresent {
+		space -= uf2ChecksumSize
+	}
+	for _, t := range tags {
+		if len(t.data) > uf2TagMaxDataSize {
+			return fmt.Errorf("tag %06X is too long", t.kind)
+		}
+		space -= int(align(uint32(uf2TagHeaderSize+len(t.data)), 4))
+	}
+	if space < 0 {
+		return fmt.Errorf("tags do not fit after the payload")
+	}
+	b.flags.ExtensionTagsPresent = true
+	b.tags = tags
+	return nil
+}
+
+// imageTags builds the tags given in the command line, empty values
+// are left out. The SHA-2 tag holds the SHA-256 of the regions in order
+func imageTags(maps []*memoryMap, version, description string, pageSize uint32, sha2 bool) []uf2Tag {
+	out := []uf2Tag{}
+	if version != "" {
+		out = append(out, uf2Tag{kind: tagVersion, data: []byte(version)})
+	}
+	if description != "" {
+		out = append(out, uf2Tag{kind: tagDescription, data: []byte(description)})
+	}
+	if pageSize != 0 {
+		out = append(out, uf2Tag{kind: tagPageSize, data: appendU32(nil, pageSize)})
+	}
+	if sha2 {
+		h := sha256.New()
+		for _, m := range maps {
+			h.Write(m.contents)
+		}
+		out = append(out, uf2Tag{kind: tagSHA2, data: h.Sum(nil)})
+	}
+	return out
+}
+
+// checkChecksum compares the MD5 of a block against the flashed image
+func checkChecksum(c *uf2Checksum, maps []*memoryMap) error {
+	for _, m := range maps {
+		if m.contains(c.addr) && (c.length == 0 || m.contains(c.addr+c.length-1)) {
+			offset := c.addr - m.addr
+			sum := md5.Sum(m.contents[offset : offset+c.length])
+			if !bytes.Equal(sum[:], c.md5[:]) {
+				return fmt.Errorf("MD5 of %v bytes at 0x%08X is %X, expected %X", c.length, c.addr, sum, c.md5)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("MD5 range of %v bytes at 0x%08X is not in the image", c.length, c.addr)
+}
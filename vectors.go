@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+)
+
+// exception numbers of the ARMv6-M vector table, followed by the
+// RP2040 interrupts, empty names are reserved entries
+var vectorNames = []string{
+	"initial SP",
+	"Reset",
+	"NMI",
+	"HardFault",
+	"", "", "", "", "", "", "",
+	"SVCall",
+	"", "",
+	"PendSV",
+	"SysTick",
+	"TIMER_IRQ_0",
+	"TIMER_IRQ_1",
+	"TIMER_IRQ_2",
+	"TIMER_IRQ_3",
+	"PWM_IRQ_WRAP",
+	"USBCTRL_IRQ",
+	"XIP_IRQ",
+	"PIO0_IRQ_0",
+	"PIO0_IRQ_1",
+	"PIO1_IRQ_0",
+	"PIO1_IRQ_1",
+	"DMA_IRQ_0",
+	"DMA_IRQ_1",
+	"IO_IRQ_BANK0",
+	"IO_IRQ_QSPI",
+	"SIO_IRQ_PROC0",
+	"SIO_IRQ_PROC1",
+	"CLOCKS_IRQ",
+	"SPI0_IRQ",
+	"SPI1_IRQ",
+	"UART0_IRQ",
+	"UART1_IRQ",
+	"ADC_IRQ_FIFO",
+	"I2C0_IRQ",
+	"I2C1_IRQ",
+	"RTC_IRQ",
+}
+
+// handlers may also live in the RP2040 bootrom
+const bootromEnd = 0x4000
+
+type vector struct {
+	index int
+	name  string
+	// location of the entry
+	addr  uint32
+	value uint32
+	// empty if the entry looks fine
+	problem string
+}
+
+func (this *vector) String() string {
+	name := this.name
+	if name == "" {
+		name = "reserved"
+	}
+	out := fmt.Sprintf("%2v  %08X  %08X  %v", this.index, this.addr, this.value, name)
+	if this.problem != "" {
+		out += "\t; " + this.problem
+	}
+	return out
+}
+
+// readVectorTable reads the vector table at vtor. The table ends at the
+// last RP2040 interrupt or at the first handler that points neither
+// to the image nor to the bootrom, since small images often place code
+// right after the reset vector
+func readVectorTable(maps []*memoryMap, vtor uint32) ([]*vector, error) {
+	if vtor%4 != 0 {
+		return nil, fmt.Errorf("vector table at 0x%08X is not word aligned", vtor)
+	}
+	inImage := func(addr uint32) bool {
+		for _, m := range maps {
+			if m.contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	out := []*vector{}
+	for i, name := range vectorNames {
+		addr := vtor + uint32(i)*4
+		value, ok := wordAt(maps, addr)
+		if !ok {
+			break
+		}
+		v := &vector{index: i, name: name, addr: addr, value: value}
+		handler := value &^ 1
+		switch {
+		case i == 0:
+			if value%4 != 0 {
+				v.problem = "stack pointer is not word aligned"
+			}
+		case value == 0:
+			if i == 1 {
+				v.problem = "no reset handler"
+			}
+		case !inImage(handler) && handler >= bootromEnd:
+			if i == 1 {
+				v.problem = "reset handler is outside the image"
+				break
+			}
+			return out, nil
+		case value&1 == 0:
+			v.problem = "Thumb bit not set"
+		case name == "":
+			v.problem = "reserved entry is not zero"
+		}
+		out = append(out, v)
+	}
+	if len(out) < 2 {
+		return nil, fmt.Errorf("no vector table at 0x%08X", vtor)
+	}
+	return out, nil
+}
+
+func wordAt(maps []*memoryMap, addr uint32) (uint32, bool) {
+	for _, m := range maps {
+		if v, ok := m.word(addr); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// vectorEntries returns the handlers that can be followed as entry points
+func vectorEntries(maps []*memoryMap, table []*vector) []uint32 {
+	out := []uint32{}
+	for _, v := range table[1:] {
+		if v.value == 0 || v.value < bootromEnd {
+			continue
+		}
+		for _, m := range maps {
+			if m.contains(v.value &^ 1) {
+				out = append(out, v.value)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// vectorLabels names the handlers used by a single vector,
+// handlers shared by many vectors keep their automatic names
+func vectorLabels(table []*vector) map[uint32]string {
+	users := map[uint32][]*vector{}
+	for _, v := range table[1:] {
+		if v.value != 0 {
+			users[v.value&^1] = append(users[v.value&^1], v)
+		}
+	}
+	out := map[uint32]string{}
+	for addr, vs := range users {
+		if len(vs) == 1 && vs[0].name != "" {
+			out[addr] = vs[0].name
+		}
+	}
+	return out
+}
+
+// resetEntry returns the reset handler of the vector table at the
+// start of the image, after the boot2 block, or zero if there is none
+func resetEntry(maps []*memoryMap) uint32 {
+	_, app := splitBoot2(maps)
+	if len(app) == 0 {
+		return 0
+	}
+	table, err := readVectorTable(app, app[0].addr)
+	if err != nil {
+		return 0
+	}
+	return table[1].value
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// offsets of the UF2 block fields
+const (
+	uf2OffMagic1      = 0
+	uf2OffMagic2      = 4
+	uf2OffFlags       = 8
+	uf2OffAddr        = 12
+	uf2OffPayloadSize = 16
+	uf2OffSeqBlockNum = 20
+	uf2OffTotBlockNum = 24
+	uf2OffFamilyID    = 28
+	uf2OffData        = 32
+	uf2OffMagicFinal  = 508
+)
+
+type violation struct {
+	block  int
+	offset int
+	msg    string
+}
+
+func (this violation) String() string {
+	return fmt.Sprintf("block %v (offset 0x%X): %v", this.block, this.offset, this.msg)
+}
+
+type blockRange struct {
+	block  int
+	family uint32
+	addr   uint32
+	end    uint32
+	offset int
+}
+
+// verifyUF2 runs every structural check on the file, reading each
+// block on its own so that one broken block does not hide the others
+func verifyUF2(data []byte) []violation {
+	out := []violation{}
+	report := func(block, offset int, format string, a ...any) {
+		out = append(out, violation{block, offset, fmt.Sprintf(format, a...)})
+	}
+	if len(data)%uf2BlockSize != 0 {
+		n := len(data) / uf2BlockSize
+		report(n, n*uf2BlockSize, "%v trailing bytes after the last block", len(data)%uf2BlockSize)
+	}
+
+	ranges := []blockRange{}
+	var prevSeq, prevTot uint32
+	seqStart := 0
+	for i := 0; (i+1)*uf2BlockSize <= len(data); i++ {
+		base := i * uf2BlockSize
+		block := data[base : base+uf2BlockSize]
+		u32 := func(offset int) uint32 {
+			v, _ := newReadBuffer(block[offset : offset+4]).getU32()
+			return v
+		}
+		if v := u32(uf2OffMagic1); v != uf2Magic1 {
+			report(i, base+uf2OffMagic1, "first magic is 0x%08X, expected 0x%08X", v, uf2Magic1)
+		}
+		if v := u32(uf2OffMagic2); v != uf2Magic2 {
+			report(i, base+uf2OffMagic2, "second magic is 0x%08X, expected 0x%08X", v, uf2Magic2)
+		}
+		if v := u32(uf2OffMagicFinal); v != uf2MagicFinal {
+			report(i, base+uf2OffMagicFinal, "final magic is 0x%08X, expected 0x%08X", v, uf2MagicFinal)
+		}
+
+		flags := decodeFlags(u32(uf2OffFlags))
+		addr := u32(uf2OffAddr)
+		size := u32(uf2OffPayloadSize)
+		seq := u32(uf2OffSeqBlockNum)
+		tot := u32(uf2OffTotBlockNum)
+
+		if size > uf2DataSize {
+			report(i, base+uf2OffPayloadSize, "payload size %v is larger than %v", size, uf2DataSize)
+			size = uf2DataSize
+		}
+		if addr%4 != 0 {
+			report(i, base+uf2OffAddr, "address 0x%08X is not word aligned", addr)
+		} else if size == uf2PayloadSize && addr%uf2PayloadSize != 0 {
+			report(i, base+uf2OffAddr, "address 0x%08X is not aligned to the %v byte payload", addr, size)
+		}
+
+		// a new sequence may start once the previous one is complete,
+		// as happens when UF2 files are concatenated
+		switch {
+		case i == 0 || (seq == 0 && prevSeq+1 == prevTot):
+			if seq != 0 {
+				report(i, base+uf2OffSeqBlockNum, "block number is %v, expected 0", seq)
+			}
+			seqStart = i
+		case seq != prevSeq+1:
+			report(i, base+uf2OffSeqBlockNum, "block number is %v, expected %v", seq, prevSeq+1)
+		}
+		if i != seqStart && tot != prevTot {
+			report(i, base+uf2OffTotBlockNum, "total block count is %v, previous blocks said %v", tot, prevTot)
+		}
+		if seq >= tot {
+			report(i, base+uf2OffSeqBlockNum, "block number %v is not below the total of %v", seq, tot)
+		}
+		prevSeq, prevTot = seq, tot
+
+		// the space after the payload holds other data with these flags
+		if !flags.FileContainer && !flags.ChecksumPresent && !flags.ExtensionTagsPresent {
+			for j := uf2OffData + int(size); j < uf2OffMagicFinal; j++ {
+				if block[j] != 0 {
+					report(i, base+j, "padding after the payload is not zero")
+					break
+				}
+			}
+		}
+
+		if !flags.FileContainer {
+			r := blockRange{block: i, addr: addr, end: addr + size, offset: base + uf2OffAddr}
+			if flags.FamilyIDPresent {
+				r.family = u32(uf2OffFamilyID)
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	n := len(data) / uf2BlockSize
+	if n > 0 && prevSeq+1 != prevTot {
+		report(n-1, (n-1)*uf2BlockSize+uf2OffTotBlockNum, "file ends at block number %v of %v", prevSeq, prevTot)
+	}
+
+	// only blocks for the same family can collide
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].family != ranges[j].family {
+			return ranges[i].family < ranges[j].family
+		}
+		return ranges[i].addr < ranges[j].addr
+	})
+	for i := 1; i < len(ranges); i++ {
+		// prev is the block that reaches furthest so far
+		prev, curr := ranges[i-1], ranges[i]
+		if prev.family != curr.family {
+			continue
+		}
+		if prev.addr == curr.addr {
+			report(curr.block, curr.offset, "address 0x%08X is also written by block %v", curr.addr, prev.block)
+		} else if prev.end > curr.addr {
+			report(curr.block, curr.offset, "range 0x%08X-0x%08X overlaps block %v", curr.addr, curr.end, prev.block)
+		}
+		if prev.end > curr.end {
+			ranges[i] = prev
+		}
+	}
+
+	// checksums are compared against what ends up in flash
+	blocks, _ := readUF2(data)
+	for _, g := range groupByFamily(blocks) {
+		maps := joinBlocks(g.blocks)
+		for _, b := range g.blocks {
+			if b.checksum == nil {
+				continue
+			}
+			if err := checkChecksum(b.checksum, maps); err != nil {
+				i := b.offset / uf2BlockSize
+				report(i, b.offset+uf2OffChecksum, "%v", err)
+			}
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].offset < out[j].offset
+	})
+	return out
+}